@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+
+	"github.com/mcfx/tcoin/core"
+)
+
+func main() {
+	path := flag.String("path", "", "storage path of a stopped node")
+	gcfn := flag.String("globalConfig", "", "global config file")
+	depth := flag.Int("depth", 0, "keep the bodies of the blocks this deep below the finalized height")
+	flag.Parse()
+	if *path == "" {
+		log.Fatal("no storage path provided")
+	}
+	var gc core.ChainGlobalConfig
+	gcf, err := ioutil.ReadFile(*gcfn)
+	if err != nil {
+		log.Fatalf("failed to read global config: %v", err)
+	}
+	json.Unmarshal(gcf, &gc)
+
+	saved, err := core.CompactStorage(*path, gc, *depth)
+	if err != nil {
+		log.Fatalf("failed to compact storage: %v", err)
+	}
+	log.Printf("%d bytes saved", saved)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/mcfx/tcoin/storage"
+)
+
+func main() {
+	path := flag.String("path", "", "storage path of a stopped node, to export its finalized state")
+	out := flag.String("out", "", "snapshot file to write")
+	info := flag.String("info", "", "snapshot file to verify and show")
+	flag.Parse()
+	if *info != "" {
+		si, err := storage.ReadSnapshotInfo(*info)
+		if err != nil {
+			log.Fatalf("invalid snapshot: %v", err)
+		}
+		log.Printf("height: %d block: %s", si.Height, hex.EncodeToString(si.Key[:]))
+		return
+	}
+	if *path == "" || *out == "" {
+		log.Fatal("path and out are required for exporting")
+	}
+	b, err := storage.NewFileBackend(*path, 0)
+	if err != nil {
+		log.Fatalf("failed to open storage: %v", err)
+	}
+	defer b.Close()
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("failed to create snapshot: %v", err)
+	}
+	bf := bufio.NewWriter(f)
+	si, err := storage.ExportSnapshot(b, bf)
+	if err == nil {
+		err = bf.Flush()
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(*out)
+		log.Fatalf("failed to export snapshot: %v", err)
+	}
+	log.Printf("exported height: %d block: %s", si.Height, hex.EncodeToString(si.Key[:]))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/mcfx/tcoin/core"
+)
+
+func main() {
+	path := flag.String("path", "", "storage path of a stopped node")
+	gcfn := flag.String("globalConfig", "", "global config file")
+	repair := flag.Bool("repair", false, "truncate dangling tails and remove broken temp slices")
+	flag.Parse()
+	if *path == "" {
+		log.Fatal("no storage path provided")
+	}
+	var gc core.ChainGlobalConfig
+	gcf, err := ioutil.ReadFile(*gcfn)
+	if err != nil {
+		log.Fatalf("failed to read global config: %v", err)
+	}
+	json.Unmarshal(gcf, &gc)
+
+	report, err := core.CheckStorage(*path, gc, true, *repair)
+	if err != nil {
+		log.Fatalf("failed to check storage: %v", err)
+	}
+	log.Printf("state height: %d, records checked: %d", report.StateHeight, report.Records)
+	for _, p := range report.Repairable {
+		if *repair {
+			log.Printf("repaired: %s", p)
+		} else {
+			log.Printf("repairable: %s", p)
+		}
+	}
+	for _, p := range report.Problems {
+		log.Printf("problem: %s", p)
+	}
+	if len(report.Problems) > 0 {
+		log.Print("the storage can't be repaired, remove it and sync again (or start from a snapshot)")
+		os.Exit(1)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/mcfx/tcoin/core/block"
 	"github.com/mcfx/tcoin/utils/address"
+	"github.com/mcfx/tcoin/utils/chaininfo"
 )
 
 const rpcUrl = "http://127.0.0.1:60157/"
@@ -29,7 +30,16 @@ func newAccount() account {
 	return a
 }
 
+func readChainInfo() chaininfo.ChainInfo {
+	ci, err := chaininfo.Read(rpcUrl)
+	if err != nil {
+		panic(err)
+	}
+	return ci
+}
+
 func main() {
+	ci := readChainInfo()
 	as := []account{}
 	n := 2000
 	m := 20
@@ -51,7 +61,11 @@ func main() {
 				Nonce:        uint64(i),
 				Data:         []byte{},
 			}
-			tx.Sign(as[j].privkey)
+			if ci.Tip3Enabled {
+				tx.SignWithChainId(as[j].privkey, ci.ChainId)
+			} else {
+				tx.Sign(as[j].privkey)
+			}
 			var buf bytes.Buffer
 			err := block.EncodeTx(&buf, tx)
 			if err != nil {
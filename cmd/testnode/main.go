@@ -16,12 +16,9 @@ import (
 )
 
 func main() {
-	path := flag.String("path", "", "storage path")
+	path := flag.String("path", "", "storage path, kept in memory if empty")
 	rpcAddr := flag.String("rpc", "", "rpc listen addr")
 	flag.Parse()
-	if *path == "" {
-		log.Fatal("path can't be empty")
-	}
 	if *rpcAddr == "" {
 		log.Fatal("rpc can't be empty")
 	}
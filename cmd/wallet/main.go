@@ -18,6 +18,7 @@ import (
 
 	"github.com/mcfx/tcoin/core/block"
 	"github.com/mcfx/tcoin/utils/address"
+	"github.com/mcfx/tcoin/utils/chaininfo"
 	"github.com/mcfx/tcoin/vm"
 
 	"github.com/chzyer/readline"
@@ -54,23 +55,32 @@ func readWallet(addr string) block.AccountInfo {
 	return res.Data
 }
 
-func estimateGas(addr string, code []byte) (int, string) {
+func readChainInfo() chaininfo.ChainInfo {
+	ci, err := chaininfo.Read(rpcUrl)
+	if err != nil {
+		panic(err)
+	}
+	return ci
+}
+
+func estimateGas(addr string, code []byte) (int, uint64, string) {
 	data, _ := json.Marshal(map[string]interface{}{"origin": addr, "code": code})
 	resp, err := http.Post(rpcUrl+"estimate_gas", "application/json", bytes.NewBuffer(data))
 	if err != nil {
 		panic(err)
 	}
 	var res struct {
-		Status bool   `json:"status"`
-		Msg    string `json:"msg"`
-		Gas    int    `json:"gas"`
-		Error  string `json:"error"`
+		Status   bool   `json:"status"`
+		Msg      string `json:"msg"`
+		Gas      int    `json:"gas"`
+		GasPrice uint64 `json:"gas_price"`
+		Error    string `json:"error"`
 	}
 	json.NewDecoder(resp.Body).Decode(&res)
 	if !res.Status {
 		panic(res.Msg)
 	}
-	return res.Gas, res.Error
+	return res.Gas, res.GasPrice, res.Error
 }
 
 func runViewRawCode(addr string, code []byte) ([]byte, string) {
@@ -121,8 +131,13 @@ func main() {
 	eaddr := address.EncodeAddr(addr)
 	fmt.Printf("Address: %s\n", eaddr)
 
-	sendTx := func(txType byte, toAddr block.AddressType, amount uint64, s []byte, gasLimit uint64) {
+	sendTx := func(txType byte, toAddr block.AddressType, amount uint64, s []byte, gasLimit uint64, gasPrice uint64) {
 		ai := readWallet(eaddr)
+		ci := readChainInfo()
+		// code execution is paid by gas price after tip5, and the unused gas is refunded
+		if txType == 2 && ci.Tip5Enabled {
+			txType = 3
+		}
 		tx := &block.Transaction{
 			TxType:       txType,
 			SenderPubkey: pubkey,
@@ -133,7 +148,14 @@ func main() {
 			Nonce:        ai.Nonce,
 			Data:         s,
 		}
-		tx.Sign(privkey)
+		if txType == 3 {
+			tx.GasPrice = gasPrice
+		}
+		if ci.Tip3Enabled {
+			tx.SignWithChainId(privkey, ci.ChainId)
+		} else {
+			tx.Sign(privkey)
+		}
 		var buf bytes.Buffer
 		err = block.EncodeTx(&buf, tx)
 		if err != nil {
@@ -178,15 +200,16 @@ func main() {
 			}
 			msg := strings.Join(cmd[2:], " ")
 			amount := int(math.Round(amountF * 1e9))
-			sendTx(1, toAddr, uint64(amount), []byte(msg), 40000+uint64(len(msg)))
+			sendTx(1, toAddr, uint64(amount), []byte(msg), 40000+uint64(len(msg)), 0)
 		case "estimate_gas_asm":
 			b, err := ioutil.ReadFile(cmd[0])
 			if err != nil {
 				panic(err)
 			}
 			code := vm.AsmToBytes(string(b))
-			x, t := estimateGas(eaddr, code)
+			x, p, t := estimateGas(eaddr, code)
 			fmt.Printf("Gas used: %d\n", x)
+			fmt.Printf("Gas price: %d\n", p)
 			if t != "" {
 				fmt.Printf("Error happened: %s\n", t)
 			}
@@ -235,14 +258,14 @@ func main() {
 			}
 			var contractAddr block.AddressType
 			copy(contractAddr[:], xaddr)
-			gas, t := estimateGas(eaddr, code2)
+			gas, gasPrice, t := estimateGas(eaddr, code2)
 			if t != "" {
 				fmt.Printf("Error happened: %s\n", t)
 				return
 			}
 			fmt.Printf("gas: %d\n", gas)
 			fmt.Printf("addr: %s\n", address.EncodeAddr(contractAddr))
-			sendTx(2, block.AddressType{}, 0, code2, uint64(gas))
+			sendTx(2, block.AddressType{}, 0, code2, uint64(gas), gasPrice)
 		case "read", "write":
 			caddrt := cmd[0]
 			caddr, err := address.ParseAddr(caddrt)
@@ -486,13 +509,13 @@ func main() {
 				}
 				postProcess(funcSig[0], x)
 			} else if op == "write" {
-				gas, t := estimateGas(eaddr, code)
+				gas, gasPrice, t := estimateGas(eaddr, code)
 				if t != "" {
 					fmt.Printf("Error happened: %s\n", t)
 					return
 				}
 				fmt.Printf("gas: %d\n", gas)
-				sendTx(2, block.AddressType{}, 0, code, uint64(gas))
+				sendTx(2, block.AddressType{}, 0, code, uint64(gas), gasPrice)
 			}
 		case "parse":
 			addr, err := address.ParseAddr(cmd[0])
@@ -6,16 +6,20 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 
 	"github.com/mcfx/tcoin/storage"
 	"github.com/mcfx/tcoin/utils"
 )
 
 type BlockHeader struct {
-	Hash       HashType `json:"hash"`
-	ParentHash HashType `json:"parent_hash"`
-	BodyHash   HashType `json:"body_hash"`
-	ExtraData  HashType `json:"extra_data"`
+	Hash         HashType `json:"hash"`
+	ParentHash   HashType `json:"parent_hash"`
+	BodyHash     HashType `json:"body_hash"`
+	ExtraData    HashType `json:"extra_data"`
+	StateRoot    HashType `json:"state_root"`
+	ReceiptsRoot HashType `json:"receipts_root"`
+	Seal         SigType  `json:"seal"`
 }
 
 type Block struct {
@@ -25,14 +29,47 @@ type Block struct {
 	Txs    []*Transaction `json:"txs"`
 }
 
+// extension fields follow ExtraData, they are encoded and hashed only up to
+// the last non-zero one, so legacy headers keep their encoding and hash
+func (bh *BlockHeader) extFields() [][]byte {
+	return [][]byte{bh.StateRoot[:], bh.ReceiptsRoot[:], bh.Seal[:]}
+}
+
+func isZeroBytes(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (bh *BlockHeader) usedExtFields() [][]byte {
+	res := bh.extFields()
+	for len(res) > 0 && isZeroBytes(res[len(res)-1]) {
+		res = res[:len(res)-1]
+	}
+	return res
+}
+
 func (bh *BlockHeader) ComputeHash() HashType {
 	buf := make([]byte, HashLen*3)
 	copy(buf[:HashLen], bh.ParentHash[:])
 	copy(buf[HashLen:HashLen*2], bh.BodyHash[:])
 	copy(buf[HashLen*2:HashLen*3], bh.ExtraData[:])
+	for _, f := range bh.usedExtFields() {
+		buf = append(buf, f...)
+	}
 	return sha256.Sum256(buf)
 }
 
+// the hash signed by the seal, which is the header hash without the seal
+func (bh *BlockHeader) SealHash() HashType {
+	t := *bh
+	t.Seal = SigType{}
+	return t.ComputeHash()
+}
+
 func DecodeBlockHeader(r utils.Reader) (BlockHeader, error) {
 	var bh BlockHeader
 	buf := make([]byte, HashLen*4)
@@ -44,7 +81,20 @@ func DecodeBlockHeader(r utils.Reader) (BlockHeader, error) {
 	copy(bh.ParentHash[:], buf[HashLen:HashLen*2])
 	copy(bh.BodyHash[:], buf[HashLen*2:HashLen*3])
 	copy(bh.ExtraData[:], buf[HashLen*3:HashLen*4])
-	if sha256.Sum256(buf[HashLen:]) != bh.Hash {
+	// the number of extension fields is the one that matches the hash
+	exts := bh.extFields()
+	for i := 0; sha256.Sum256(buf[HashLen:]) != bh.Hash; i++ {
+		if i == len(exts) {
+			return bh, errors.New("block header hash mismatch")
+		}
+		_, err = io.ReadFull(r, exts[i])
+		if err != nil {
+			return bh, err
+		}
+		buf = append(buf, exts[i]...)
+	}
+	// reject trailing zero fields, which are never encoded
+	if bh.ComputeHash() != bh.Hash {
 		return bh, errors.New("block header hash mismatch")
 	}
 	return bh, nil
@@ -56,6 +106,9 @@ func EncodeBlockHeader(w utils.Writer, bh BlockHeader) error {
 	copy(buf[HashLen:HashLen*2], bh.ParentHash[:])
 	copy(buf[HashLen*2:HashLen*3], bh.BodyHash[:])
 	copy(buf[HashLen*3:HashLen*4], bh.ExtraData[:])
+	for _, f := range bh.usedExtFields() {
+		buf = append(buf, f...)
+	}
 	_, err := w.Write(buf)
 	if err != nil {
 		return err
@@ -143,21 +196,85 @@ func EncodeBlock(w utils.Writer, b *Block) error {
 	return nil
 }
 
-func ExecuteBlock(b *Block, reward uint64, s *storage.Slice, ctx *ExecutionContext) error {
-	var totalFee uint64 = 0
+// the sum of the gas limits of the txs, saturated on overflow
+func (b *Block) GasLimit() uint64 {
+	var res uint64 = 0
 	for _, tx := range b.Txs {
-		err := ExecuteTx(tx, s, ctx)
+		if res+tx.GasLimit < res {
+			return math.MaxUint64
+		}
+		res += tx.GasLimit
+	}
+	return res
+}
+
+func (b *Block) EncodedSize() int {
+	var buf bytes.Buffer
+	EncodeBlock(&buf, b)
+	return buf.Len()
+}
+
+func CheckBlockLimits(b *Block, ctx *ExecutionContext) error {
+	if ctx.BlockGasLimit != 0 && b.GasLimit() > ctx.BlockGasLimit {
+		return errors.New("block gas limit exceeded")
+	}
+	if ctx.BlockSizeLimit != 0 && b.EncodedSize() > ctx.BlockSizeLimit {
+		return errors.New("block size limit exceeded")
+	}
+	return nil
+}
+
+func ExecuteBlock(b *Block, reward uint64, s *storage.Slice, ctx *ExecutionContext) ([]*Receipt, error) {
+	err := CheckBlockLimits(b, ctx)
+	if err != nil {
+		return nil, err
+	}
+	var totalFee uint64 = 0
+	rs := make([]*Receipt, len(b.Txs))
+	for i, tx := range b.Txs {
+		rc, err := ExecuteTxWithReceipt(tx, s, ctx)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		totalFee += tx.Fee // it won't overflow since the total amount is bounded
+		rs[i] = rc
+		totalFee += tx.FeeForGas(rc.GasUsed) // it won't overflow since the total amount is bounded
+	}
+	err = FinishBlock(b, totalFee+reward, s, ctx)
+	if err != nil {
+		return nil, err
 	}
+	return rs, nil
+}
+
+// pay the fees and the reward to the miner after the txs of the block are
+// executed, and update the state root after tip2, the tree is built from the
+// whole state at the first block of tip2
+func FinishBlock(b *Block, value uint64, s *storage.Slice, ctx *ExecutionContext) error {
 	info := GetAccountInfo(s, b.Miner)
-	info.Balance += totalFee + reward
+	info.Balance += value
 	SetAccountInfo(s, b.Miner, info)
 	if ctx.Callback != nil {
-		ctx.Callback.Transfer(s, AddressType{}, b.Miner, totalFee+reward, nil, nil, ctx)
+		ctx.Callback.Transfer(s, AddressType{}, b.Miner, value, nil, nil, ctx)
 		ctx.Callback.Block(s, b, ctx)
 	}
+	if !ctx.Tip2Enabled {
+		return nil
+	}
+	if s.StateRoot() == (storage.HashType{}) {
+		_, err := s.BuildStateRoot()
+		return err
+	}
+	s.UpdateStateRoot()
+	return nil
+}
+
+func CheckStateRoot(b *Block, s *storage.Slice, ctx *ExecutionContext) error {
+	var root HashType
+	if ctx.Tip2Enabled {
+		root = HashType(s.StateRoot())
+	}
+	if b.Header.StateRoot != root {
+		return errors.New("state root mismatch")
+	}
 	return nil
 }
@@ -93,7 +93,7 @@ func TestBlockFeeExec(t *testing.T) {
 		Txs:   []*Transaction{tx},
 	}
 	blk.FillHash()
-	err := ExecuteBlock(blk, 1000000, s, &ExecutionContext{})
+	_, err := ExecuteBlock(blk, 1000000, s, &ExecutionContext{})
 	if err != nil {
 		t.Fatal("failed to execute block")
 	}
@@ -106,3 +106,159 @@ func TestBlockFeeExec(t *testing.T) {
 		t.Fatalf("account 2 balance invalid: %d", info.Balance)
 	}
 }
+
+func TestBlockHeaderStateRoot(t *testing.T) {
+	blk := &Block{
+		Header: BlockHeader{
+			ParentHash: HashType{1, 2, 4},
+			ExtraData:  HashType{1, 2, 5},
+		},
+		Miner: AddressType{1, 2, 6},
+		Time:  127,
+		Txs:   []*Transaction{},
+	}
+	blk.FillHash()
+	legacy := blk.Header.Hash
+	blk.Header.StateRoot = HashType{7, 8, 9}
+	blk.FillHash()
+	if blk.Header.Hash == legacy {
+		t.Fatal("state root not committed")
+	}
+	var b bytes.Buffer
+	err := EncodeBlock(&b, blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk2, err := DecodeBlock(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(blk, blk2) {
+		t.Fatal("not equal")
+	}
+	blk.Header.StateRoot = HashType{}
+	blk.FillHash()
+	if blk.Header.Hash != legacy {
+		t.Fatal("legacy header hash changed")
+	}
+
+	s := storage.EmptySlice()
+	_, err = ExecuteBlock(blk, 1000000, s, &ExecutionContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CheckStateRoot(blk, s, &ExecutionContext{}) != nil {
+		t.Fatal("state root should be zero before tip2")
+	}
+	if s.StateRoot() != (storage.HashType{}) {
+		t.Fatal("state tree kept before tip2")
+	}
+	s = storage.EmptySlice()
+	_, err = ExecuteBlock(blk, 1000000, s, &ExecutionContext{Tip2Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CheckStateRoot(blk, s, &ExecutionContext{Tip2Enabled: true}) == nil {
+		t.Fatal("state root should be checked after tip2")
+	}
+	blk.Header.StateRoot = HashType(s.StateRoot())
+	if CheckStateRoot(blk, s, &ExecutionContext{Tip2Enabled: true}) != nil {
+		t.Fatal("state root rejected")
+	}
+}
+
+func TestAccountProof(t *testing.T) {
+	blk := &Block{
+		Header: BlockHeader{
+			ParentHash: HashType{1, 2, 4},
+		},
+		Miner: AddressType{1, 2, 6},
+		Time:  127,
+		Txs:   []*Transaction{},
+	}
+	s := storage.EmptySlice()
+	pos := HashType{3}
+	val := storage.DataType{4}
+	key := storage.KeyType{2}
+	copy(key[1:33], blk.Miner[:])
+	copy(key[33:], pos[:])
+	s.Write(key, val)
+	_, err := ExecuteBlock(blk, 1000000, s, &ExecutionContext{Tip2Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk.Header.StateRoot = HashType(s.StateRoot())
+	blk.FillHash()
+	bh := &blk.Header
+	info := GetAccountInfo(s, blk.Miner)
+	p := s.ProveState(storage.KeyType{1})
+	if VerifyAccountProof(bh, blk.Miner, info, p) == nil {
+		t.Fatal("proof of another key accepted")
+	}
+	key = storage.KeyType{1}
+	copy(key[1:33], blk.Miner[:])
+	p = s.ProveState(key)
+	if err := VerifyAccountProof(bh, blk.Miner, info, p); err != nil {
+		t.Fatal(err)
+	}
+	info.Balance++
+	if VerifyAccountProof(bh, blk.Miner, info, p) == nil {
+		t.Fatal("wrong balance accepted")
+	}
+	other := AddressType{7}
+	copy(key[1:33], other[:])
+	p = s.ProveState(key)
+	if err := VerifyAccountProof(bh, other, AccountInfo{}, p); err != nil {
+		t.Fatal(err)
+	}
+	key = storage.KeyType{2}
+	copy(key[1:33], blk.Miner[:])
+	copy(key[33:], pos[:])
+	p = s.ProveState(key)
+	if err := VerifyStorageProof(bh, blk.Miner, pos, val, p); err != nil {
+		t.Fatal(err)
+	}
+	bh.ExtraData[0]++
+	if VerifyStorageProof(bh, blk.Miner, pos, val, p) == nil {
+		t.Fatal("tampered header accepted")
+	}
+}
+
+func TestBlockLimits(t *testing.T) {
+	blk := &Block{
+		Miner: AddressType{1, 2, 6},
+		Time:  127,
+		Txs:   []*Transaction{},
+	}
+	for i := 0; i < 3; i++ {
+		blk.Txs = append(blk.Txs, &Transaction{
+			TxType:   1,
+			GasLimit: 100000,
+			Data:     make([]byte, 1000),
+		})
+	}
+	if blk.GasLimit() != 300000 {
+		t.Fatal("gas limit mismatch")
+	}
+	size := blk.EncodedSize()
+	if CheckBlockLimits(blk, &ExecutionContext{}) != nil {
+		t.Fatal("limits should be disabled by default")
+	}
+	if CheckBlockLimits(blk, &ExecutionContext{BlockGasLimit: 300000, BlockSizeLimit: size}) != nil {
+		t.Fatal("block within limits rejected")
+	}
+	if CheckBlockLimits(blk, &ExecutionContext{BlockGasLimit: 299999}) == nil {
+		t.Fatal("gas limit not enforced")
+	}
+	if CheckBlockLimits(blk, &ExecutionContext{BlockSizeLimit: size - 1}) == nil {
+		t.Fatal("size limit not enforced")
+	}
+	_, err := ExecuteBlock(blk, 1000000, storage.EmptySlice(), &ExecutionContext{BlockSizeLimit: size - 1})
+	if err == nil {
+		t.Fatal("block over limits executed")
+	}
+	blk.Txs[0].GasLimit = ^uint64(0)
+	if CheckBlockLimits(blk, &ExecutionContext{BlockGasLimit: 300000}) == nil {
+		t.Fatal("gas limit overflow")
+	}
+}
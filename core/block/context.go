@@ -14,5 +14,13 @@ type ExecutionContext struct {
 	Difficulty  HashType
 	ChainId     uint16
 	Tip1Enabled bool
-	Callback    *ExecutionCallback
+	Tip2Enabled bool
+	Tip3Enabled bool
+	Tip4Enabled bool
+	Tip5Enabled bool
+	Tip7Enabled bool
+	// zero means unlimited
+	BlockGasLimit  uint64
+	BlockSizeLimit int
+	Callback       *ExecutionCallback
 }
@@ -0,0 +1,38 @@
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/mcfx/tcoin/storage"
+)
+
+func verifyHeaderProof(bh *BlockHeader, key storage.KeyType, val storage.DataType, p *storage.StateProof) error {
+	if bh.ComputeHash() != bh.Hash {
+		return errors.New("block header hash mismatch")
+	}
+	if bh.StateRoot == (HashType{}) {
+		return errors.New("block header has no state root")
+	}
+	return storage.VerifyStateProof(storage.HashType(bh.StateRoot), key, val, p)
+}
+
+// check the account info against the state root of the header, the header
+// itself should be checked by the caller (e.g. it's on the best chain)
+func VerifyAccountProof(bh *BlockHeader, addr AddressType, info AccountInfo, p *storage.StateProof) error {
+	key := storage.KeyType{}
+	key[0] = 1
+	copy(key[1:33], addr[:])
+	val := storage.DataType{}
+	binary.LittleEndian.PutUint64(val[:8], info.Balance)
+	binary.LittleEndian.PutUint64(val[8:16], info.Nonce)
+	return verifyHeaderProof(bh, key, val, p)
+}
+
+func VerifyStorageProof(bh *BlockHeader, addr AddressType, pos HashType, val storage.DataType, p *storage.StateProof) error {
+	key := storage.KeyType{}
+	key[0] = 2
+	copy(key[1:33], addr[:])
+	copy(key[33:], pos[:])
+	return verifyHeaderProof(bh, key, val, p)
+}
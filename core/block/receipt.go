@@ -0,0 +1,352 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/mcfx/tcoin/utils"
+	"github.com/mcfx/tcoin/vm"
+)
+
+const MaxReceiptErrorLen = 1024
+
+// the status of a receipt is committed in the receipts root instead of the
+// error message, so the messages may change without forking the chain, an
+// error not listed here is ReceiptFailed
+const (
+	ReceiptFailed = iota
+	ReceiptSuccess
+	ReceiptInsufficientGas
+	ReceiptReverted
+	ReceiptInsufficientBalance
+	ReceiptContractNotExist
+	ReceiptContractExists
+	ReceiptIllegalEntry
+	ReceiptInvalidSyscall
+	ReceiptIllegalSyscallParameters
+	ReceiptInvalidJumpDest
+	ReceiptIllegalInstruction
+	ReceiptDivision
+	ReceiptUnalignedMemoryAccess
+	ReceiptIllegalPc
+	ReceiptSegFault
+	ReceiptTooManyPrograms
+)
+
+var receiptErrors = []struct {
+	err    error
+	status byte
+}{
+	{vm.ErrInsufficientGas, ReceiptInsufficientGas},
+	{ErrReverted, ReceiptReverted},
+	{ErrInsufficientBalance, ReceiptInsufficientBalance},
+	{ErrContractNotExist, ReceiptContractNotExist},
+	{ErrContractExists, ReceiptContractExists},
+	{ErrIllegalEntry, ReceiptIllegalEntry},
+	{ErrInvalidSyscall, ReceiptInvalidSyscall},
+	{ErrIllegalSyscallParameters, ReceiptIllegalSyscallParameters},
+	{ErrInvalidJumpDest, ReceiptInvalidJumpDest},
+	{vm.ErrIllegalInstruction, ReceiptIllegalInstruction},
+	{vm.ErrDivision, ReceiptDivision},
+	{vm.ErrUnalignedMemoryAccess, ReceiptUnalignedMemoryAccess},
+	{vm.ErrIllegalPc, ReceiptIllegalPc},
+	{vm.ErrSegFault, ReceiptSegFault},
+	{vm.ErrTooManyPrograms, ReceiptTooManyPrograms},
+}
+
+func ReceiptStatus(err error) byte {
+	if err == nil {
+		return ReceiptSuccess
+	}
+	for _, e := range receiptErrors {
+		if errors.Is(err, e.err) {
+			return e.status
+		}
+	}
+	return ReceiptFailed
+}
+
+type Receipt struct {
+	TxHash  HashType      `json:"tx_hash"`
+	Success bool          `json:"success"`
+	Status  byte          `json:"status"`
+	GasUsed uint64        `json:"gas_used"`
+	Error   string        `json:"error"`
+	Created []AddressType `json:"created"`
+	Logs    []*Log        `json:"logs"`
+}
+
+type Log struct {
+	Address AddressType `json:"address"`
+	Topics  []HashType  `json:"topics"`
+	Data    []byte      `json:"data"`
+}
+
+func DecodeLog(r utils.Reader) (*Log, error) {
+	l := &Log{}
+	_, err := io.ReadFull(r, l.Address[:])
+	if err != nil {
+		return nil, err
+	}
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxLogTopics {
+		return nil, errors.New("too much log topics")
+	}
+	l.Topics = make([]HashType, n)
+	for i := 0; i < int(n); i++ {
+		_, err = io.ReadFull(r, l.Topics[i][:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	dataLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if dataLen > MaxLogDataLen {
+		return nil, errors.New("invalid data length")
+	}
+	l.Data = make([]byte, dataLen)
+	_, err = io.ReadFull(r, l.Data)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func EncodeLog(w utils.Writer, l *Log) error {
+	_, err := w.Write(l.Address[:])
+	if err != nil {
+		return err
+	}
+	err = w.WriteByte(byte(len(l.Topics)))
+	if err != nil {
+		return err
+	}
+	for _, t := range l.Topics {
+		_, err = w.Write(t[:])
+		if err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	cur := binary.PutUvarint(buf, uint64(len(l.Data)))
+	_, err = w.Write(buf[:cur])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(l.Data)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func DecodeReceipt(r utils.Reader) (*Receipt, error) {
+	rc := &Receipt{}
+	_, err := io.ReadFull(r, rc.TxHash[:])
+	if err != nil {
+		return nil, err
+	}
+	t, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	rc.Status = t
+	rc.Success = t == ReceiptSuccess
+	rc.GasUsed, err = binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	errLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if errLen > MaxReceiptErrorLen {
+		return nil, errors.New("invalid error length")
+	}
+	buf := make([]byte, errLen)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	rc.Error = string(buf)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > (1 << 16) {
+		return nil, errors.New("too much created contracts")
+	}
+	rc.Created = make([]AddressType, n)
+	for i := 0; i < int(n); i++ {
+		_, err = io.ReadFull(r, rc.Created[i][:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	n, err = binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > (1 << 16) {
+		return nil, errors.New("too much logs")
+	}
+	rc.Logs = make([]*Log, n)
+	for i := 0; i < int(n); i++ {
+		rc.Logs[i], err = DecodeLog(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func EncodeReceipt(w utils.Writer, rc *Receipt) error {
+	return encodeReceipt(w, rc, true)
+}
+
+// the error message is left out of the hash
+func encodeReceipt(w utils.Writer, rc *Receipt, withError bool) error {
+	_, err := w.Write(rc.TxHash[:])
+	if err != nil {
+		return err
+	}
+	err = w.WriteByte(rc.Status)
+	if err != nil {
+		return err
+	}
+	es := rc.Error
+	if len(es) > MaxReceiptErrorLen {
+		es = es[:MaxReceiptErrorLen]
+	}
+	buf := make([]byte, binary.MaxVarintLen64*3)
+	cur := binary.PutUvarint(buf, rc.GasUsed)
+	if withError {
+		cur += binary.PutUvarint(buf[cur:], uint64(len(es)))
+	}
+	_, err = w.Write(buf[:cur])
+	if err != nil {
+		return err
+	}
+	if withError {
+		_, err = w.Write([]byte(es))
+		if err != nil {
+			return err
+		}
+	}
+	cur = binary.PutUvarint(buf, uint64(len(rc.Created)))
+	_, err = w.Write(buf[:cur])
+	if err != nil {
+		return err
+	}
+	for _, a := range rc.Created {
+		_, err = w.Write(a[:])
+		if err != nil {
+			return err
+		}
+	}
+	cur = binary.PutUvarint(buf, uint64(len(rc.Logs)))
+	_, err = w.Write(buf[:cur])
+	if err != nil {
+		return err
+	}
+	for _, l := range rc.Logs {
+		err = EncodeLog(w, l)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receipts are stored after the block, a missing list (blocks stored by
+// older versions) is decoded as nil
+func DecodeReceipts(r utils.Reader) ([]*Receipt, error) {
+	n, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n > (1 << 20) {
+		return nil, errors.New("too much receipts")
+	}
+	res := make([]*Receipt, n)
+	for i := 0; i < int(n); i++ {
+		res[i], err = DecodeReceipt(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func EncodeReceipts(w utils.Writer, rs []*Receipt) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	cur := binary.PutUvarint(buf, uint64(len(rs)))
+	_, err := w.Write(buf[:cur])
+	if err != nil {
+		return err
+	}
+	for _, rc := range rs {
+		err = EncodeReceipt(w, rc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rc *Receipt) Hash() HashType {
+	var buf bytes.Buffer
+	buf.WriteByte(0)
+	encodeReceipt(&buf, rc, false)
+	return sha256.Sum256(buf.Bytes())
+}
+
+// binary merkle tree over the receipt hashes, an odd node is carried up as is,
+// and the root of no receipts is zero
+func ReceiptsRoot(rs []*Receipt) HashType {
+	if len(rs) == 0 {
+		return HashType{}
+	}
+	hs := make([]HashType, len(rs))
+	for i, rc := range rs {
+		hs[i] = rc.Hash()
+	}
+	buf := make([]byte, 1+HashLen*2)
+	buf[0] = 1
+	for len(hs) > 1 {
+		n := (len(hs) + 1) / 2
+		for i := 0; i < n; i++ {
+			if i*2+1 == len(hs) {
+				hs[i] = hs[i*2]
+				continue
+			}
+			copy(buf[1:1+HashLen], hs[i*2][:])
+			copy(buf[1+HashLen:], hs[i*2+1][:])
+			hs[i] = sha256.Sum256(buf)
+		}
+		hs = hs[:n]
+	}
+	return hs[0]
+}
+
+func CheckReceiptsRoot(b *Block, rs []*Receipt, ctx *ExecutionContext) error {
+	var root HashType
+	if ctx.Tip4Enabled {
+		root = ReceiptsRoot(rs)
+	}
+	if b.Header.ReceiptsRoot != root {
+		return errors.New("receipts root mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/mcfx/tcoin/storage"
+	"github.com/mcfx/tcoin/vm"
+)
+
+func TestReceiptSerialization(t *testing.T) {
+	rs := []*Receipt{
+		{
+			TxHash:  HashType{1, 2, 3},
+			Success: true,
+			Status:  ReceiptSuccess,
+			GasUsed: 12345,
+			Created: []AddressType{{4}, {5, 6}},
+			Logs: []*Log{
+				{Address: AddressType{8}, Topics: []HashType{{9}, {10}}, Data: []byte{11, 12}},
+				{Address: AddressType{13}, Topics: []HashType{}, Data: []byte{}},
+			},
+		},
+		{
+			TxHash:  HashType{7},
+			Status:  ReceiptReverted,
+			GasUsed: 100000,
+			Error:   "reverted: test",
+			Created: []AddressType{},
+			Logs:    []*Log{},
+		},
+	}
+	var b bytes.Buffer
+	err := EncodeReceipts(&b, rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs2, err := DecodeReceipts(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rs, rs2) {
+		t.Fatal("not equal")
+	}
+	rs2, err = DecodeReceipts(&b)
+	if err != nil || rs2 != nil {
+		t.Fatal("missing receipts should be decoded as nil")
+	}
+}
+
+func TestReceiptStatus(t *testing.T) {
+	if ReceiptStatus(nil) != ReceiptSuccess || ReceiptStatus(errors.New("test")) != ReceiptFailed {
+		t.Fatal("wrong status")
+	}
+	if ReceiptStatus(vm.ErrInsufficientGas) != ReceiptInsufficientGas {
+		t.Fatal("wrong status of insufficient gas")
+	}
+	if ReceiptStatus(fmt.Errorf("%w: test", ErrReverted)) != ReceiptReverted {
+		t.Fatal("wrong status of revert")
+	}
+	rc := &Receipt{TxHash: HashType{7}, Status: ReceiptReverted, Error: "reverted: test"}
+	rc2 := *rc
+	rc2.Error = "reverted: other"
+	if rc.Hash() != rc2.Hash() {
+		t.Fatal("error message shouldn't be hashed")
+	}
+	rc2.Status = ReceiptFailed
+	if rc.Hash() == rc2.Hash() {
+		t.Fatal("status should be hashed")
+	}
+}
+
+func TestBlockReceipts(t *testing.T) {
+	rnd := rand.New(rand.NewSource(114517))
+	pubk1, prik1 := GenKeyPair(rnd)
+	addr1 := PubkeyToAddress(pubk1)
+	s := storage.EmptySlice()
+	SetAccountInfo(s, addr1, AccountInfo{Balance: 10000000})
+	s.Freeze()
+	blk := &Block{
+		Miner: AddressType{1, 2, 6},
+		Time:  127,
+		Txs:   []*Transaction{},
+	}
+	for i := 0; i < 3; i++ {
+		tx := &Transaction{
+			TxType:       1,
+			SenderPubkey: pubk1,
+			Receiver:     AddressType{2},
+			Value:        1000,
+			GasLimit:     100000,
+			Fee:          100,
+			Nonce:        uint64(i),
+			Data:         []byte{1, 2, 3},
+		}
+		tx.Sign(prik1)
+		blk.Txs = append(blk.Txs, tx)
+	}
+	ctx := &ExecutionContext{Tip1Enabled: true, Tip4Enabled: true}
+	rs, err := ExecuteBlock(blk, 1000000, storage.ForkSlice(s), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 3 {
+		t.Fatal("receipt count mismatch")
+	}
+	for i, rc := range rs {
+		if rc.TxHash != blk.Txs[i].Hash() || !rc.Success || rc.Status != ReceiptSuccess || rc.GasUsed != GasSyscallBase[SYSCALL_TRANSFER]+3 {
+			t.Fatalf("receipt %d invalid", i)
+		}
+	}
+	if CheckReceiptsRoot(blk, rs, ctx) == nil {
+		t.Fatal("receipts root should be checked after tip4")
+	}
+	if CheckReceiptsRoot(blk, rs, &ExecutionContext{}) != nil {
+		t.Fatal("receipts root should be zero before tip4")
+	}
+	blk.Header.ReceiptsRoot = ReceiptsRoot(rs)
+	if CheckReceiptsRoot(blk, rs, ctx) != nil {
+		t.Fatal("receipts root rejected")
+	}
+	if ReceiptsRoot(rs[:2]) == blk.Header.ReceiptsRoot {
+		t.Fatal("receipts root doesn't commit all receipts")
+	}
+	blk.FillHash()
+	var b bytes.Buffer
+	err = EncodeBlock(&b, blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk2, err := DecodeBlock(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(blk, blk2) {
+		t.Fatal("not equal")
+	}
+}
@@ -21,6 +21,7 @@ type Transaction struct {
 	Value        uint64      `json:"value"`
 	GasLimit     uint64      `json:"gas_limit"`
 	Fee          uint64      `json:"fee"`
+	GasPrice     uint64      `json:"gas_price"`
 	Nonce        uint64      `json:"nonce"`
 	Data         []byte      `json:"data"`
 }
@@ -54,7 +55,12 @@ func DecodeTx(r utils.Reader) (*Transaction, error) {
 	if err != nil {
 		return nil, err
 	}
-	tx.Fee, err = binary.ReadUvarint(r)
+	// type 3 transactions pay gasUsed * GasPrice instead of a flat fee
+	if tx.TxType == 3 {
+		tx.GasPrice, err = binary.ReadUvarint(r)
+	} else {
+		tx.Fee, err = binary.ReadUvarint(r)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +106,11 @@ func EncodeTx(w utils.Writer, tx *Transaction) error {
 		cur += binary.PutUvarint(buf[cur:], tx.Value)
 	}
 	cur += binary.PutUvarint(buf[cur:], tx.GasLimit)
-	cur += binary.PutUvarint(buf[cur:], tx.Fee)
+	if tx.TxType == 3 {
+		cur += binary.PutUvarint(buf[cur:], tx.GasPrice)
+	} else {
+		cur += binary.PutUvarint(buf[cur:], tx.Fee)
+	}
 	cur += binary.PutUvarint(buf[cur:], tx.Nonce)
 	cur += binary.PutUvarint(buf[cur:], uint64(len(tx.Data)))
 	_, err = w.Write(buf[:cur])
@@ -125,7 +135,11 @@ func (tx *Transaction) prepareSignData() []byte {
 	copy(sbuf[:AddressLen], tx.Receiver[:])
 	binary.BigEndian.PutUint64(sbuf[AddressLen:AddressLen+8], tx.Value)
 	binary.BigEndian.PutUint64(sbuf[AddressLen+8:AddressLen+16], tx.GasLimit)
-	binary.BigEndian.PutUint64(sbuf[AddressLen+16:AddressLen+24], tx.Fee)
+	if tx.TxType == 3 {
+		binary.BigEndian.PutUint64(sbuf[AddressLen+16:AddressLen+24], tx.GasPrice)
+	} else {
+		binary.BigEndian.PutUint64(sbuf[AddressLen+16:AddressLen+24], tx.Fee)
+	}
 	if tx.TxType == 1 {
 		binary.BigEndian.PutUint64(sbuf[AddressLen+24:AddressLen+32], tx.Nonce)
 		sbuf = sbuf[:AddressLen+8*4]
@@ -136,54 +150,139 @@ func (tx *Transaction) prepareSignData() []byte {
 	return append(sbuf, tx.Data...)
 }
 
+// after tip3, the chain id is bound into the signature to prevent replays across
+// chains, the hashed message is shorter than any legacy one so they never collide
+func (tx *Transaction) prepareSignDataWithChainId(chainId uint16) []byte {
+	buf := []byte("tcoin tx\x00\x00")
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], chainId)
+	hs := sha256.Sum256(append(buf, tx.prepareSignData()...))
+	return hs[:]
+}
+
 func (tx *Transaction) Sign(privKey PrivkeyType) {
 	data := tx.prepareSignData()
 	copy(tx.SenderSig[:], ed25519.Sign(privKey[:], data))
 }
 
+func (tx *Transaction) SignWithChainId(privKey PrivkeyType, chainId uint16) {
+	data := tx.prepareSignDataWithChainId(chainId)
+	copy(tx.SenderSig[:], ed25519.Sign(privKey[:], data))
+}
+
+// the fee paid to the miner
+func (tx *Transaction) FeeForGas(gasUsed uint64) uint64 {
+	if tx.TxType == 3 {
+		return gasUsed * tx.GasPrice
+	}
+	return tx.Fee
+}
+
+// the price per gas the sender is willing to pay, used to prioritize txs
+func (tx *Transaction) EffectiveGasPrice() uint64 {
+	if tx.TxType == 3 {
+		return tx.GasPrice
+	}
+	if tx.GasLimit == 0 {
+		return tx.Fee
+	}
+	return tx.Fee / tx.GasLimit
+}
+
 func ExecuteTx(tx *Transaction, s *storage.Slice, ctx *ExecutionContext) error {
-	if tx.TxType != 1 && tx.TxType != 2 {
+	_, err := ExecuteTxWithReceipt(tx, s, ctx)
+	return err
+}
+
+// check the type and the signature of the tx, which don't depend on the state
+func CheckTx(tx *Transaction, ctx *ExecutionContext) error {
+	if tx.TxType < 1 || tx.TxType > 3 {
 		return errors.New("wrong tx type")
 	}
-	if tx.TxType == 2 && !ctx.Tip1Enabled {
+	if (tx.TxType == 2 && !ctx.Tip1Enabled) || (tx.TxType == 3 && !ctx.Tip5Enabled) {
 		return errors.New("wrong tx type")
 	}
-	sbuf := tx.prepareSignData()
+	// the gas of a vm tx below the base would be refunded in full
+	if (tx.TxType == 2 || tx.TxType == 3) && ctx.Tip5Enabled && tx.GasLimit < GasVmTxRawCode {
+		return vm.ErrInsufficientGas
+	}
+	var sbuf []byte
+	if ctx.Tip3Enabled {
+		sbuf = tx.prepareSignDataWithChainId(ctx.ChainId)
+	} else {
+		sbuf = tx.prepareSignData()
+	}
 	if !ed25519.Verify(tx.SenderPubkey[:], sbuf, tx.SenderSig[:]) {
 		return errors.New("signature mismatch")
 	}
+	return nil
+}
+
+// an error means the tx is invalid and can't be included, while a failed
+// execution of a valid tx is reported in the receipt
+func ExecuteTxWithReceipt(tx *Transaction, s *storage.Slice, ctx *ExecutionContext) (*Receipt, error) {
+	err := CheckTx(tx, ctx)
+	if err != nil {
+		return nil, err
+	}
 	senderAddr := PubkeyToAddress(tx.SenderPubkey)
 	senderAccount := GetAccountInfo(s, senderAddr)
-	totalValue := tx.Value + tx.Fee
+	maxFee := tx.Fee
+	if tx.TxType == 3 {
+		maxFee = tx.GasLimit * tx.GasPrice
+		if tx.GasPrice != 0 && maxFee/tx.GasPrice != tx.GasLimit {
+			return nil, errors.New("integer overflow")
+		}
+	}
+	totalValue := tx.Value + maxFee
 	if totalValue < tx.Value {
-		return errors.New("integer overflow")
+		return nil, errors.New("integer overflow")
 	}
 	if senderAccount.Balance < totalValue {
-		return errors.New("balance not enough")
+		return nil, errors.New("balance not enough")
 	}
 	if senderAccount.Nonce != tx.Nonce {
-		return errors.New("nonce mismatch")
+		return nil, errors.New("nonce mismatch")
 	}
 	if tx.TxType == 1 && ctx.Tip1Enabled && tx.GasLimit < GasSyscallBase[SYSCALL_TRANSFER]+uint64(len(tx.Data)) {
-		return vm.ErrInsufficientGas
+		return nil, vm.ErrInsufficientGas
 	}
 	senderAccount.Balance -= totalValue
 	senderAccount.Nonce++
 	SetAccountInfo(s, senderAddr, senderAccount)
+	rc := &Receipt{
+		TxHash:  tx.Hash(),
+		Success: true,
+		Status:  ReceiptSuccess,
+		Created: []AddressType{},
+		Logs:    []*Log{},
+	}
 	switch tx.TxType {
 	case 1:
+		if ctx.Tip1Enabled {
+			rc.GasUsed = GasSyscallBase[SYSCALL_TRANSFER] + uint64(len(tx.Data))
+		}
 		receiverAccount := GetAccountInfo(s, tx.Receiver)
 		receiverAccount.Balance += tx.Value
 		SetAccountInfo(s, tx.Receiver, receiverAccount)
 		if ctx.Callback != nil {
 			ctx.Callback.Transfer(s, senderAddr, tx.Receiver, tx.Value, tx.Data, tx, ctx)
 		}
-	case 2:
+	case 2, 3:
 		newS := storage.ForkSlice(s)
-		_, err := ExecVmTxRawCode(senderAddr, tx.GasLimit, tx.Data, newS, ctx, tx)
+		rem, err := execVmTxRawCode(senderAddr, tx.GasLimit, tx.Data, newS, ctx, tx, rc)
+		rc.GasUsed = tx.GasLimit - rem
 		if err == nil {
 			newS.Merge()
+		} else {
+			rc.Success = false
+			rc.Status = ReceiptStatus(err)
+			rc.Error = err.Error()
+		}
+		if tx.TxType == 3 && rem > 0 {
+			senderAccount = GetAccountInfo(s, senderAddr)
+			senderAccount.Balance += rem * tx.GasPrice
+			SetAccountInfo(s, senderAddr, senderAccount)
 		}
 	}
-	return nil
+	return rc, nil
 }
@@ -14,7 +14,7 @@ import (
 
 func TestTransactionSerialization(t *testing.T) {
 	rnd := rand.New(rand.NewSource(114514))
-	for tp := 1; tp <= 2; tp++ {
+	for tp := 1; tp <= 3; tp++ {
 		tx := &Transaction{
 			TxType:   byte(tp),
 			Value:    rnd.Uint64(),
@@ -27,9 +27,13 @@ func TestTransactionSerialization(t *testing.T) {
 		rnd.Read(tx.SenderSig[:])
 		if tp == 1 {
 			rnd.Read(tx.Receiver[:])
-		} else if tp == 2 {
+		} else {
 			tx.Value = 0
 		}
+		if tp == 3 {
+			tx.Fee = 0
+			tx.GasPrice = rnd.Uint64()
+		}
 
 		var b bytes.Buffer
 		err := EncodeTx(&b, tx)
@@ -170,3 +174,175 @@ func TestTransactionExecType2(t *testing.T) {
 		t.Fatalf("account 2 balance invalid: %d", info.Balance)
 	}
 }
+
+func TestTransactionChainIdSign(t *testing.T) {
+	rnd := rand.New(rand.NewSource(114516))
+	pubk1, prik1 := GenKeyPair(rnd)
+	addr1 := PubkeyToAddress(pubk1)
+	s := storage.EmptySlice()
+	info := GetAccountInfo(s, addr1)
+	info.Balance = 10000000
+	SetAccountInfo(s, addr1, info)
+	tx := &Transaction{
+		TxType:       1,
+		SenderPubkey: pubk1,
+		Receiver:     AddressType{1},
+		Value:        500000,
+		GasLimit:     100000,
+		Fee:          100000,
+		Nonce:        0,
+		Data:         []byte{1, 2, 3},
+	}
+	tx.Sign(prik1)
+	err := ExecuteTx(tx, storage.ForkSlice(s), &ExecutionContext{ChainId: 4, Tip3Enabled: true})
+	if err == nil || err.Error() != "signature mismatch" {
+		t.Fatalf("legacy signature accepted after tip3: %v", err)
+	}
+	tx.SignWithChainId(prik1, 4)
+	err = ExecuteTx(tx, storage.ForkSlice(s), &ExecutionContext{ChainId: 4})
+	if err == nil || err.Error() != "signature mismatch" {
+		t.Fatalf("chain id signature accepted before tip3: %v", err)
+	}
+	err = ExecuteTx(tx, storage.ForkSlice(s), &ExecutionContext{ChainId: 5, Tip3Enabled: true})
+	if err == nil || err.Error() != "signature mismatch" {
+		t.Fatalf("signature replayed on another chain: %v", err)
+	}
+	err = ExecuteTx(tx, storage.ForkSlice(s), &ExecutionContext{ChainId: 4, Tip3Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransactionExecType3(t *testing.T) {
+	rnd := rand.New(rand.NewSource(114518))
+	pubk1, prik1 := GenKeyPair(rnd)
+	addr1 := PubkeyToAddress(pubk1)
+	miner := AddressType{9}
+	s := storage.EmptySlice()
+	SetAccountInfo(s, addr1, AccountInfo{Balance: 10000000})
+	s.Freeze()
+	tx := &Transaction{
+		TxType:       3,
+		SenderPubkey: pubk1,
+		GasLimit:     100000,
+		GasPrice:     3,
+		Nonce:        0,
+		Data:         vm.BuiltinAsmToBytes("ret"),
+	}
+	tx.Sign(prik1)
+	err := ExecuteTx(tx, storage.ForkSlice(s), &ExecutionContext{Tip1Enabled: true})
+	if err == nil || err.Error() != "wrong tx type" {
+		t.Fatalf("type 3 accepted before tip5: %v", err)
+	}
+	ctx := &ExecutionContext{Tip1Enabled: true, Tip5Enabled: true}
+	blk := &Block{Miner: miner, Txs: []*Transaction{tx}}
+	s2 := storage.ForkSlice(s)
+	rs, err := ExecuteBlock(blk, 1000, s2, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gas := rs[0].GasUsed
+	if !rs[0].Success || gas < GasVmTxRawCode || gas >= tx.GasLimit {
+		t.Fatalf("unexpected receipt: %v", rs[0])
+	}
+	if GetAccountInfo(s2, addr1).Balance != 10000000-gas*3 {
+		t.Fatalf("unused gas not refunded: %d", GetAccountInfo(s2, addr1).Balance)
+	}
+	if GetAccountInfo(s2, miner).Balance != 1000+gas*3 {
+		t.Fatalf("miner balance invalid: %d", GetAccountInfo(s2, miner).Balance)
+	}
+
+	tx.GasLimit = GasVmTxRawCode + 1
+	tx.Sign(prik1)
+	s2 = storage.ForkSlice(s)
+	rs, err = ExecuteBlock(blk, 1000, s2, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs[0].Success || rs[0].Error != vm.ErrInsufficientGas.Error() {
+		t.Fatalf("unexpected receipt: %v", rs[0])
+	}
+	if GetAccountInfo(s2, addr1).Balance != 10000000-rs[0].GasUsed*3 {
+		t.Fatalf("failed tx not charged: %d", GetAccountInfo(s2, addr1).Balance)
+	}
+
+	// below the base gas nothing would be charged
+	tx.GasLimit = GasVmTxRawCode - 1
+	tx.Sign(prik1)
+	err = ExecuteTx(tx, storage.ForkSlice(s), ctx)
+	if err != vm.ErrInsufficientGas {
+		t.Fatalf("free tx accepted: %v", err)
+	}
+	tx.TxType = 2
+	tx.Sign(prik1)
+	err = ExecuteTx(tx, storage.ForkSlice(s), ctx)
+	if err != vm.ErrInsufficientGas {
+		t.Fatalf("type 2 tx below the base gas accepted after tip5: %v", err)
+	}
+	err = ExecuteTx(tx, storage.ForkSlice(s), &ExecutionContext{Tip1Enabled: true})
+	if err != nil {
+		t.Fatalf("type 2 tx below the base gas rejected before tip5: %v", err)
+	}
+	tx.TxType = 3
+	tx.GasLimit = GasVmTxRawCode + 1
+
+	tx.GasPrice = 1 << 60
+	tx.Sign(prik1)
+	err = ExecuteTx(tx, storage.ForkSlice(s), ctx)
+	if err == nil || err.Error() != "integer overflow" {
+		t.Fatalf("expect overflow, but returned %v", err)
+	}
+}
+
+func TestTransactionLogs(t *testing.T) {
+	topic := HashType{1, 2, 3}
+	code := vm.BuiltinAsmToBytes(strings.Join([]string{
+		"mv s0, ra",
+		"la a0, topic",
+		"li a1, 1",
+		"la a2, data",
+		"li a3, 8",
+		fmt.Sprintf("li t0, -%d", SYSCALL_LOG*8),
+		"srli t0, t0, 1",
+		"jalr t0",
+		"mv ra, s0",
+		"ret",
+		"topic:",
+		asAsmByteArr(topic[:]),
+		"data:",
+		asAsmByteArr([]byte("testlog!")),
+	}, "\n"))
+	rnd := rand.New(rand.NewSource(114519))
+	pubk1, prik1 := GenKeyPair(rnd)
+	addr1 := PubkeyToAddress(pubk1)
+	s := storage.EmptySlice()
+	SetAccountInfo(s, addr1, AccountInfo{Balance: 10000000})
+	s.Freeze()
+	tx := &Transaction{
+		TxType:       3,
+		SenderPubkey: pubk1,
+		GasLimit:     100000,
+		GasPrice:     1,
+		Nonce:        0,
+		Data:         code,
+	}
+	tx.Sign(prik1)
+	rc, err := ExecuteTxWithReceipt(tx, storage.ForkSlice(s), &ExecutionContext{Tip1Enabled: true, Tip5Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc.Success || rc.Error != ErrInvalidSyscall.Error() || len(rc.Logs) != 0 {
+		t.Fatalf("log accepted before tip7: %v", rc)
+	}
+	rc, err = ExecuteTxWithReceipt(tx, storage.ForkSlice(s), &ExecutionContext{Tip1Enabled: true, Tip5Enabled: true, Tip7Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rc.Success || len(rc.Logs) != 1 {
+		t.Fatalf("unexpected receipt: %v", rc)
+	}
+	l := rc.Logs[0]
+	if l.Address != addr1 || !reflect.DeepEqual(l.Topics, []HashType{topic}) || string(l.Data) != "testlog!" {
+		t.Fatalf("unexpected log: %v", l)
+	}
+}
@@ -32,6 +32,8 @@ type vmCtx struct {
 	jumpDest map[uint64]bool
 	origin   AddressType
 	tx       *Transaction
+	created  []AddressType
+	logs     []*Log
 }
 
 type callCtx struct {
@@ -54,6 +56,8 @@ func newVmCtx(ctx *ExecutionContext, origin AddressType, tx *Transaction) *vmCtx
 		jumpDest: make(map[uint64]bool),
 		origin:   origin,
 		tx:       tx,
+		created:  []AddressType{},
+		logs:     []*Log{},
 	}
 }
 
@@ -142,6 +146,11 @@ func (ctx *vmCtx) execVM(call *callCtx) (uint64, error) {
 }
 
 func ExecVmTxRawCode(origin AddressType, gasLimit uint64, data []byte, s *storage.Slice, ctx *ExecutionContext, tx *Transaction) (uint64, error) {
+	return execVmTxRawCode(origin, gasLimit, data, s, ctx, tx, nil)
+}
+
+// on success, the created contracts and the logs are put into the receipt if given
+func execVmTxRawCode(origin AddressType, gasLimit uint64, data []byte, s *storage.Slice, ctx *ExecutionContext, tx *Transaction, rc *Receipt) (uint64, error) {
 	const initPc = 0x10000000
 	if gasLimit < GasVmTxRawCode {
 		return gasLimit, vm.ErrInsufficientGas
@@ -167,7 +176,14 @@ func ExecVmTxRawCode(origin AddressType, gasLimit uint64, data []byte, s *storag
 		caller:    id,
 		callType:  CallExternal,
 	})
-	return env.Gas, err
+	if err != nil {
+		return env.Gas, err
+	}
+	if rc != nil {
+		rc.Created = vmCtx.created
+		rc.Logs = vmCtx.logs
+	}
+	return env.Gas, nil
 }
 
 func ExecVmViewRawCode(origin AddressType, gasLimit uint64, data []byte, s *storage.Slice, ctx *ExecutionContext) ([]byte, error) {
@@ -35,6 +35,7 @@ const SYSCALL_TRANSFER = 19
 const SYSCALL_CREATE = 20
 const SYSCALL_ED25519_VERIFY = 21
 const SYSCALL_LOAD_ELF = 22
+const SYSCALL_LOG = 23
 
 const CREATE_TRIMELF = 1
 const CREATE_INIT = 2
@@ -46,9 +47,12 @@ var ErrInsufficientBalance = errors.New("insufficient balance")
 var ErrContractNotExist = errors.New("contract not exist")
 var ErrIllegalEntry = errors.New("illegal entry")
 var ErrContractExists = errors.New("contract exists")
+var ErrReverted = errors.New("reverted")
 
 const MaxRevertMsgLen = 1024
 const MaxByteArrayLen = 1 << 20
+const MaxLogTopics = 4
+const MaxLogDataLen = 1 << 16
 
 var GasSyscallBase = map[int]uint64{
 	SYSCALL_SELF:           40,
@@ -73,6 +77,7 @@ var GasSyscallBase = map[int]uint64{
 	SYSCALL_CREATE:         25000,
 	SYSCALL_ED25519_VERIFY: 50000,
 	SYSCALL_LOAD_ELF:       500,
+	SYSCALL_LOG:            1000,
 }
 
 const GasSyscallSha256PerBlock = 60
@@ -81,6 +86,8 @@ const GasSyscallRevertPerByte = 1
 const GasSyscallTransferMessagePerByte = 1
 const GasSyscallCreatePerByte = 1
 const GasSyscallCreateStorePerBlock = 10000
+const GasSyscallLogPerTopic = 500
+const GasSyscallLogPerByte = 8
 const GasLoadContractCodeCached = 400
 const GasLoadContractCode = 20000
 const GasLoadContractCodePerBlock = 2000
@@ -237,6 +244,7 @@ func (ctx *vmCtx) create(call *callCtx, elf []byte, flags, nonce uint64) (Addres
 	}
 	env.Gas -= gas
 	storeContractCode(call.s, addr, elf)
+	ctx.created = append(ctx.created, addr)
 	return addr, nil
 }
 
@@ -245,6 +253,9 @@ func (ctx *vmCtx) execSyscall(call *callCtx, syscallId uint64) error {
 	cpu := &ctx.cpus[prog]
 	mem := ctx.mem
 	env := call.env
+	if syscallId == SYSCALL_LOG && !ctx.ctx.Tip7Enabled {
+		return ErrInvalidSyscall
+	}
 	if gasBase, ok := GasSyscallBase[int(syscallId)]; ok {
 		if env.Gas < gasBase {
 			return vm.ErrInsufficientGas
@@ -401,6 +412,8 @@ func (ctx *vmCtx) execSyscall(call *callCtx, syscallId uint64) error {
 		newEnv := &vm.ExecEnv{
 			Gas: gasLimit,
 		}
+		nCreated := len(ctx.created)
+		nLogs := len(ctx.logs)
 		res, err := ctx.execVM(&callCtx{
 			s:         newS,
 			env:       newEnv,
@@ -412,6 +425,8 @@ func (ctx *vmCtx) execSyscall(call *callCtx, syscallId uint64) error {
 		})
 		env.Gas -= gasLimit - newEnv.Gas
 		if err != nil {
+			ctx.created = ctx.created[:nCreated]
+			ctx.logs = ctx.logs[:nLogs]
 			err2 := mem.WriteBytes(prog, cpu.GetArg(5), []byte{0}, env)
 			if err2 != nil {
 				return err2
@@ -438,7 +453,7 @@ func (ctx *vmCtx) execSyscall(call *callCtx, syscallId uint64) error {
 			return vm.ErrInsufficientGas
 		}
 		env.Gas -= gas
-		return fmt.Errorf("reverted: %s", str)
+		return fmt.Errorf("%w: %s", ErrReverted, str)
 	case SYSCALL_TIME:
 		cpu.SetArg(0, ctx.ctx.Time)
 	case SYSCALL_MINER:
@@ -580,6 +595,33 @@ func (ctx *vmCtx) execSyscall(call *callCtx, syscallId uint64) error {
 			return err
 		}
 		cpu.SetArg(0, prog<<32|uint64(entry))
+	case SYSCALL_LOG:
+		nTopics := cpu.GetArg(1)
+		n := cpu.GetArg(3)
+		if nTopics > MaxLogTopics || n > MaxLogDataLen {
+			return ErrIllegalSyscallParameters
+		}
+		gas := nTopics*GasSyscallLogPerTopic + n*GasSyscallLogPerByte
+		if env.Gas < gas {
+			return vm.ErrInsufficientGas
+		}
+		env.Gas -= gas
+		l := &Log{
+			Address: ctx.addr[prog],
+			Topics:  make([]HashType, nTopics),
+			Data:    make([]byte, n),
+		}
+		for i := 0; i < int(nTopics); i++ {
+			err := mem.ReadBytes(prog, cpu.GetArg(0)+uint64(i*HashLen), l.Topics[i][:], env)
+			if err != nil {
+				return err
+			}
+		}
+		err := mem.ReadBytes(prog, cpu.GetArg(2), l.Data, env)
+		if err != nil {
+			return err
+		}
+		ctx.logs = append(ctx.logs, l)
 	}
 	return nil
 }
@@ -1,16 +1,31 @@
 package core
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/mcfx/tcoin/core/block"
 	"github.com/mcfx/tcoin/core/consensus"
 )
 
 type ChainNodeConfig struct {
-	StoragePath          string  `json:"storage_path"`
-	StorageFinalizeDepth int     `json:"storage_finalize_depth"`
-	StorageDumpDiskRatio float64 `json:"storage_dump_disk_ratio"`
-	ListenPort           int     `json:"listen_port"`
-	MaxConnections       int     `json:"max_connections"`
+	StoragePath          string       `json:"storage_path"`
+	StorageFinalizeDepth int          `json:"storage_finalize_depth"`
+	StorageDumpDiskRatio float64      `json:"storage_dump_disk_ratio"`
+	ListenPort           int          `json:"listen_port"`
+	MaxConnections       int          `json:"max_connections"`
+	StorageArchive       bool         `json:"storage_archive"`
+	StorageCacheSize     int          `json:"storage_cache_size"`
+	Snapshot             string       `json:"snapshot"`
+	StoragePruneDepth    int          `json:"storage_prune_depth"`
+	MinGasPrice          uint64       `json:"min_gas_price"`
+	Miner                *MinerConfig `json:"miner"`
+}
+
+// a node with a miner config produces blocks itself, as a poa signer
+type MinerConfig struct {
+	// hex of the ed25519 seed of the signer, which also gets the rewards
+	SignerKey string `json:"signer_key"`
 }
 
 type ChainGlobalConfig struct {
@@ -21,4 +36,55 @@ type ChainGlobalConfig struct {
 	BlockReward           uint64                    `json:"block_reward"`
 	SeedNodes             []string                  `json:"seed_nodes"`
 	Tip1EnableHeight      int                       `json:"tip1_enable_height"`
+	Tip2EnableHeight      int                       `json:"tip2_enable_height"`
+	Tip3EnableHeight      int                       `json:"tip3_enable_height"`
+	Tip4EnableHeight      int                       `json:"tip4_enable_height"`
+	Tip5EnableHeight      int                       `json:"tip5_enable_height"`
+	Tip6EnableHeight      int                       `json:"tip6_enable_height"`
+	Tip7EnableHeight      int                       `json:"tip7_enable_height"`
+	Tip8EnableHeight      int                       `json:"tip8_enable_height"`
+	BlockGasLimit         uint64                    `json:"block_gas_limit"`
+	BlockSizeLimit        int                       `json:"block_size_limit"`
+	Consensus             string                    `json:"consensus"`
+	PoASigners            []block.PubkeyType        `json:"poa_signers"`
+	PoAPeriod             uint64                    `json:"poa_period"`
+}
+
+// the consensus engine is "pow" (default) or "poa"
+func (gc *ChainGlobalConfig) newEngine() (consensus.Engine, error) {
+	switch gc.Consensus {
+	case "", "pow":
+		return consensus.PoW{MedianTimeHeight: gc.Tip8EnableHeight}, nil
+	case "poa":
+		if len(gc.PoASigners) == 0 {
+			return nil, errors.New("no poa signers")
+		}
+		return &consensus.PoA{
+			Signers: gc.PoASigners,
+			Period:  gc.PoAPeriod,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown consensus engine: %s", gc.Consensus)
+}
+
+func (gc *ChainGlobalConfig) newExecutionContext(height int, time uint64, miner block.AddressType, difficulty block.HashType, callback *block.ExecutionCallback) *block.ExecutionContext {
+	ctx := &block.ExecutionContext{
+		Height:      height,
+		Time:        time,
+		Miner:       miner,
+		Difficulty:  difficulty,
+		ChainId:     gc.ChainId,
+		Callback:    callback,
+		Tip1Enabled: height >= gc.Tip1EnableHeight,
+		Tip2Enabled: height >= gc.Tip2EnableHeight,
+		Tip3Enabled: height >= gc.Tip3EnableHeight,
+		Tip4Enabled: height >= gc.Tip4EnableHeight,
+		Tip5Enabled: height >= gc.Tip5EnableHeight,
+		Tip7Enabled: height >= gc.Tip7EnableHeight,
+	}
+	if height >= gc.Tip6EnableHeight {
+		ctx.BlockGasLimit = gc.BlockGasLimit
+		ctx.BlockSizeLimit = gc.BlockSizeLimit
+	}
+	return ctx
 }
@@ -3,8 +3,10 @@ package consensus
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"math/big"
+	"sort"
 
 	"github.com/mcfx/tcoin/core/block"
 )
@@ -14,33 +16,107 @@ type ConsensusState struct {
 	LastBlockTime    uint64
 	LastKeyBlockTime uint64
 	Difficulty       block.HashType
+	TotalWork        block.HashType
+	// times of the last MedianTimeSpan blocks, oldest first
+	RecentTimes []uint64
 }
 
 const PeriodBlockCount = 30
 const PeriodTime = 300 // 10s per block
 
+const MedianTimeSpan = 11
+const MaxFutureDrift = 60 * 1000000000
+
 func (cs *ConsensusState) Copy() *ConsensusState {
 	return &ConsensusState{
 		Height:           cs.Height,
 		LastBlockTime:    cs.LastBlockTime,
 		LastKeyBlockTime: cs.LastKeyBlockTime,
 		Difficulty:       cs.Difficulty,
+		TotalWork:        cs.TotalWork,
+		RecentTimes:      append([]uint64(nil), cs.RecentTimes...),
 	}
 }
 
-func (cs *ConsensusState) CheckAndUpdate(blk *block.Block) bool {
-	if bytes.Compare(blk.Header.Hash[:], cs.Difficulty[:]) > 0 {
+// median of the recent block times, or the last block time if they are not
+// known (states stored by older versions)
+func (cs *ConsensusState) MedianTimePast() uint64 {
+	if len(cs.RecentTimes) == 0 {
+		return cs.LastBlockTime
+	}
+	t := append([]uint64(nil), cs.RecentTimes...)
+	sort.Slice(t, func(i, j int) bool {
+		return t[i] < t[j]
+	})
+	return t[len(t)/2]
+}
+
+// whether the block is too far ahead of the local time now, it may be valid
+// later
+func InFuture(blk *block.Block, now uint64) bool {
+	return blk.Time > now+MaxFutureDrift
+}
+
+// check the time of the block on top of the state at the local time now, the
+// block must be later than the median time past if mtp is set, or else later
+// than the last block
+func (cs *ConsensusState) CheckTime(blk *block.Block, mtp bool, now uint64) bool {
+	if InFuture(blk, now) {
 		return false
 	}
+	if mtp {
+		return blk.Time > cs.MedianTimePast()
+	}
+	return blk.Time > cs.LastBlockTime
+}
+
+var maxWork = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// expected number of hashes to mine a block, 2^256 / (difficulty + 1)
+func BlockWork(difficulty block.HashType) *big.Int {
+	t := new(big.Int).SetBytes(difficulty[:])
+	t.Add(t, big.NewInt(1))
+	return t.Div(maxWork, t)
+}
+
+func addWork(a block.HashType, w *big.Int) block.HashType {
+	t := new(big.Int).SetBytes(a[:])
+	t.Add(t, w)
+	if t.Cmp(maxWork) >= 0 {
+		t.Sub(maxWork, big.NewInt(1))
+	}
+	t.FillBytes(a[:])
+	return a
+}
+
+// compare the total work of two states, which decides the best chain
+func CompareWork(a, b *ConsensusState) int {
+	return bytes.Compare(a.TotalWork[:], b.TotalWork[:])
+}
+
+// check the block with the legacy time rule and no future drift check
+func (cs *ConsensusState) CheckAndUpdate(blk *block.Block) bool {
 	if blk.Time <= cs.LastBlockTime {
 		return false
 	}
+	return cs.update(blk)
+}
+
+func (cs *ConsensusState) update(blk *block.Block) bool {
+	if bytes.Compare(blk.Header.Hash[:], cs.Difficulty[:]) > 0 {
+		return false
+	}
 	cs.Height++
 	cs.LastBlockTime = blk.Time
+	cs.pushTime(blk.Time)
+	cs.TotalWork = addWork(cs.TotalWork, BlockWork(cs.Difficulty))
 	if cs.Height%PeriodBlockCount == 0 {
-		dt := big.NewInt(0)
-		dt.SetBytes(cs.Difficulty[:])
-		rtime := blk.Time - cs.LastKeyBlockTime
+		// blocks may be earlier than the last one after the median time past
+		// rule, which is clamped to rmin below
+		var rtime uint64 = 0
+		if blk.Time > cs.LastKeyBlockTime {
+			rtime = blk.Time - cs.LastKeyBlockTime
+		}
 		wtime := uint64(PeriodTime * 1000000000)
 		rmin := wtime * 15 / 16
 		rmax := wtime * 17 / 16
@@ -49,37 +125,103 @@ func (cs *ConsensusState) CheckAndUpdate(blk *block.Block) bool {
 		} else if rtime > rmax {
 			rtime = rmax
 		}
-		dt.Mul(dt, big.NewInt(int64(rtime)))
-		dt.Div(dt, big.NewInt(int64(wtime)))
-		if dt.BitLen() > 256 {
-			cs.Difficulty[0] = 0xff
-		} else {
-			dt.FillBytes(cs.Difficulty[:])
-		}
+		cs.Difficulty = retarget(cs.Difficulty, rtime, wtime)
 		cs.LastKeyBlockTime = blk.Time
 	}
 	return true
 }
 
+func retarget(d block.HashType, rtime, wtime uint64) block.HashType {
+	dt := new(big.Int).SetBytes(d[:])
+	dt.Mul(dt, big.NewInt(int64(rtime)))
+	dt.Div(dt, big.NewInt(int64(wtime)))
+	if dt.BitLen() > 256 {
+		d[0] = 0xff
+	} else {
+		dt.FillBytes(d[:])
+	}
+	return d
+}
+
+// the largest difficulty a retarget may give
+func maxRetarget(d block.HashType) block.HashType {
+	wtime := uint64(PeriodTime * 1000000000)
+	return retarget(d, wtime*17/16, wtime)
+}
+
+// states stored by older versions lack the total work and the recent times,
+// and new states set workFlag in the encoded height (stored heights are never
+// negative or that large)
+const workFlag = 1 << 62
+
+// whether the encoded state was stored by an older version
+func LegacyEncoded(data []byte) bool {
+	return len(data) >= 8 && binary.LittleEndian.Uint64(data[:8])&workFlag == 0
+}
+
+// fill the total work and the recent times of a legacy state from the state
+// of its parent, as update would
+func (cs *ConsensusState) Migrate(parent *ConsensusState) {
+	cs.TotalWork = addWork(parent.TotalWork, BlockWork(parent.Difficulty))
+	cs.RecentTimes = append([]uint64(nil), parent.RecentTimes...)
+	cs.pushTime(cs.LastBlockTime)
+}
+
+func (cs *ConsensusState) pushTime(t uint64) {
+	cs.RecentTimes = append(cs.RecentTimes, t)
+	if len(cs.RecentTimes) > MedianTimeSpan {
+		cs.RecentTimes = append([]uint64(nil), cs.RecentTimes[len(cs.RecentTimes)-MedianTimeSpan:]...)
+	}
+}
+
 func DecodeConsensus(r io.Reader) (*ConsensusState, error) {
 	cs := &ConsensusState{}
 	buf := make([]byte, 8*3+block.HashLen)
 	if _, err := io.ReadFull(r, buf); err != nil {
 		return nil, err
 	}
-	cs.Height = int(binary.LittleEndian.Uint64(buf[:8]))
+	h := binary.LittleEndian.Uint64(buf[:8])
 	cs.LastBlockTime = binary.LittleEndian.Uint64(buf[8:16])
 	cs.LastKeyBlockTime = binary.LittleEndian.Uint64(buf[16:24])
 	copy(cs.Difficulty[:], buf[24:])
+	if h>>62 == 1 {
+		h ^= workFlag
+		if _, err := io.ReadFull(r, cs.TotalWork[:]); err != nil {
+			return nil, err
+		}
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return nil, err
+		}
+		if n[0] > MedianTimeSpan {
+			return nil, errors.New("too much recent times")
+		}
+		if n[0] > 0 {
+			tb := make([]byte, 8*int(n[0]))
+			if _, err := io.ReadFull(r, tb); err != nil {
+				return nil, err
+			}
+			cs.RecentTimes = make([]uint64, n[0])
+			for i := range cs.RecentTimes {
+				cs.RecentTimes[i] = binary.LittleEndian.Uint64(tb[i*8:])
+			}
+		}
+	}
+	cs.Height = int(h)
 	return cs, nil
 }
 
 func EncodeConsensus(w io.Writer, cs *ConsensusState) error {
-	buf := make([]byte, 8*3+block.HashLen)
-	binary.LittleEndian.PutUint64(buf[:8], uint64(cs.Height))
+	buf := make([]byte, 8*3+block.HashLen*2+1+8*len(cs.RecentTimes))
+	binary.LittleEndian.PutUint64(buf[:8], uint64(cs.Height)|workFlag)
 	binary.LittleEndian.PutUint64(buf[8:16], cs.LastBlockTime)
 	binary.LittleEndian.PutUint64(buf[16:24], cs.LastKeyBlockTime)
 	copy(buf[24:], cs.Difficulty[:])
+	copy(buf[24+block.HashLen:], cs.TotalWork[:])
+	buf[24+block.HashLen*2] = byte(len(cs.RecentTimes))
+	for i, t := range cs.RecentTimes {
+		binary.LittleEndian.PutUint64(buf[25+block.HashLen*2+i*8:], t)
+	}
 	if _, err := w.Write(buf); err != nil {
 		return err
 	}
@@ -2,6 +2,8 @@ package consensus
 
 import (
 	"bytes"
+	"encoding/binary"
+	"math/big"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -17,6 +19,10 @@ func TestConsensusSerialization(t *testing.T) {
 		LastKeyBlockTime: rnd.Uint64(),
 	}
 	rnd.Read(cs.Difficulty[:])
+	rnd.Read(cs.TotalWork[:])
+	for i := 0; i < MedianTimeSpan; i++ {
+		cs.RecentTimes = append(cs.RecentTimes, rnd.Uint64())
+	}
 
 	var b bytes.Buffer
 	err := EncodeConsensus(&b, cs)
@@ -81,3 +87,255 @@ func TestConsensus(t *testing.T) {
 		t.Fatal("state difficulty invalid")
 	}
 }
+
+func TestConsensusLegacySerialization(t *testing.T) {
+	cs := &ConsensusState{
+		Height:           1234,
+		LastBlockTime:    5678,
+		LastKeyBlockTime: 910,
+		Difficulty:       block.HashType{0, 0, 1},
+	}
+	buf := make([]byte, 8*3+block.HashLen+1)
+	binary.LittleEndian.PutUint64(buf[:8], uint64(cs.Height))
+	binary.LittleEndian.PutUint64(buf[8:16], cs.LastBlockTime)
+	binary.LittleEndian.PutUint64(buf[16:24], cs.LastKeyBlockTime)
+	copy(buf[24:], cs.Difficulty[:])
+	buf[len(buf)-1] = 42
+	b := bytes.NewBuffer(buf)
+	cs2, err := DecodeConsensus(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cs, cs2) {
+		t.Fatal("not equal")
+	}
+	if b.Len() != 1 {
+		t.Fatal("read too much")
+	}
+}
+
+func TestConsensusMigrate(t *testing.T) {
+	cs := &ConsensusState{
+		Height:     -1,
+		Difficulty: block.HashType{0, 0, 0, 1},
+	}
+	blk := &block.Block{}
+	var prev *ConsensusState
+	for i := 0; i < PeriodBlockCount*2; i++ {
+		blk.Time = cs.LastBlockTime + 1000000000*uint64(5+i%10)
+		if !cs.CheckAndUpdate(blk) {
+			t.Fatal("block rejected")
+		}
+		var buf bytes.Buffer
+		err := EncodeConsensus(&buf, cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		if LegacyEncoded(data) {
+			t.Fatal("new state taken as legacy")
+		}
+		// the legacy encoding is the start of the new one without the flag
+		binary.LittleEndian.PutUint64(data[:8], uint64(cs.Height))
+		if !LegacyEncoded(data) {
+			t.Fatal("legacy state not detected")
+		}
+		legacy, err := DecodeConsensus(bytes.NewBuffer(data[:8*3+block.HashLen]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if legacy.TotalWork != (block.HashType{}) || len(legacy.RecentTimes) != 0 {
+			t.Fatal("legacy state has the new fields")
+		}
+		if prev != nil {
+			legacy.Migrate(prev)
+			if !reflect.DeepEqual(legacy, cs) {
+				t.Fatalf("migrated state at height %d differs: %v %v", cs.Height, legacy, cs)
+			}
+		}
+		prev = cs.Copy()
+	}
+}
+
+func TestConsensusWork(t *testing.T) {
+	if BlockWork(block.HashType{0x7f, 0xff}).Cmp(big.NewInt(2)) != 0 {
+		t.Fatal("block work invalid")
+	}
+	mine := func(cs *ConsensusState, n int, dt uint64) {
+		blk := &block.Block{}
+		for i := 0; i < n; i++ {
+			blk.Time = cs.LastBlockTime + dt
+			if !cs.CheckAndUpdate(blk) {
+				t.Fatal("block rejected")
+			}
+		}
+	}
+	base := &ConsensusState{
+		Difficulty: block.HashType{0, 0, 0, 1},
+	}
+	mine(base, PeriodBlockCount-1, 1000000000*10)
+	w := base.TotalWork
+	if new(big.Int).SetBytes(w[:]).Cmp(new(big.Int).Mul(BlockWork(base.Difficulty), big.NewInt(PeriodBlockCount-1))) != 0 {
+		t.Fatal("total work invalid")
+	}
+
+	// a longer chain mined at a lower difficulty has less work
+	easy := base.Copy()
+	easy.Difficulty = block.HashType{0, 0, 1}
+	mine(easy, 50, 1000000000*10)
+	hard := base.Copy()
+	mine(hard, 20, 1000000000*10)
+	if easy.Height <= hard.Height {
+		t.Fatal("easy chain should be longer")
+	}
+	if CompareWork(easy, hard) >= 0 || CompareWork(hard, easy) <= 0 {
+		t.Fatal("hard chain should have more work")
+	}
+	if CompareWork(hard, hard.Copy()) != 0 {
+		t.Fatal("work of copy mismatch")
+	}
+
+	// the work of a block uses the difficulty before retargeting
+	cs := base.Copy()
+	mine(cs, 1, 1000000000*5)
+	if cs.Difficulty == base.Difficulty {
+		t.Fatal("difficulty not retargeted")
+	}
+	exp := new(big.Int).SetBytes(w[:])
+	exp.Add(exp, BlockWork(base.Difficulty))
+	if new(big.Int).SetBytes(cs.TotalWork[:]).Cmp(exp) != 0 {
+		t.Fatal("total work invalid after retarget")
+	}
+}
+
+func TestMedianTimePast(t *testing.T) {
+	cs := &ConsensusState{Difficulty: block.HashType{0xff}}
+	now := uint64(1000000000 * 1000)
+	e := PoW{Now: func() uint64 { return now }}
+	blk := &block.Block{}
+	times := []uint64{100, 105, 101, 110, 103, 104, 102, 120, 107, 106, 108, 109}
+	for _, tm := range times {
+		blk.Time = tm
+		cs.update(blk)
+	}
+	if len(cs.RecentTimes) != MedianTimeSpan || cs.RecentTimes[0] != 105 {
+		t.Fatal("recent times invalid")
+	}
+	if cs.MedianTimePast() != 106 {
+		t.Fatalf("median time past invalid: %d", cs.MedianTimePast())
+	}
+	blk.Time = 106
+	if e.CheckAndUpdate(cs.Copy(), blk) {
+		t.Fatal("block not later than the median time past accepted")
+	}
+	blk.Time = 107
+	if !e.CheckAndUpdate(cs.Copy(), blk) {
+		t.Fatal("block later than the median time past rejected")
+	}
+	if (PoW{MedianTimeHeight: 100, Now: e.Now}).CheckAndUpdate(cs.Copy(), blk) {
+		t.Fatal("block earlier than the last one accepted before mtp")
+	}
+	blk.Time = now + MaxFutureDrift + 1
+	if e.CheckAndUpdate(cs.Copy(), blk) || !InFuture(blk, now) {
+		t.Fatal("block too far in the future accepted")
+	}
+	blk.Time = now + MaxFutureDrift
+	if !e.CheckAndUpdate(cs.Copy(), blk) || InFuture(blk, now) {
+		t.Fatal("block within the future drift rejected")
+	}
+}
+
+func TestRetargetAttack(t *testing.T) {
+	diff := block.HashType{0, 1}
+	var now uint64 = 1000000000 * 1000
+	var bt uint64 = 1000000000 * 10
+	cs := &ConsensusState{
+		LastBlockTime:    now,
+		LastKeyBlockTime: now,
+		Difficulty:       diff,
+	}
+	e := PoW{Now: func() uint64 { return now }}
+	blk := &block.Block{}
+	for i := 1; i < PeriodBlockCount; i++ {
+		now += bt
+		blk.Time = now
+		if !e.CheckAndUpdate(cs, blk) {
+			t.Fatal("block rejected")
+		}
+	}
+	// the attacker mines the retarget block with a time in the future to
+	// lower the difficulty, which is bounded by the drift
+	now += bt
+	blk.Time = now + 1000000000*3600
+	if e.CheckAndUpdate(cs.Copy(), blk) {
+		t.Fatal("block too far in the future accepted")
+	}
+	blk.Time = now + MaxFutureDrift
+	if !e.CheckAndUpdate(cs, blk) {
+		t.Fatal("block rejected")
+	}
+	eased := cs.Difficulty
+	if bytes.Compare(eased[:], diff[:]) <= 0 {
+		t.Fatal("difficulty should be eased")
+	}
+	lim := new(big.Int).SetBytes(diff[:])
+	lim.Mul(lim, big.NewInt(17))
+	lim.Div(lim, big.NewInt(16))
+	if new(big.Int).SetBytes(eased[:]).Cmp(lim) > 0 {
+		t.Fatal("difficulty eased too much")
+	}
+
+	// honest miners keep using the real time, which is only allowed by the
+	// median time past rule
+	now += bt
+	blk.Time = now
+	if (PoW{MedianTimeHeight: 1 << 30, Now: e.Now}).CheckAndUpdate(cs.Copy(), blk) {
+		t.Fatal("block earlier than the last one accepted before mtp")
+	}
+	if !e.CheckAndUpdate(cs, blk) {
+		t.Fatal("honest block rejected")
+	}
+	for i := 2; i <= PeriodBlockCount; i++ {
+		now += bt
+		blk.Time = now
+		if !e.CheckAndUpdate(cs, blk) {
+			t.Fatal("honest block rejected")
+		}
+	}
+	// the next period looks short, which takes back the eased difficulty
+	if bytes.Compare(cs.Difficulty[:], eased[:]) >= 0 || bytes.Compare(cs.Difficulty[:], diff[:]) > 0 {
+		t.Fatal("difficulty not compensated")
+	}
+}
+
+func TestUpdateHeader(t *testing.T) {
+	var now uint64 = 1000000000 * 1000
+	cs := &ConsensusState{
+		LastBlockTime:    now,
+		LastKeyBlockTime: now,
+		Difficulty:       block.HashType{0, 1},
+	}
+	e := PoW{Now: func() uint64 { return now }}
+	hcs := cs.Copy()
+	blk := &block.Block{}
+	// the difficulty of the headers stays above the real one, whatever the
+	// block times are
+	for i := 1; i <= PeriodBlockCount*3; i++ {
+		now += 1000000000 * uint64(1+i%30)
+		blk.Time = now
+		blk.Header.Hash = cs.Difficulty
+		if !e.CheckAndUpdate(cs, blk) {
+			t.Fatal("block rejected")
+		}
+		if e.UpdateHeader(hcs, &blk.Header) != nil {
+			t.Fatal("header rejected")
+		}
+		if hcs.Height != cs.Height || bytes.Compare(hcs.Difficulty[:], cs.Difficulty[:]) < 0 {
+			t.Fatal("header state invalid")
+		}
+	}
+	bh := &block.BlockHeader{Hash: block.HashType{0, 2}}
+	if e.UpdateHeader(hcs, bh) != ErrDifficulty || hcs.Height != cs.Height {
+		t.Fatal("header above the difficulty accepted")
+	}
+}
@@ -0,0 +1,82 @@
+package consensus
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/mcfx/tcoin/core/block"
+)
+
+type Engine interface {
+	// check the header against the state of its parent
+	CheckHeader(cs *ConsensusState, bh *block.BlockHeader) error
+	// check the block and update the state to include it
+	CheckAndUpdate(cs *ConsensusState, blk *block.Block) bool
+	// check the header and update the state to include it without its body,
+	// the state is then only good for checking the following headers
+	UpdateHeader(cs *ConsensusState, bh *block.BlockHeader) error
+	EncodeState(w io.Writer, cs *ConsensusState) error
+	DecodeState(r io.Reader) (*ConsensusState, error)
+	// whether the producer may produce a block on top of the state at the time
+	CanProduce(cs *ConsensusState, producer block.PubkeyType, time uint64) bool
+}
+
+// sha256 proof of work, the difficulty is retargeted every PeriodBlockCount blocks
+type PoW struct {
+	// the median time past rule replaces "later than the last block" from
+	// this height
+	MedianTimeHeight int
+	// local clock in nanoseconds for the future drift check, time.Now if nil
+	Now func() uint64
+}
+
+func clock(now func() uint64) uint64 {
+	if now == nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return now()
+}
+
+var ErrDifficulty = errors.New("block hash doesn't meet the difficulty")
+
+func (PoW) CheckHeader(cs *ConsensusState, bh *block.BlockHeader) error {
+	if bytes.Compare(bh.Hash[:], cs.Difficulty[:]) > 0 {
+		return ErrDifficulty
+	}
+	return nil
+}
+
+func (p PoW) CheckAndUpdate(cs *ConsensusState, blk *block.Block) bool {
+	if !cs.CheckTime(blk, cs.Height+1 >= p.MedianTimeHeight, clock(p.Now)) {
+		return false
+	}
+	return cs.update(blk)
+}
+
+// the time retargeting the difficulty is in the body, so the difficulty after
+// a retarget is bounded by the largest step up instead
+func (p PoW) UpdateHeader(cs *ConsensusState, bh *block.BlockHeader) error {
+	err := p.CheckHeader(cs, bh)
+	if err != nil {
+		return err
+	}
+	cs.Height++
+	if cs.Height%PeriodBlockCount == 0 {
+		cs.Difficulty = maxRetarget(cs.Difficulty)
+	}
+	return nil
+}
+
+func (PoW) EncodeState(w io.Writer, cs *ConsensusState) error {
+	return EncodeConsensus(w, cs)
+}
+
+func (PoW) DecodeState(r io.Reader) (*ConsensusState, error) {
+	return DecodeConsensus(r)
+}
+
+func (PoW) CanProduce(cs *ConsensusState, producer block.PubkeyType, time uint64) bool {
+	return true
+}
@@ -0,0 +1,109 @@
+package consensus
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"math/big"
+
+	"github.com/mcfx/tcoin/core/block"
+)
+
+// proof of authority, blocks are sealed by one of the signers, whose public
+// key is in ExtraData and whose signature of the seal hash is in Seal
+//
+// the signers take turns by height, the in-turn signer may produce a block
+// Period after the last one, and a signer d turns later after (d+1)*Period,
+// so the chain goes on if some signers are offline
+type PoA struct {
+	Signers []block.PubkeyType
+	Period  uint64
+	// local clock in nanoseconds for the future drift check, time.Now if nil
+	Now func() uint64
+}
+
+var ErrUnknownSigner = errors.New("unknown signer")
+var ErrSealMismatch = errors.New("seal mismatch")
+
+func (p *PoA) signerIndex(pk block.PubkeyType) int {
+	for i, s := range p.Signers {
+		if s == pk {
+			return i
+		}
+	}
+	return -1
+}
+
+// number of turns the signer is behind the in-turn signer of the next block
+func (p *PoA) distance(cs *ConsensusState, idx int) int {
+	n := len(p.Signers)
+	return (idx - (cs.Height+1)%n + n) % n
+}
+
+func (p *PoA) CheckHeader(cs *ConsensusState, bh *block.BlockHeader) error {
+	pk := block.PubkeyType(bh.ExtraData)
+	if p.signerIndex(pk) == -1 {
+		return ErrUnknownSigner
+	}
+	sh := bh.SealHash()
+	if !ed25519.Verify(pk[:], sh[:], bh.Seal[:]) {
+		return ErrSealMismatch
+	}
+	return nil
+}
+
+func (p *PoA) CheckAndUpdate(cs *ConsensusState, blk *block.Block) bool {
+	if !cs.CheckTime(blk, false, clock(p.Now)) {
+		return false
+	}
+	// the genesis block is trusted
+	if cs.Height >= 0 {
+		if p.CheckHeader(cs, &blk.Header) != nil {
+			return false
+		}
+		d := p.distance(cs, p.signerIndex(block.PubkeyType(blk.Header.ExtraData)))
+		if blk.Time < cs.LastBlockTime+p.Period*uint64(d+1) {
+			return false
+		}
+		cs.TotalWork = addWork(cs.TotalWork, big.NewInt(int64(len(p.Signers)-d)))
+	}
+	cs.Height++
+	cs.LastBlockTime = blk.Time
+	cs.LastKeyBlockTime = blk.Time
+	cs.pushTime(blk.Time)
+	return true
+}
+
+func (p *PoA) UpdateHeader(cs *ConsensusState, bh *block.BlockHeader) error {
+	err := p.CheckHeader(cs, bh)
+	if err != nil {
+		return err
+	}
+	cs.Height++
+	return nil
+}
+
+func (p *PoA) EncodeState(w io.Writer, cs *ConsensusState) error {
+	return EncodeConsensus(w, cs)
+}
+
+func (p *PoA) DecodeState(r io.Reader) (*ConsensusState, error) {
+	return DecodeConsensus(r)
+}
+
+func (p *PoA) CanProduce(cs *ConsensusState, producer block.PubkeyType, time uint64) bool {
+	idx := p.signerIndex(producer)
+	if idx == -1 {
+		return false
+	}
+	return time >= cs.LastBlockTime+p.Period*uint64(p.distance(cs, idx)+1)
+}
+
+// sign the block as the signer, the hash of the block is updated
+func (p *PoA) Seal(blk *block.Block, pubkey block.PubkeyType, privkey block.PrivkeyType) {
+	blk.Header.ExtraData = block.HashType(pubkey)
+	blk.Header.Seal = block.SigType{}
+	sh := blk.Header.SealHash()
+	copy(blk.Header.Seal[:], ed25519.Sign(privkey[:], sh[:]))
+	blk.Header.Hash = blk.Header.ComputeHash()
+}
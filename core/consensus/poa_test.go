@@ -0,0 +1,112 @@
+package consensus
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/mcfx/tcoin/core/block"
+)
+
+func TestPoA(t *testing.T) {
+	rnd := rand.New(rand.NewSource(114514))
+	pubks := []block.PubkeyType{}
+	priks := []block.PrivkeyType{}
+	for i := 0; i < 3; i++ {
+		pubk, prik := block.GenKeyPair(rnd)
+		pubks = append(pubks, pubk)
+		priks = append(priks, prik)
+	}
+	var period uint64 = 1000000000 * 10
+	var e Engine = &PoA{Signers: pubks, Period: period}
+	p := e.(*PoA)
+	cs := &ConsensusState{Height: -1}
+	genesis := &block.Block{Time: 1, Txs: []*block.Transaction{}}
+	genesis.FillHash()
+	if !e.CheckAndUpdate(cs, genesis) {
+		t.Fatal("genesis rejected")
+	}
+	newBlock := func(tm uint64, signer int) *block.Block {
+		blk := &block.Block{Time: tm, Txs: []*block.Transaction{}}
+		blk.FillHash()
+		p.Seal(blk, pubks[signer], priks[signer])
+		return blk
+	}
+
+	// signer 1 is in turn for height 1
+	if e.CanProduce(cs, pubks[1], 1+period-1) || !e.CanProduce(cs, pubks[1], 1+period) {
+		t.Fatal("in-turn signer should produce after the period")
+	}
+	if e.CanProduce(cs, pubks[2], 1+period) || !e.CanProduce(cs, pubks[2], 1+period*2) {
+		t.Fatal("out-of-turn signer should wait")
+	}
+	if e.CanProduce(cs, block.PubkeyType{1}, 1+period*10) {
+		t.Fatal("unknown signer can't produce")
+	}
+	cs2 := cs.Copy()
+	if e.CheckAndUpdate(cs2, newBlock(1+period*2-1, 2)) {
+		t.Fatal("out-of-turn block accepted too early")
+	}
+	if !e.CheckAndUpdate(cs2, newBlock(1+period*2, 2)) {
+		t.Fatal("out-of-turn block rejected")
+	}
+	blk := newBlock(1+period, 1)
+	if e.CheckHeader(cs, &blk.Header) != nil || !e.CheckAndUpdate(cs, blk) {
+		t.Fatal("in-turn block rejected")
+	}
+	if CompareWork(cs, cs2) <= 0 {
+		t.Fatal("in-turn block should have more work")
+	}
+
+	// the seal survives serialization
+	var b bytes.Buffer
+	err := block.EncodeBlock(&b, blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk2, err := block.DecodeBlock(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(blk, blk2) {
+		t.Fatal("not equal")
+	}
+
+	blk = newBlock(1+period*2, 2)
+	blk.Header.Seal[0] ^= 1
+	blk.Header.Hash = blk.Header.ComputeHash()
+	if e.CheckHeader(cs, &blk.Header) != ErrSealMismatch || e.CheckAndUpdate(cs.Copy(), blk) {
+		t.Fatal("tampered seal accepted")
+	}
+	blk = newBlock(1+period*2, 2)
+	blk.Header.ExtraData = block.HashType{1}
+	if e.CheckHeader(cs, &blk.Header) != ErrUnknownSigner {
+		t.Fatal("unknown signer accepted")
+	}
+}
+
+func TestPoWEngine(t *testing.T) {
+	var e Engine = PoW{}
+	cs := &ConsensusState{Difficulty: block.HashType{0, 0xff}}
+	blk := &block.Block{Time: 1, Txs: []*block.Transaction{}}
+	blk.FillHash()
+	for i := 0; bytes.Compare(blk.Header.Hash[:], cs.Difficulty[:]) <= 0; i++ {
+		blk.Header.ExtraData[0] = byte(i)
+		blk.Header.Hash = blk.Header.ComputeHash()
+	}
+	if e.CheckHeader(cs, &blk.Header) != ErrDifficulty || e.CheckAndUpdate(cs.Copy(), blk) {
+		t.Fatal("block over difficulty accepted")
+	}
+	for i := 0; bytes.Compare(blk.Header.Hash[:], cs.Difficulty[:]) > 0; i++ {
+		blk.Header.ExtraData[1] = byte(i)
+		blk.Header.ExtraData[2] = byte(i >> 8)
+		blk.Header.Hash = blk.Header.ComputeHash()
+	}
+	if e.CheckHeader(cs, &blk.Header) != nil || !e.CheckAndUpdate(cs, blk) {
+		t.Fatal("block rejected")
+	}
+	if !e.CanProduce(cs, block.PubkeyType{}, 0) {
+		t.Fatal("anyone can mine with pow")
+	}
+}
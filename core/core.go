@@ -2,13 +2,13 @@ package core
 
 import (
 	"bytes"
+	"container/heap"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
-	"math"
 	"math/rand"
-	"sync"
+	"sort"
 	"time"
 
 	"github.com/mcfx/tcoin/core/block"
@@ -16,29 +16,40 @@ import (
 	cnet "github.com/mcfx/tcoin/core/network"
 	"github.com/mcfx/tcoin/network"
 	"github.com/mcfx/tcoin/storage"
+	"github.com/mcfx/tcoin/utils/chaininfo"
 
 	"github.com/patrickmn/go-cache"
 )
 
+// sent to peers in the handshake
+const ClientVersion = "tcoin/1.0"
+
 type ChainNode struct {
-	se                  *storage.StorageEngine
-	unresolvedBlocks    *cache.Cache
-	blockCache          *cache.Cache
+	se               *storage.StorageEngine
+	unresolvedBlocks *cache.Cache
+	blockCache       *cache.Cache
+	// the peer which sent a block first, scored when the block is checked
+	blockSource         *cache.Cache
 	blockConsensusState *cache.Cache
 	txPool              *cache.Cache
-	neighborHeight      *cache.Cache
-	possibleNext        *cache.Cache
-	nc                  *network.Client
-	rchan               chan network.ClientPacket
-	txChan              chan *block.Transaction
-	checkUnBlocks       chan bool
-	broadcastBlocks     chan bool
-	config              ChainNodeConfig
-	gConfig             ChainGlobalConfig
-	execCallback        *block.ExecutionCallback
-	stop                chan bool
-	stopped             chan bool
-	seMut               sync.Mutex
+	// the txs each peer has sent or been sent, and the txs requested by hash
+	txKnown         *cache.Cache
+	txRequested     *cache.Cache
+	neighborState   *cache.Cache
+	possibleNext    *cache.Cache
+	hsync           *headerSync
+	nc              *network.Client
+	rchan           chan network.ClientPacket
+	txChan          chan *block.Transaction
+	checkUnBlocks   chan bool
+	broadcastBlocks chan bool
+	config          ChainNodeConfig
+	gConfig         ChainGlobalConfig
+	engine          consensus.Engine
+	producer        *producer
+	execCallback    *block.ExecutionCallback
+	stop            chan bool
+	stopped         chan bool
 }
 
 func NewChainNode(config ChainNodeConfig, gConfig ChainGlobalConfig, execCallback *block.ExecutionCallback) (*ChainNode, error) {
@@ -48,25 +59,27 @@ func NewChainNode(config ChainNodeConfig, gConfig ChainGlobalConfig, execCallbac
 	if gConfig.GenesisBlock.ComputeHash() != gConfig.GenesisBlock.Header.BodyHash {
 		return nil, errors.New("failed to init node: header hash mismatch")
 	}
+	engine, err := gConfig.newEngine()
+	if err != nil {
+		return nil, fmt.Errorf("failed to init node: %v", err)
+	}
+	prod, err := newProducer(config.Miner, engine)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init node: %v", err)
+	}
 	sl := storage.EmptySlice()
-	err := block.ExecuteBlock(gConfig.GenesisBlock, gConfig.GenesisBlockReward, sl, &block.ExecutionContext{
-		Height:      0,
-		Time:        gConfig.GenesisBlock.Time,
-		Miner:       gConfig.GenesisBlock.Miner,
-		Difficulty:  gConfig.GenesisConsensusState.Difficulty,
-		ChainId:     gConfig.ChainId,
-		Callback:    execCallback,
-		Tip1Enabled: 0 >= gConfig.Tip1EnableHeight,
-	})
+	rs, err := block.ExecuteBlock(gConfig.GenesisBlock, gConfig.GenesisBlockReward, sl, gConfig.newExecutionContext(
+		0, gConfig.GenesisBlock.Time, gConfig.GenesisBlock.Miner, gConfig.GenesisConsensusState.Difficulty, execCallback,
+	))
 	if err != nil {
 		return nil, fmt.Errorf("failed to init node: %v", err)
 	}
 	cs := gConfig.GenesisConsensusState
-	if !cs.CheckAndUpdate(gConfig.GenesisBlock) {
+	if !engine.CheckAndUpdate(cs, gConfig.GenesisBlock) {
 		return nil, errors.New("failed to init node: consensus rejected")
 	}
 	var buf bytes.Buffer
-	err = consensus.EncodeConsensus(&buf, cs)
+	err = engine.EncodeState(&buf, cs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init node: %v", err)
 	}
@@ -74,19 +87,87 @@ func NewChainNode(config ChainNodeConfig, gConfig ChainGlobalConfig, execCallbac
 	if err != nil {
 		return nil, fmt.Errorf("failed to init node: %v", err)
 	}
+	err = block.EncodeReceipts(&buf, rs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init node: %v", err)
+	}
+	var backend storage.Backend
+	if config.StoragePath == "" {
+		backend = storage.NewMemoryBackend()
+	} else {
+		report, err := CheckStorage(config.StoragePath, gConfig, false, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check storage: %v", err)
+		}
+		for _, p := range report.Repairable {
+			log.Printf("storage repaired: %s", p)
+		}
+		if len(report.Problems) > 0 {
+			return nil, fmt.Errorf("storage inconsistent, run cmd/storagecheck for details: %s", report.Problems[0])
+		}
+		due := false
+		if config.StoragePruneDepth > 0 {
+			due, err = pruneDue(config.StoragePath, report.StateHeight, config.StoragePruneDepth)
+			if err != nil {
+				return nil, fmt.Errorf("failed to prune storage: %v", err)
+			}
+		}
+		if due {
+			saved, err := CompactStorage(config.StoragePath, gConfig, config.StoragePruneDepth)
+			if err != nil {
+				return nil, fmt.Errorf("failed to prune storage: %v", err)
+			}
+			if saved > 0 {
+				log.Printf("storage pruned: %d bytes saved", saved)
+			}
+		}
+		backend, err = storage.NewFileBackend(config.StoragePath, config.StorageCacheSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init node: %v", err)
+		}
+	}
+	var snapshotBlock *block.Block
+	if config.Snapshot != "" && backend.StateHeight() == -1 {
+		snapshotBlock, err = importSnapshot(backend, config.Snapshot, engine)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import snapshot: %v", err)
+		}
+	}
+	err = migrateStoredRoot(backend, engine, buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate storage: %v", err)
+	}
 	se, err := storage.NewStorageEngine(storage.StorageEngineConfig{
-		FinalizeDepth: config.StorageFinalizeDepth,
-		DumpDiskRatio: config.StorageDumpDiskRatio,
-		Path:          config.StoragePath,
+		FinalizeDepth:  config.StorageFinalizeDepth,
+		DumpDiskRatio:  config.StorageDumpDiskRatio,
+		Path:           config.StoragePath,
+		SliceWork:      sliceWork(engine),
+		Archive:        config.StorageArchive,
+		StateCacheSize: config.StorageCacheSize,
+		Backend:        backend,
+		MigrateData: func(parent, data []byte) []byte {
+			return migrateBlockData(engine, parent, data)
+		},
 	}, sl, storage.SliceKeyType(gConfig.GenesisBlock.Header.Hash), buf.Bytes())
 	if err != nil {
 		return nil, fmt.Errorf("failed to init node: %v", err)
 	}
+	if snapshotBlock != nil && snapshotBlock.Header.StateRoot != (block.HashType{}) &&
+		block.HashType(se.Head().Slice.StateRoot()) != snapshotBlock.Header.StateRoot {
+		se.Stop()
+		return nil, errors.New("failed to import snapshot: state root mismatch, the storage has to be removed")
+	}
 	rchan := make(chan network.ClientPacket, 10000)
 	nc, err := network.NewClient(&network.ClientConfig{
 		Port:           config.ListenPort,
 		MaxConnections: config.MaxConnections,
 		Path:           config.StoragePath,
+		ClientVersion:  ClientVersion,
+		Capabilities:   cnet.Capabilities,
+		Status: func() (int, [32]byte) {
+			hc := se.Head().Chain
+			return hc[len(hc)-1].S.Height(), hc[len(hc)-1].Key
+		},
 	}, rchan, gConfig.ChainId)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init node: %v", err)
@@ -98,10 +179,13 @@ func NewChainNode(config ChainNodeConfig, gConfig ChainGlobalConfig, execCallbac
 		se:                  se,
 		unresolvedBlocks:    cache.New(time.Minute*5, time.Minute*10),
 		blockCache:          cache.New(time.Minute*5, time.Minute*10),
+		blockSource:         cache.New(time.Minute*5, time.Minute*10),
 		blockConsensusState: cache.New(time.Minute*5, time.Minute*10),
 		txPool:              cache.New(time.Minute*5, time.Minute*10),
-		neighborHeight:      cache.New(time.Minute*5, time.Minute*10),
+		txKnown:             cache.New(time.Minute*5, time.Minute*10),
+		neighborState:       cache.New(time.Minute*5, time.Minute*10),
 		possibleNext:        cache.New(time.Minute*5, time.Minute*10),
+		hsync:               newHeaderSync(),
 		nc:                  nc,
 		rchan:               rchan,
 		txChan:              make(chan *block.Transaction, 100),
@@ -109,16 +193,19 @@ func NewChainNode(config ChainNodeConfig, gConfig ChainGlobalConfig, execCallbac
 		broadcastBlocks:     make(chan bool, 10),
 		config:              config,
 		gConfig:             gConfig,
+		engine:              engine,
+		producer:            prod,
 		execCallback:        execCallback,
 		stop:                make(chan bool, 50),
 		stopped:             make(chan bool, 10),
 	}
+	cn.txRequested = newTxRequests(cn)
 	return cn, nil
 }
 
 func (cn *ChainNode) Stop() {
 	cn.istop()
-	for i := 0; i < 10; i++ {
+	for i := 0; i < 11; i++ {
 		<-cn.stopped
 	}
 }
@@ -139,6 +226,7 @@ func (cn *ChainNode) Run() {
 	go cn.checkUnresolvedBlocks()
 	go cn.syncLoop()
 	go cn.sendMyHighest()
+	go cn.produceLoop()
 	for {
 		slp := time.After(time.Second * 10)
 		select {
@@ -183,45 +271,75 @@ func (cn *ChainNode) readLoop() {
 				if p.MinId != -1 {
 					tmp := make([]byte, 8)
 					binary.LittleEndian.PutUint64(tmp, uint64(cp.PeerId))
-					t, ok := cn.neighborHeight.Get(string(tmp))
-					np := p.MinId + len(p.Body) - 1
+					t, ok := cn.neighborState.Get(string(tmp))
+					ns := neighborState{
+						Height: p.MinId + len(p.Body) - 1,
+						Work:   p.TotalWork,
+					}
 					if ok {
-						if t.(int) > np {
-							np = t.(int)
+						ot := t.(neighborState)
+						if ot.Height > ns.Height {
+							ns.Height = ot.Height
+						}
+						if bytes.Compare(ot.Work[:], ns.Work[:]) > 0 {
+							ns.Work = ot.Work
 						}
 					}
-					cn.neighborHeight.Set(string(tmp), np, cache.DefaultExpiration)
+					cn.neighborState.Set(string(tmp), ns, cache.DefaultExpiration)
 				}
-				return cn.handleBlocks(p)
+				return cn.handleBlocks(p, cp.PeerKey)
 			} else if opcode == cnet.PktTransactions {
 				p, err := cnet.DecodeTransactions(buf)
 				if err != nil {
 					return err
 				}
-				return cn.handleTransactions(p)
+				return cn.handleTransactions(p, &cp)
+			} else if opcode == cnet.PktHeaderRequest {
+				p, err := cnet.DecodeHeaderRequest(buf)
+				if err != nil {
+					return err
+				}
+				return cn.handleHeaderRequest(p, cp.PeerId)
+			} else if opcode == cnet.PktHeaders {
+				p, err := cnet.DecodeHeaders(buf)
+				if err != nil {
+					return err
+				}
+				return cn.handleHeaders(p, cp.PeerId, cp.PeerKey)
+			} else if opcode == cnet.PktBodyRequest {
+				p, err := cnet.DecodeBodyRequest(buf)
+				if err != nil {
+					return err
+				}
+				return cn.handleBodyRequest(p, cp.PeerId)
+			} else if opcode == cnet.PktTxAnnounce {
+				p, err := cnet.DecodeTxHashes(buf)
+				if err != nil {
+					return err
+				}
+				return cn.handleTxAnnounce(p, cp.PeerId)
+			} else if opcode == cnet.PktTxRequest {
+				p, err := cnet.DecodeTxHashes(buf)
+				if err != nil {
+					return err
+				}
+				return cn.handleTxRequest(p, cp.PeerId)
 			}
 			return nil
 		}()
 		if err != nil {
-			cn.nc.DiscardPeer(cp.PeerId, time.Minute*10)
+			cn.nc.ReportPeer(cp.PeerKey, network.EventInvalidPacket)
 		}
 	}
 }
 
 func (cn *ChainNode) loadBlock(height int, hash block.HashType) (*block.Block, *consensus.ConsensusState, error) {
-	cn.seMut.Lock()
-	defer cn.seMut.Unlock()
 	s, err := cn.se.ReadData(height, storage.SliceKeyType(hash))
 	if err != nil {
 		return nil, nil, err
 	}
-	buf := bytes.NewBuffer(s)
-	cs, err := consensus.DecodeConsensus(buf)
-	if err != nil {
-		return nil, nil, err
-	}
-	b, err := block.DecodeBlock(buf)
-	if err != nil {
+	cs, b, _, err := decodeBlockData(cn.engine, s)
+	if err != nil && err != errBodyPruned {
 		return nil, nil, err
 	}
 	if (block.HashType{}) == hash {
@@ -230,6 +348,10 @@ func (cn *ChainNode) loadBlock(height int, hash block.HashType) (*block.Block, *
 		return nil, nil, errors.New("block hash mismatch, possibly wrong height")
 	}
 	cn.blockConsensusState.Set(string(hash[:]), cs, cache.DefaultExpiration)
+	// a pruned block has only the header, and isn't cached
+	if err == errBodyPruned {
+		return b, cs, err
+	}
 	cn.blockCache.Set(string(hash[:]), b, cache.DefaultExpiration)
 	return b, cs, nil
 }
@@ -249,14 +371,37 @@ func (cn *ChainNode) getConsensusState(height int, hash block.HashType) (*consen
 		return t.(*consensus.ConsensusState), nil
 	}
 	_, c, err := cn.loadBlock(height, hash)
+	if err == errBodyPruned {
+		err = nil
+	}
 	return c, err
 }
 
+// total work of the chain ending at the block, used by the storage engine to
+// pick the highest chain
+func sliceWork(engine consensus.Engine) func(data []byte) storage.HashType {
+	return func(data []byte) storage.HashType {
+		cs, err := engine.DecodeState(bytes.NewBuffer(data))
+		if err != nil {
+			return storage.HashType{}
+		}
+		return storage.HashType(cs.TotalWork)
+	}
+}
+
+func (cn *ChainNode) highestWork(hc []storage.SliceChain) block.HashType {
+	ls := hc[len(hc)-1]
+	cs, err := cn.getConsensusState(ls.S.Height(), block.HashType(ls.Key))
+	if err != nil {
+		return block.HashType{}
+	}
+	return cs.TotalWork
+}
+
 func (cn *ChainNode) handleBlockRequest(p cnet.PacketBlockRequest, peerId, maxReturn int) error {
-	cn.seMut.Lock()
-	hs := cn.se.HighestSlice
-	hc := cn.se.HighestChain
-	cn.seMut.Unlock()
+	head := cn.se.Head()
+	hs := head.Slice
+	hc := head.Chain
 	rp, err := func() (cnet.PacketBlocks, error) {
 		rp := cnet.NewPacketBlocks(0)
 		if p.MinId == -1 {
@@ -290,6 +435,11 @@ func (cn *ChainNode) handleBlockRequest(p cnet.PacketBlockRequest, peerId, maxRe
 				h = block.HashType(hc[p.MinId+i-mh].Key)
 			}
 			b, err := cn.getBlock(p.MinId+i, h)
+			if err == errBodyPruned {
+				// the peer may get the body from others
+				rp.Add(b.Header, false)
+				continue
+			}
 			if err != nil {
 				return rp, fmt.Errorf("getblock error: %v", err)
 			}
@@ -305,22 +455,35 @@ func (cn *ChainNode) handleBlockRequest(p cnet.PacketBlockRequest, peerId, maxRe
 			rp.Add(b.Header, false)
 		}
 	}
+	rp.TotalWork = cn.highestWork(hc)
 	var buf bytes.Buffer
 	buf.WriteByte(cnet.PktBlocks)
 	err = cnet.EncodeBlocks(&buf, rp)
 	if err != nil {
 		return err
 	}
-	cn.nc.WriteTo(peerId, buf.Bytes())
+	cn.writeTo(peerId, buf.Bytes())
 	return nil
 }
 
+// packets are only sent to the peers which advertised their capability
+func (cn *ChainNode) writeTo(peerId int, data []byte) {
+	if cn.nc.HasCaps(peerId, cnet.PacketCapability(data[0])) {
+		cn.nc.WriteTo(peerId, data)
+	}
+}
+
+func (cn *ChainNode) broadcast(data []byte, count int) {
+	cn.nc.BroadcastCaps(data, count, cnet.PacketCapability(data[0]))
+}
+
 func (cn *ChainNode) sendHighest(peerId int, hs *storage.Slice, hc []storage.SliceChain, broadcast bool) error {
 	rp := cnet.NewPacketBlocks(hs.Height())
 	b, err := cn.getBlock(hs.Height(), block.HashType(hc[len(hc)-1].Key))
 	if err != nil {
 		rp.Add(b.Header, false)
 	}
+	rp.TotalWork = cn.highestWork(hc)
 	var buf bytes.Buffer
 	buf.WriteByte(cnet.PktBlocks)
 	err = cnet.EncodeBlocks(&buf, rp)
@@ -328,9 +491,9 @@ func (cn *ChainNode) sendHighest(peerId int, hs *storage.Slice, hc []storage.Sli
 		return err
 	}
 	if broadcast {
-		cn.nc.Broadcast(buf.Bytes(), cn.config.MaxConnections)
+		cn.broadcast(buf.Bytes(), cn.config.MaxConnections)
 	} else {
-		cn.nc.WriteTo(peerId, buf.Bytes())
+		cn.writeTo(peerId, buf.Bytes())
 	}
 	return nil
 }
@@ -374,21 +537,24 @@ func (cn *ChainNode) checkUnresolvedBlocks() {
 				return
 			}
 			b := bt.(*block.Block)
-			if b.Time > math.MaxInt64 || time.Unix(0, int64(b.Time)).After(time.Now().Add(time.Minute)) {
-				cn.unresolvedBlocks.Delete(string(k[:]))
-				return
-			}
 			cs, err := cn.getConsensusState(0, bh.ParentHash)
 			if err != nil {
 				return
 			}
+			// the clock of the sender may be ahead, so the block is kept for
+			// later instead of being dropped as invalid
+			if consensus.InFuture(b, uint64(time.Now().UnixNano())) {
+				return
+			}
 			oldCs := cs
 			cs = cs.Copy()
-			if !cs.CheckAndUpdate(b) {
+			if !cn.engine.CheckAndUpdate(cs, b) {
+				cn.reportBlock(k, network.EventInvalidBlock)
+				cn.invalidBlock(k)
 				return
 			}
 			var buf bytes.Buffer
-			err = consensus.EncodeConsensus(&buf, cs)
+			err = cn.engine.EncodeState(&buf, cs)
 			if err != nil {
 				return
 			}
@@ -396,28 +562,33 @@ func (cn *ChainNode) checkUnresolvedBlocks() {
 			if err != nil {
 				return
 			}
-			cn.seMut.Lock()
 			sl, ok := cn.se.GetSlice(storage.SliceKeyType(bh.ParentHash))
 			if ok {
 				sln := storage.ForkSlice(sl)
-				err := block.ExecuteBlock(b, cn.gConfig.BlockReward, sln, &block.ExecutionContext{
-					Height:      cs.Height,
-					Time:        b.Time,
-					Miner:       b.Miner,
-					Difficulty:  oldCs.Difficulty,
-					ChainId:     cn.gConfig.ChainId,
-					Callback:    cn.execCallback,
-					Tip1Enabled: cs.Height >= cn.gConfig.Tip1EnableHeight,
-				})
+				ctx := cn.gConfig.newExecutionContext(cs.Height, b.Time, b.Miner, oldCs.Difficulty, cn.execCallback)
+				rs, err := block.ExecuteBlock(b, cn.gConfig.BlockReward, sln, ctx)
+				if err == nil {
+					err = block.CheckStateRoot(b, sln, ctx)
+				}
+				if err == nil {
+					err = block.CheckReceiptsRoot(b, rs, ctx)
+				}
+				if err == nil {
+					err = block.EncodeReceipts(&buf, rs)
+				}
 				if err == nil {
+					writeTxIndex(sln, b)
 					sln.Freeze()
 					cn.se.AddFreezedSlice(sln, storage.SliceKeyType(k), storage.SliceKeyType(bh.ParentHash), buf.Bytes())
 					cn.unresolvedBlocks.Delete(string(k[:]))
 					// log.Printf("add block: %x", b.Header.Hash[:])
 					any = true
+					cn.reportBlock(k, network.EventUsefulBlock)
+				} else {
+					cn.reportBlock(k, network.EventInvalidBlock)
+					cn.invalidBlock(k)
 				}
 			}
-			cn.seMut.Unlock()
 		}
 		var tk block.HashType
 		for k := range ti {
@@ -426,8 +597,18 @@ func (cn *ChainNode) checkUnresolvedBlocks() {
 		}
 		if any {
 			cn.broadcastBlocks <- true
+			// the walk is limited in depth, blocks further from the added
+			// ones are resolved in the next round
+			select {
+			case cn.checkUnBlocks <- true:
+			default:
+			}
 		}
 		for _, k := range ask {
+			// requested by the header sync already
+			if cn.headerSyncHas(k) {
+				continue
+			}
 			p := cnet.PacketBlockRequest{
 				MinId: -1,
 				Hash:  k,
@@ -436,16 +617,32 @@ func (cn *ChainNode) checkUnresolvedBlocks() {
 			buf.WriteByte(cnet.PktBlockRequest)
 			err := cnet.EncodeBlockRequest(&buf, p)
 			if err == nil {
-				cn.nc.Broadcast(buf.Bytes(), 3)
+				cn.broadcast(buf.Bytes(), 3)
 			}
 		}
 	}
 }
 
-func (cn *ChainNode) handleBlocks(p cnet.PacketBlocks) error {
-	cn.seMut.Lock()
-	s := storage.ForkSlice(cn.se.HighestSlice)
-	cn.seMut.Unlock()
+// a block which failed to be added, it's dropped if the header sync would
+// otherwise wait for it
+func (cn *ChainNode) invalidBlock(k block.HashType) {
+	if cn.headerSyncFailed(k) {
+		cn.blockCache.Delete(string(k[:]))
+	}
+}
+
+// score the peer which sent the block, once
+func (cn *ChainNode) reportBlock(k block.HashType, ev network.PeerEvent) {
+	t, ok := cn.blockSource.Get(string(k[:]))
+	if !ok {
+		return
+	}
+	cn.blockSource.Delete(string(k[:]))
+	cn.nc.ReportPeer(t.(network.PeerKey), ev)
+}
+
+func (cn *ChainNode) handleBlocks(p cnet.PacketBlocks, from network.PeerKey) error {
+	s := storage.ForkSlice(cn.se.Head().Slice)
 	rejectLow := s.Height() - cn.config.StorageFinalizeDepth - 5
 	rejectHigh := s.Height() + 500
 	any := false
@@ -456,6 +653,7 @@ func (cn *ChainNode) handleBlocks(p cnet.PacketBlocks) error {
 			_, ok := cn.blockCache.Get(string(b.Header.Hash[:]))
 			if !ok {
 				cn.blockCache.Set(string(b.Header.Hash[:]), b, cache.DefaultExpiration)
+				cn.blockSource.Set(string(b.Header.Hash[:]), from, cache.DefaultExpiration)
 				for _, tx := range b.Txs {
 					hs := tx.Hash()
 					cn.txPool.Delete(string(hs[:]))
@@ -477,6 +675,10 @@ func (cn *ChainNode) handleBlocks(p cnet.PacketBlocks) error {
 			cn.unresolvedBlocks.Delete(string(bh.Hash[:]))
 			continue
 		}
+		if cs, err := cn.getConsensusState(-1, bh.ParentHash); err == nil && cn.engine.CheckHeader(cs, &bh) != nil {
+			cn.nc.ReportPeer(from, network.EventInvalidBlock)
+			continue
+		}
 		// log.Printf("get block %d %x", p.MinId+i, bh.Hash[:])
 		_, ok := cn.unresolvedBlocks.Get(string(bh.Hash[:]))
 		if !ok {
@@ -514,26 +716,54 @@ func (cn *ChainNode) broadcastTxsLoop() {
 		if len(txs) == 0 {
 			continue
 		}
-		var buf bytes.Buffer
-		buf.WriteByte(cnet.PktTransactions)
-		err := cnet.EncodeTransactions(&buf, cnet.PacketTransactions{Txs: txs})
-		if err != nil {
-			continue
-		}
-		cn.nc.Broadcast(buf.Bytes(), 3)
+		cn.announceTxs(txs)
 	}
 }
 
-func (cn *ChainNode) handleTransactions(p cnet.PacketTransactions) error {
+// the txs are checked against the next block
+func (cn *ChainNode) checkTx(tx *block.Transaction) error {
+	h := cn.se.Head().Slice.Height() + 1
+	return block.CheckTx(tx, cn.gConfig.newExecutionContext(h, 0, block.AddressType{}, block.HashType{}, nil))
+}
+
+// from is nil for local txs
+func (cn *ChainNode) handleTransactions(p cnet.PacketTransactions, from *network.ClientPacket) error {
+	var res error
 	for _, tx := range p.Txs {
 		hs := tx.Hash()
-		err := cn.txPool.Add(string(hs[:]), tx, cache.DefaultExpiration)
+		if from != nil {
+			cn.markTxKnown(from.PeerId, hs)
+		}
+		err := cn.checkTx(tx)
+		if err != nil {
+			if from != nil {
+				cn.nc.ReportPeer(from.PeerKey, network.EventInvalidTx)
+			}
+			res = err
+			continue
+		}
+		// a low price isn't invalid, it's just not worth keeping here
+		if tx.TxType == 3 && tx.GasPrice < cn.config.MinGasPrice {
+			res = fmt.Errorf("gas price below %d", cn.config.MinGasPrice)
+			continue
+		}
+		err = cn.txPool.Add(string(hs[:]), tx, cache.DefaultExpiration)
+		cn.txRequested.Delete(string(hs[:]))
 		if err == nil {
 			cn.broadcastTx(tx)
 		}
 	}
 	cn.broadcastTx(nil)
-	return nil
+	if from != nil {
+		return nil
+	}
+	return res
+}
+
+// the highest block a neighbor has told us, and the total work of its chain
+type neighborState struct {
+	Height int
+	Work   block.HashType
 }
 
 func (cn *ChainNode) syncLoop() {
@@ -546,26 +776,41 @@ func (cn *ChainNode) syncLoop() {
 		case <-cn.stop:
 			return
 		}
-		cn.seMut.Lock()
-		hs := cn.se.HighestSlice
-		hc := cn.se.HighestChain
-		cn.seMut.Unlock()
+		head := cn.se.Head()
+		hs := head.Slice
+		hc := head.Chain
 		mh := hc[len(hc)-1].S.Height()
-		nh := cn.neighborHeight.Items()
+		mw := cn.highestWork(hc)
+		cn.stepHeaderSync()
+		nh := cn.neighborState.Items()
 		keys := make([]string, 0, len(nh))
 		for k := range nh {
 			keys = append(keys, k)
 		}
 		p := rand.Perm(len(keys))
 		remReq := 1
+		if cn.headerSyncing() {
+			remReq = 0
+		}
 		for ti := 0; ti < len(p); ti++ {
 			k := keys[p[ti]]
 			v := nh[k]
 			id := int(binary.LittleEndian.Uint64([]byte(k)))
-			h := v.Object.(int)
-			if h < mh-3 {
+			ns := v.Object.(neighborState)
+			h := ns.Height
+			// older nodes don't send the work, compare the height instead
+			c := bytes.Compare(ns.Work[:], mw[:])
+			if ns.Work == (block.HashType{}) {
+				c = 0
+				if h < mh {
+					c = -1
+				} else if h > mh {
+					c = 1
+				}
+			}
+			if c < 0 && (h < mh-3 || h >= mh) {
 				cn.sendHighest(id, hs, hc, false)
-			} else if h < mh {
+			} else if c < 0 {
 				if rand.Intn(4) == 0 {
 					hs := block.HashType{}
 					if h > hc[0].S.Height() {
@@ -576,25 +821,35 @@ func (cn *ChainNode) syncLoop() {
 						Hash:  hs,
 					}, id, 5)
 				}
-			} else if h > mh {
+			} else if c > 0 {
 				if rand.Intn(5) == 1 {
 					cn.sendHighest(id, hs, hc, false)
 				}
-				if remReq > 0 {
+				if remReq > 0 && h > mh+headerSyncMinLead && cn.nc.HasCaps(id, cnet.CapHeaders) {
+					cn.startHeaderSync(id, h, hc)
+					remReq--
+				} else if remReq > 0 {
+					// a heavier chain may be shorter, then ask for its top
+					// block and resolve the parents by hash
+					minId := mh + 1
 					hs := block.HashType{}
-					t, ok := cn.possibleNext.Get(string(hc[len(hc)-1].Key[:]))
-					if ok {
-						hs = t.(block.HashType)
+					if h < minId {
+						minId = h
+					} else {
+						t, ok := cn.possibleNext.Get(string(hc[len(hc)-1].Key[:]))
+						if ok {
+							hs = t.(block.HashType)
+						}
 					}
 					p := cnet.PacketBlockRequest{
-						MinId: mh + 1,
+						MinId: minId,
 						Hash:  hs,
 					}
 					var buf bytes.Buffer
 					buf.WriteByte(cnet.PktBlockRequest)
 					err := cnet.EncodeBlockRequest(&buf, p)
 					if err == nil {
-						cn.nc.WriteTo(id, buf.Bytes())
+						cn.writeTo(id, buf.Bytes())
 						remReq--
 					}
 				}
@@ -612,21 +867,19 @@ func (cn *ChainNode) sendMyHighest() {
 		case <-cn.stop:
 			return
 		}
-		cn.seMut.Lock()
-		hs := cn.se.HighestSlice
-		hc := cn.se.HighestChain
-		cn.seMut.Unlock()
+		head := cn.se.Head()
+		hs := head.Slice
+		hc := head.Chain
 		cn.sendHighest(0, hs, hc, true)
 	}
 }
 
 func (cn *ChainNode) GetBlockCandidate(miner block.AddressType) *block.Block {
-	// todo: sort by gas price
 	txPool := cn.txPool.Items()
-	cn.seMut.Lock()
-	sl := storage.ForkSlice(cn.se.HighestSlice)
-	ls := cn.se.HighestChain[len(cn.se.HighestChain)-1]
-	cn.seMut.Unlock()
+	head := cn.se.Head()
+	hs := head.Slice
+	ls := head.Chain[len(head.Chain)-1]
+	sl := storage.ForkSlice(hs)
 	b := &block.Block{}
 	b.Header.ParentHash = block.HashType(ls.Key)
 	h := sl.Height()
@@ -634,27 +887,100 @@ func (cn *ChainNode) GetBlockCandidate(miner block.AddressType) *block.Block {
 	b.Miner = miner
 	b.Time = uint64(time.Now().UnixNano())
 	b.Txs = make([]*block.Transaction, 0)
+	ctx := cn.gConfig.newExecutionContext(h, b.Time, miner, cs.Difficulty, cn.execCallback)
+	bySender := make(map[block.PubkeyType]txQueue)
 	for _, v := range txPool {
 		tx := v.Object.(*block.Transaction)
-		sl2 := storage.ForkSlice(sl)
-		err := block.ExecuteTx(tx, sl2, &block.ExecutionContext{
-			Height:      h,
-			Time:        b.Time,
-			Miner:       miner,
-			Difficulty:  cs.Difficulty,
-			ChainId:     cn.gConfig.ChainId,
-			Callback:    cn.execCallback,
-			Tip1Enabled: h >= cn.gConfig.Tip1EnableHeight,
+		if tx.TxType == 3 && tx.GasPrice < cn.config.MinGasPrice {
+			continue
+		}
+		bySender[tx.SenderPubkey] = append(bySender[tx.SenderPubkey], tx)
+	}
+	qs := make(txQueues, 0, len(bySender))
+	for _, q := range bySender {
+		sort.Slice(q, func(i, j int) bool {
+			if q[i].Nonce != q[j].Nonce {
+				return q[i].Nonce < q[j].Nonce
+			}
+			return q[i].EffectiveGasPrice() > q[j].EffectiveGasPrice()
 		})
+		qs = append(qs, q)
+	}
+	heap.Init(&qs)
+	// leave room for the header roots and the growth of the tx count
+	var gas, fee uint64
+	rs := []*block.Receipt{}
+	size := b.EncodedSize() + block.HashLen*2 + 2
+	for len(qs) > 0 {
+		q := qs[0]
+		tx := q[0]
+		var buf bytes.Buffer
+		block.EncodeTx(&buf, tx)
+		if (ctx.BlockGasLimit != 0 && (gas+tx.GasLimit < gas || gas+tx.GasLimit > ctx.BlockGasLimit)) ||
+			(ctx.BlockSizeLimit != 0 && size+buf.Len() > ctx.BlockSizeLimit) {
+			// the later txs of the sender need this one
+			heap.Pop(&qs)
+			continue
+		}
+		sl2 := storage.ForkSlice(sl)
+		rc, err := block.ExecuteTxWithReceipt(tx, sl2, ctx)
 		if err == nil {
 			sl2.Merge()
 			b.Txs = append(b.Txs, tx)
+			rs = append(rs, rc)
+			gas += tx.GasLimit
+			fee += tx.FeeForGas(rc.GasUsed)
+			size += buf.Len()
+		}
+		if len(q) == 1 {
+			heap.Pop(&qs)
+		} else {
+			qs[0] = q[1:]
+			heap.Fix(&qs, 0)
 		}
 	}
+	// the roots come from the txs executed above, as in block.ExecuteBlock
+	err := block.FinishBlock(b, fee+cn.gConfig.BlockReward, sl, ctx)
+	if err == nil && ctx.Tip2Enabled {
+		b.Header.StateRoot = block.HashType(sl.StateRoot())
+	}
+	if err == nil && ctx.Tip4Enabled {
+		b.Header.ReceiptsRoot = block.ReceiptsRoot(rs)
+	}
 	b.FillHash()
 	return b
 }
 
+// the pool txs of a sender in nonce order
+type txQueue []*block.Transaction
+
+// the senders by the price of their next tx, so the candidate takes the best
+// paying txs without breaking the nonce order of a sender
+type txQueues []txQueue
+
+func (qs txQueues) Len() int {
+	return len(qs)
+}
+
+func (qs txQueues) Less(i, j int) bool {
+	return qs[i][0].EffectiveGasPrice() > qs[j][0].EffectiveGasPrice()
+}
+
+func (qs txQueues) Swap(i, j int) {
+	qs[i], qs[j] = qs[j], qs[i]
+}
+
+func (qs *txQueues) Push(x interface{}) {
+	*qs = append(*qs, x.(txQueue))
+}
+
+func (qs *txQueues) Pop() interface{} {
+	old := *qs
+	x := old[len(old)-1]
+	*qs = old[:len(old)-1]
+	return x
+}
+
 func (cn *ChainNode) SubmitBlock(b *block.Block) error {
 	// log.Printf("submit block: %x", b.Header.Hash[:])
 	cn.blockCache.Set(string(b.Header.Hash[:]), b, cache.DefaultExpiration)
@@ -672,14 +998,21 @@ func (cn *ChainNode) SubmitBlock(b *block.Block) error {
 	if err != nil {
 		return err
 	}
-	cn.nc.Broadcast(buf.Bytes(), 7)
+	cn.broadcast(buf.Bytes(), 7)
 	return nil
 }
 
+// whether the producer may produce a block on top of the highest block now
+func (cn *ChainNode) CanProduce(producer block.PubkeyType) bool {
+	_, cs, err := cn.GetHighest()
+	if err != nil {
+		return false
+	}
+	return cn.engine.CanProduce(cs, producer, uint64(time.Now().UnixNano()))
+}
+
 func (cn *ChainNode) GetHighest() (*block.Block, *consensus.ConsensusState, error) {
-	cn.seMut.Lock()
-	hc := cn.se.HighestChain
-	cn.seMut.Unlock()
+	hc := cn.se.Head().Chain
 	uh := hc[len(hc)-1]
 	h := block.HashType(uh.Key)
 	b, err := cn.getBlock(uh.S.Height(), h)
@@ -693,22 +1026,57 @@ func (cn *ChainNode) GetHighest() (*block.Block, *consensus.ConsensusState, erro
 	return b, c, nil
 }
 
+// the peers banned for their low scores
+func (cn *ChainNode) GetBans() []network.PeerBan {
+	return cn.nc.GetBans()
+}
+
+// the info needed by wallets to sign a transaction for the next block
+func (cn *ChainNode) GetChainInfo() chaininfo.ChainInfo {
+	h := cn.se.Head().Slice.Height() + 1
+	return chaininfo.ChainInfo{
+		ChainId:     cn.gConfig.ChainId,
+		Height:      h,
+		Tip3Enabled: h >= cn.gConfig.Tip3EnableHeight,
+		Tip5Enabled: h >= cn.gConfig.Tip5EnableHeight,
+		GasPrice:    cn.SuggestGasPrice(),
+	}
+}
+
+// the median gas price of the type 3 txs in the pool, and at least the
+// configured min price
+func (cn *ChainNode) SuggestGasPrice() uint64 {
+	ps := make([]uint64, 0)
+	for _, v := range cn.txPool.Items() {
+		tx := v.Object.(*block.Transaction)
+		if tx.TxType == 3 {
+			ps = append(ps, tx.GasPrice)
+		}
+	}
+	if len(ps) == 0 {
+		return cn.config.MinGasPrice
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i] < ps[j]
+	})
+	if ps[len(ps)/2] < cn.config.MinGasPrice {
+		return cn.config.MinGasPrice
+	}
+	return ps[len(ps)/2]
+}
+
 func (cn *ChainNode) GetAccountInfo(addr block.AddressType) block.AccountInfo {
-	cn.seMut.Lock()
-	defer cn.seMut.Unlock()
-	return block.GetAccountInfo(cn.se.HighestSlice, addr)
+	return block.GetAccountInfo(cn.se.Head().Slice, addr)
 }
 
 func (cn *ChainNode) SubmitTx(tx *block.Transaction) error {
 	return cn.handleTransactions(cnet.PacketTransactions{
 		Txs: []*block.Transaction{tx},
-	})
+	}, nil)
 }
 
 func (cn *ChainNode) GetBlock(height int) (*block.Block, *consensus.ConsensusState, error) {
-	cn.seMut.Lock()
-	hc := cn.se.HighestChain
-	cn.seMut.Unlock()
+	hc := cn.se.Head().Chain
 	mh := hc[len(hc)-1].S.Height()
 	hash := block.HashType{}
 	if height >= hc[0].S.Height() && height <= mh {
@@ -726,9 +1094,7 @@ func (cn *ChainNode) GetBlock(height int) (*block.Block, *consensus.ConsensusSta
 }
 
 func (cn *ChainNode) GetStorageAt(addr block.AddressType, pos block.HashType) storage.DataType {
-	cn.seMut.Lock()
-	s := cn.se.HighestSlice
-	cn.seMut.Unlock()
+	s := cn.se.Head().Slice
 	key := storage.KeyType{}
 	key[0] = 2
 	copy(key[1:33], addr[:])
@@ -736,49 +1102,135 @@ func (cn *ChainNode) GetStorageAt(addr block.AddressType, pos block.HashType) st
 	return s.Read(key)
 }
 
+// the state after the block at the height on the highest chain, finalized
+// heights need archive mode
+func (cn *ChainNode) getStateAt(height int) (*storage.Slice, error) {
+	hc := cn.se.Head().Chain
+	if height > hc[len(hc)-1].S.Height() {
+		return nil, errors.New("height too large")
+	}
+	if height >= hc[0].S.Height() {
+		return hc[height-hc[0].S.Height()].S, nil
+	}
+	return cn.se.HistorySlice(height)
+}
+
+const MaxStorageListLimit = 1000
+
+type StorageSlot struct {
+	Pos   block.HashType
+	Value storage.DataType
+}
+
+// list the non-zero storage slots of the contract from start on, ordered by
+// position
+func (cn *ChainNode) ListStorage(addr block.AddressType, start block.HashType, limit int) ([]StorageSlot, error) {
+	if limit <= 0 || limit > MaxStorageListLimit {
+		return nil, errors.New("invalid limit")
+	}
+	s := cn.se.Head().Slice
+	key := storage.KeyType{}
+	key[0] = 2
+	copy(key[1:33], addr[:])
+	copy(key[33:], start[:])
+	kvs, err := s.Iterate(key[:33], key, limit)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]StorageSlot, len(kvs))
+	for i, kv := range kvs {
+		copy(res[i].Pos[:], kv.Key[33:])
+		res[i].Value = kv.Value
+	}
+	return res, nil
+}
+
+func (cn *ChainNode) GetAccountInfoAtHeight(addr block.AddressType, height int) (block.AccountInfo, error) {
+	s, err := cn.getStateAt(height)
+	if err != nil {
+		return block.AccountInfo{}, err
+	}
+	return block.GetAccountInfo(s, addr), nil
+}
+
+func (cn *ChainNode) GetStorageAtHeight(addr block.AddressType, pos block.HashType, height int) (storage.DataType, error) {
+	s, err := cn.getStateAt(height)
+	if err != nil {
+		return storage.DataType{}, err
+	}
+	key := storage.KeyType{}
+	key[0] = 2
+	copy(key[1:33], addr[:])
+	copy(key[33:], pos[:])
+	return s.Read(key), nil
+}
+
+func (cn *ChainNode) getHighestWithHeader() (*storage.Slice, *block.BlockHeader, error) {
+	head := cn.se.Head()
+	s := head.Slice
+	hc := head.Chain
+	uh := hc[len(hc)-1]
+	b, err := cn.getBlock(uh.S.Height(), block.HashType(uh.Key))
+	if err != nil {
+		return nil, nil, err
+	}
+	if b.Header.StateRoot == (block.HashType{}) {
+		return nil, nil, errors.New("highest block has no state root")
+	}
+	return s, &b.Header, nil
+}
+
+func (cn *ChainNode) GetAccountInfoWithProof(addr block.AddressType) (block.AccountInfo, *block.BlockHeader, *storage.StateProof, error) {
+	s, bh, err := cn.getHighestWithHeader()
+	if err != nil {
+		return block.AccountInfo{}, nil, nil, err
+	}
+	key := storage.KeyType{}
+	key[0] = 1
+	copy(key[1:33], addr[:])
+	return block.GetAccountInfo(s, addr), bh, s.ProveState(key), nil
+}
+
+func (cn *ChainNode) GetStorageAtWithProof(addr block.AddressType, pos block.HashType) (storage.DataType, *block.BlockHeader, *storage.StateProof, error) {
+	s, bh, err := cn.getHighestWithHeader()
+	if err != nil {
+		return storage.DataType{}, nil, nil, err
+	}
+	key := storage.KeyType{}
+	key[0] = 2
+	copy(key[1:33], addr[:])
+	copy(key[33:], pos[:])
+	return s.Read(key), bh, s.ProveState(key), nil
+}
+
 func (cn *ChainNode) GetContractElf(addr block.AddressType) ([]byte, error) {
-	cn.seMut.Lock()
-	s := cn.se.HighestSlice
-	cn.seMut.Unlock()
+	s := cn.se.Head().Slice
 	return block.LoadContractCode(s, addr)
 }
 
-func (cn *ChainNode) EstimateGas(origin block.AddressType, code []byte) (int, error) {
+// returns the gas used by a type 2 or 3 tx with the code, and the suggested gas price
+func (cn *ChainNode) EstimateGas(origin block.AddressType, code []byte) (int, uint64, error) {
 	const gasLimit = 100000000
-	cn.seMut.Lock()
-	sl := storage.ForkSlice(cn.se.HighestSlice)
-	ls := cn.se.HighestChain[len(cn.se.HighestChain)-1]
-	cn.seMut.Unlock()
+	head := cn.se.Head()
+	sl := storage.ForkSlice(head.Slice)
+	ls := head.Chain[len(head.Chain)-1]
 	h := sl.Height()
 	cs, _ := cn.getConsensusState(ls.S.Height(), block.HashType(ls.Key))
-	rem, err := block.ExecVmTxRawCode(origin, gasLimit, code, sl, &block.ExecutionContext{
-		Height:      h,
-		Time:        uint64(time.Now().UnixNano()),
-		Miner:       block.AddressType{1},
-		Difficulty:  cs.Difficulty,
-		ChainId:     cn.gConfig.ChainId,
-		Callback:    cn.execCallback,
-		Tip1Enabled: h >= cn.gConfig.Tip1EnableHeight,
-	}, nil)
-	return int(gasLimit - rem), err
+	rem, err := block.ExecVmTxRawCode(origin, gasLimit, code, sl, cn.gConfig.newExecutionContext(
+		h, uint64(time.Now().UnixNano()), block.AddressType{1}, cs.Difficulty, cn.execCallback,
+	), nil)
+	return int(gasLimit - rem), cn.SuggestGasPrice(), err
 }
 
 func (cn *ChainNode) RunViewRawCode(origin block.AddressType, code []byte) ([]byte, error) {
 	const gasLimit = 100000000
-	cn.seMut.Lock()
-	sl := storage.ForkSlice(cn.se.HighestSlice)
-	ls := cn.se.HighestChain[len(cn.se.HighestChain)-1]
-	cn.seMut.Unlock()
+	head := cn.se.Head()
+	sl := storage.ForkSlice(head.Slice)
+	ls := head.Chain[len(head.Chain)-1]
 	h := sl.Height()
 	cs, _ := cn.getConsensusState(ls.S.Height(), block.HashType(ls.Key))
-	b, err := block.ExecVmViewRawCode(origin, gasLimit, code, sl, &block.ExecutionContext{
-		Height:      h,
-		Time:        uint64(time.Now().UnixNano()),
-		Miner:       block.AddressType{1},
-		Difficulty:  cs.Difficulty,
-		ChainId:     cn.gConfig.ChainId,
-		Callback:    cn.execCallback,
-		Tip1Enabled: h >= cn.gConfig.Tip1EnableHeight,
-	})
+	b, err := block.ExecVmViewRawCode(origin, gasLimit, code, sl, cn.gConfig.newExecutionContext(
+		h, uint64(time.Now().UnixNano()), block.AddressType{1}, cs.Difficulty, cn.execCallback,
+	))
 	return b, err
 }
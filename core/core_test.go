@@ -1,16 +1,22 @@
 package core
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"encoding/binary"
+	"encoding/hex"
 	"log"
 	"math/rand"
 	"os"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/mcfx/tcoin/core/block"
 	"github.com/mcfx/tcoin/core/consensus"
+	"github.com/mcfx/tcoin/storage"
+	"github.com/patrickmn/go-cache"
 )
 
 func testKeyPair(id int) (block.PubkeyType, block.PrivkeyType) {
@@ -36,15 +42,22 @@ func testInitBlock() *block.Block {
 
 func startTestNode(t *testing.T, portBase, id int) *ChainNode {
 	config := ChainNodeConfig{
-		StoragePath:          "/tmp/tcoin_test/u" + strconv.Itoa(id),
+		StoragePath:          "",
 		StorageFinalizeDepth: 20,
 		StorageDumpDiskRatio: 0.8,
 		ListenPort:           portBase + id,
 		MaxConnections:       10,
 	}
-	os.RemoveAll(config.StoragePath)
+	cn, err := NewChainNode(config, testGlobalConfig(), nil)
+	if err != nil {
+		t.Fatalf("failed to start node %d: %v", id, err)
+	}
+	return cn
+}
+
+func testGlobalConfig() ChainGlobalConfig {
 	var bi uint64 = 1000000000
-	gConfig := ChainGlobalConfig{
+	return ChainGlobalConfig{
 		ChainId:      8888,
 		GenesisBlock: testInitBlock(),
 		GenesisConsensusState: &consensus.ConsensusState{
@@ -56,18 +69,16 @@ func startTestNode(t *testing.T, portBase, id int) *ChainNode {
 		GenesisBlockReward: bi * 100,
 		BlockReward:        bi,
 	}
-	cn, err := NewChainNode(config, gConfig, nil)
-	if err != nil {
-		t.Fatalf("failed to start node %d: %v", id, err)
-	}
-	return cn
 }
 
 func genTestBlocks(n int, ko int) []*block.Block {
 	var bi = 1000000000
 	pub, _ := testKeyPair(1)
 	res := make([]*block.Block, 0)
-	lst := testInitBlock().Header.Hash
+	ib := testInitBlock()
+	lst := ib.Header.Hash
+	s := storage.EmptySlice()
+	block.ExecuteBlock(ib, uint64(bi)*100, s, &block.ExecutionContext{})
 	for i := 1; i <= n; i++ {
 		b := &block.Block{
 			Header: block.BlockHeader{
@@ -78,6 +89,10 @@ func genTestBlocks(n int, ko int) []*block.Block {
 			Time:  uint64(i * bi * 10),
 			Txs:   []*block.Transaction{},
 		}
+		s.Freeze()
+		s = storage.ForkSlice(s)
+		block.ExecuteBlock(b, uint64(bi), s, &block.ExecutionContext{Height: i, Tip2Enabled: true})
+		b.Header.StateRoot = block.HashType(s.StateRoot())
 		b.FillHash()
 		for j := ko; b.Header.Hash[0] != 0; j++ {
 			binary.BigEndian.PutUint64(b.Header.ExtraData[:8], uint64(j))
@@ -179,6 +194,132 @@ func TestCore4(t *testing.T) {
 	testTwoNodesInitSync(t, 100, 67, 24000, true)
 }
 
+func TestHeaderSync(t *testing.T) {
+	pb := 27000
+	n := 300
+	cn1 := startTestNode(t, pb, 1)
+	cn2 := startTestNode(t, pb, 2)
+	go cn1.Run()
+	go cn2.Run()
+	for _, b := range genTestBlocks(n, 1) {
+		err := cn2.SubmitBlock(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; cn2.GetSyncStatus().Height < n; i++ {
+		if i == 60 {
+			t.Fatal("node2 height too small")
+		}
+		time.Sleep(time.Second)
+	}
+	cn1.nc.AddPeers([]string{"127.0.0.1:" + strconv.Itoa(pb+2)})
+	for i := 0; i < 120; i++ {
+		st := cn1.GetSyncStatus()
+		if st.Syncing && (st.TargetHeight < n-1 || st.Progress < 0 || st.Progress > 1) {
+			t.Fatalf("wrong sync status %+v", st)
+		}
+		if !st.Syncing && st.Height == n {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	cn1.hsync.mut.Lock()
+	started := !cn1.hsync.startTime.IsZero()
+	cn1.hsync.mut.Unlock()
+	if !started {
+		t.Fatal("header sync not started")
+	}
+	st := cn1.GetSyncStatus()
+	if st.Syncing || st.Height != n {
+		t.Fatalf("node1 not synced: %+v", st)
+	}
+	cn1.Stop()
+	cn2.Stop()
+}
+
+func TestHeaderSyncAbort(t *testing.T) {
+	cn := startTestNode(t, 29000, 1)
+	go cn.Run()
+	hc := cn.se.Head().Chain
+	// the peer is not connected
+	cn.startHeaderSync(12345, 1000, hc)
+	if cn.headerSyncing() {
+		t.Fatal("header sync kept without the peer")
+	}
+	bs := genTestBlocks(2, 1)
+	hs := cn.hsync
+	hs.mut.Lock()
+	hs.peer = 12345
+	hs.headers = []block.BlockHeader{bs[0].Header, bs[1].Header}
+	hs.mut.Unlock()
+	cn.blockCache.Set(string(bs[1].Header.Hash[:]), bs[1], 0)
+	cn.invalidBlock(bs[1].Header.Hash)
+	if cn.headerSyncing() {
+		t.Fatal("header sync kept after an invalid block")
+	}
+	if _, ok := cn.blockCache.Get(string(bs[1].Header.Hash[:])); ok {
+		t.Fatal("invalid block kept in the cache")
+	}
+	cn.Stop()
+}
+
+func TestTxGossip(t *testing.T) {
+	pb := 28000
+	cns := []*ChainNode{}
+	for i := 1; i <= 3; i++ {
+		cn := startTestNode(t, pb, i)
+		go cn.Run()
+		cns = append(cns, cn)
+	}
+	cns[0].nc.AddPeers([]string{"127.0.0.1:" + strconv.Itoa(pb+2)})
+	cns[2].nc.AddPeers([]string{"127.0.0.1:" + strconv.Itoa(pb+2)})
+	time.Sleep(time.Second * 10)
+	pub, priv := testKeyPair(1)
+	tx := &block.Transaction{
+		TxType:       1,
+		SenderPubkey: pub,
+		Receiver:     block.AddressType{1},
+		Value:        1,
+		Nonce:        1,
+		Data:         []byte{},
+	}
+	tx.SignWithChainId(priv, 8888)
+	err := cns[0].SubmitTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := tx.Hash()
+	for i := 0; ; i++ {
+		if i == 30 {
+			t.Fatal("tx not relayed")
+		}
+		all := true
+		for _, cn := range cns {
+			if _, ok := cn.txPool.Get(string(hs[:])); !ok {
+				all = false
+			}
+		}
+		if all {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	// every peer of the relaying node knows the tx, so it's not sent back
+	ids := cns[1].nc.PeerIds(0)
+	if len(ids) == 0 {
+		t.Fatal("no peers")
+	}
+	for _, id := range ids {
+		if !cns[1].markTxKnown(id, hs) {
+			t.Fatalf("tx unknown by peer %d", id)
+		}
+	}
+	for _, cn := range cns {
+		cn.Stop()
+	}
+}
+
 func TestFork(t *testing.T) {
 	pb := 25000
 	cn1 := startTestNode(t, pb, 1)
@@ -221,3 +362,294 @@ func TestFork(t *testing.T) {
 	cn1.Stop()
 	cn2.Stop()
 }
+
+func TestPruneBlockData(t *testing.T) {
+	engine := consensus.PoW{}
+	b := genTestBlocks(1, 1)[0]
+	cs := &consensus.ConsensusState{Height: 1, Difficulty: block.HashType{0xff}}
+	var buf bytes.Buffer
+	err := engine.EncodeState(&buf, cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = block.EncodeBlock(&buf, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = block.EncodeReceipts(&buf, []*block.Receipt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	_, b2, rbuf, err := decodeBlockData(engine, data)
+	if err != nil || b2.Header.Hash != b.Header.Hash || rbuf.Len() == 0 {
+		t.Fatalf("failed to decode block data: %v", err)
+	}
+	pruned, err := pruneBlockData(engine, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) >= len(data) {
+		t.Fatal("nothing pruned")
+	}
+	cs2, b2, _, err := decodeBlockData(engine, pruned)
+	if err != errBodyPruned || b2.Header != b.Header || cs2.Height != cs.Height {
+		t.Fatalf("wrong pruned block data: %v", err)
+	}
+	pruned2, err := pruneBlockData(engine, pruned)
+	if err != nil || !bytes.Equal(pruned, pruned2) {
+		t.Fatal("pruning should be idempotent")
+	}
+}
+
+func TestBlockCandidateNonceOrder(t *testing.T) {
+	// port -1 doesn't listen
+	cn := startTestNode(t, -2, 1)
+	go cn.Run()
+	defer cn.Stop()
+	pub, priv := testKeyPair(0)
+	gas := block.GasSyscallBase[block.SYSCALL_TRANSFER]
+	// the later nonce pays more, but it can't go first
+	for i, price := range []uint64{1, 10, 5} {
+		tx := &block.Transaction{
+			TxType:       1,
+			SenderPubkey: pub,
+			Receiver:     block.AddressType{1},
+			Value:        1,
+			GasLimit:     gas,
+			Fee:          gas * price,
+			Nonce:        uint64(i),
+			Data:         []byte{},
+		}
+		tx.SignWithChainId(priv, 8888)
+		err := cn.SubmitTx(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := cn.GetBlockCandidate(block.AddressType{2})
+	if len(b.Txs) != 3 {
+		t.Fatalf("%d txs in the candidate", len(b.Txs))
+	}
+	for i, tx := range b.Txs {
+		if tx.Nonce != uint64(i) {
+			t.Fatal("wrong nonce order")
+		}
+	}
+	if cn.SuggestGasPrice() != 0 {
+		t.Fatal("no min gas price")
+	}
+	cn.config.MinGasPrice = 3
+	if cn.SuggestGasPrice() != 3 {
+		t.Fatal("min gas price not suggested")
+	}
+
+	// txs below the min price are neither accepted nor mined
+	tx := &block.Transaction{
+		TxType:       3,
+		SenderPubkey: pub,
+		GasLimit:     block.GasVmTxRawCode,
+		GasPrice:     2,
+		Nonce:        3,
+		Data:         []byte{},
+	}
+	tx.SignWithChainId(priv, 8888)
+	if cn.SubmitTx(tx) == nil {
+		t.Fatal("tx below the min gas price accepted")
+	}
+	hs := tx.Hash()
+	cn.txPool.Add(string(hs[:]), tx, cache.DefaultExpiration)
+	b = cn.GetBlockCandidate(block.AddressType{2})
+	if len(b.Txs) != 3 {
+		t.Fatal("tx below the min gas price mined")
+	}
+	tx.GasPrice = 3
+	tx.SignWithChainId(priv, 8888)
+	err := cn.SubmitTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = cn.GetBlockCandidate(block.AddressType{2})
+	if len(b.Txs) != 4 {
+		t.Fatal("tx at the min gas price not mined")
+	}
+}
+
+func TestPoAProducer(t *testing.T) {
+	pub, priv := testKeyPair(0)
+	config := ChainNodeConfig{
+		StorageFinalizeDepth: 20,
+		StorageDumpDiskRatio: 0.8,
+		ListenPort:           -1,
+		Miner:                &MinerConfig{SignerKey: hex.EncodeToString(priv[:ed25519.SeedSize])},
+	}
+	gConfig := ChainGlobalConfig{
+		ChainId:      8888,
+		GenesisBlock: testInitBlock(),
+		GenesisConsensusState: &consensus.ConsensusState{
+			Height:     -1,
+			Difficulty: block.HashType{0xff},
+		},
+		BlockReward: 1000000000,
+		Consensus:   "poa",
+		PoASigners:  []block.PubkeyType{pub},
+		PoAPeriod:   uint64(time.Second / 2),
+	}
+	cn, err := NewChainNode(config, gConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cn.Run()
+	defer cn.Stop()
+	time.Sleep(time.Second * 3)
+	b, cs, err := cn.GetHighest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Height < 3 {
+		t.Fatalf("only %d blocks produced", cs.Height)
+	}
+	if block.PubkeyType(b.Header.ExtraData) != pub || b.Miner != block.PubkeyToAddress(pub) {
+		t.Fatal("block not sealed by the signer")
+	}
+
+	other, _ := testKeyPair(1)
+	gConfig.PoASigners = []block.PubkeyType{other}
+	_, err = NewChainNode(config, gConfig, nil)
+	if err == nil {
+		t.Fatal("node started with a key of no signer")
+	}
+}
+
+func TestMigrateLegacyStates(t *testing.T) {
+	config := ChainNodeConfig{
+		StoragePath:          "/tmp/tcoin_test/core_migrate",
+		StorageFinalizeDepth: 5,
+		StorageDumpDiskRatio: 0.8,
+		ListenPort:           -1,
+	}
+	err := os.RemoveAll(config.StoragePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 20
+	cn, err := NewChainNode(config, testGlobalConfig(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cn.Run()
+	for _, b := range genTestBlocks(n, 1) {
+		err := cn.SubmitBlock(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var fresh *consensus.ConsensusState
+	for i := 0; i < 100; i++ {
+		time.Sleep(time.Millisecond * 100)
+		_, fresh, err = cn.GetHighest()
+		if err == nil && fresh.Height == n {
+			break
+		}
+	}
+	if fresh == nil || fresh.Height != n {
+		t.Fatal("blocks not accepted")
+	}
+	err = cn.se.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.Stop()
+	cn.se.Stop()
+
+	// store everything as an older version would
+	legacy := func(data []byte) []byte {
+		r := bytes.NewReader(data)
+		cs, err := consensus.DecodeConsensus(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 8*3+block.HashLen)
+		binary.LittleEndian.PutUint64(buf[:8], uint64(cs.Height))
+		binary.LittleEndian.PutUint64(buf[8:16], cs.LastBlockTime)
+		binary.LittleEndian.PutUint64(buf[16:24], cs.LastKeyBlockTime)
+		copy(buf[24:], cs.Difficulty[:])
+		return append(buf, data[len(data)-r.Len():]...)
+	}
+	backend, err := storage.NewFileBackend(config.StoragePath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := backend.StateHeight()
+	keys := []storage.SliceKeyType{}
+	data := [][]byte{}
+	for i := 0; i <= h; i++ {
+		k, err := backend.ReadKey(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := backend.ReadData(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+		data = append(data, legacy(d))
+	}
+	err = backend.WriteData(0, keys, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := backend.ReadLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.ClearLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range ls {
+		l.Data = legacy(l.Data)
+		err = backend.AppendLog(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts, err := backend.LoadTemps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h <= 0 || len(ts) == 0 {
+		t.Fatalf("nothing to migrate at root %d with %d temp slices", h, len(ts))
+	}
+	for _, ts := range ts {
+		ts.Data = legacy(ts.Data)
+		err = backend.StoreTemp(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend.Close()
+
+	cn, err = NewChainNode(config, testGlobalConfig(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cn.Run()
+	defer cn.se.Stop()
+	defer cn.Stop()
+	_, cs, err := cn.GetHighest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Height != n || cs.TotalWork != fresh.TotalWork || !reflect.DeepEqual(cs.RecentTimes, fresh.RecentTimes) {
+		t.Fatalf("migrated state %v differs from %v", cs, fresh)
+	}
+	root := cn.se.Head().Chain[0]
+	d, err := cn.se.ReadData(root.S.Height(), root.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consensus.LegacyEncoded(d) {
+		t.Fatal("stored root not migrated")
+	}
+}
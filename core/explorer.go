@@ -68,13 +68,6 @@ func explorerTransferCallback(s *storage.Slice, from block.AddressType, to block
 		explorerListAddAddr(s, to, 103, storage.DataType(txh))
 		explorerListAddAddr(s, to, 104, v)
 	}
-	if tx != nil {
-		k := storage.KeyType{0xf1}
-		copy(k[1:1+block.HashLen], txh[:])
-		v2 := storage.DataType{}
-		binary.LittleEndian.PutUint64(v2[:8], uint64(ctx.Height)+1)
-		s.Write(k, v2)
-	}
 }
 
 func explorerBlockCallback(s *storage.Slice, b *block.Block, ctx *block.ExecutionContext) {
@@ -103,13 +96,11 @@ type ExplorerTransaction struct {
 }
 
 func (cn *ChainNode) ExplorerGetAccountTransactions(addr block.AddressType, l int, r int) ([]ExplorerTransaction, int) {
-	cn.seMut.Lock()
-	s := cn.se.HighestSlice
+	s := cn.se.Head().Slice
 	froms, n := explorerReadListAddr(s, addr, 101, l, r)
 	tos, _ := explorerReadListAddr(s, addr, 102, l, r)
 	txh, _ := explorerReadListAddr(s, addr, 103, l, r)
 	vs, _ := explorerReadListAddr(s, addr, 104, l, r)
-	cn.seMut.Unlock()
 	res := make([]ExplorerTransaction, len(froms))
 	for i := 0; i < len(froms); i++ {
 		res[i].From = address.EncodeAddr(block.AddressType(froms[i]))
@@ -123,14 +114,9 @@ func (cn *ChainNode) ExplorerGetAccountTransactions(addr block.AddressType, l in
 }
 
 func (cn *ChainNode) ExplorerGetTransaction(txh block.HashType) (*block.Transaction, int, error) {
-	cn.seMut.Lock()
-	s := cn.se.HighestSlice
-	k := storage.KeyType{0xf1}
-	copy(k[1:1+block.HashLen], txh[:])
-	v := s.Read(k)
-	hc := cn.se.HighestChain
-	cn.seMut.Unlock()
-	height := int(binary.LittleEndian.Uint64(v[:8])) - 1
+	head := cn.se.Head()
+	hc := head.Chain
+	height, _ := readTxIndex(head.Slice, txh)
 	if height < 0 {
 		return nil, 0, errors.New("transaction not found")
 	}
@@ -152,13 +138,11 @@ func (cn *ChainNode) ExplorerGetTransaction(txh block.HashType) (*block.Transact
 }
 
 func (cn *ChainNode) ExplorerGetBlockByHash(hash block.HashType) (*block.Block, *consensus.ConsensusState, error) {
-	cn.seMut.Lock()
-	s := cn.se.HighestSlice
+	s := cn.se.Head().Slice
 	k := storage.KeyType{0xf1}
 	copy(k[1:1+block.HashLen], hash[:])
 	k[1+block.HashLen] = 1
 	v := s.Read(k)
-	cn.seMut.Unlock()
 	height := int(binary.LittleEndian.Uint64(v[:8])) - 1
 	if height < 0 {
 		return nil, nil, errors.New("block not found")
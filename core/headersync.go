@@ -0,0 +1,468 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mcfx/tcoin/core/block"
+	"github.com/mcfx/tcoin/core/consensus"
+	cnet "github.com/mcfx/tcoin/core/network"
+	"github.com/mcfx/tcoin/network"
+	"github.com/mcfx/tcoin/storage"
+)
+
+// Headers-first sync: when a neighbor with more work is far ahead, the headers
+// of its highest chain are fetched from it and checked first, then the bodies
+// are downloaded in windows from all the neighbors having them, and resolved
+// like other blocks.
+const headerSyncMinLead = 64
+const bodyWindowSize = 32
+const maxBodyWindows = 8
+const headerSyncTimeout = time.Second * 20
+
+// the sync is dropped if no body is added for this long
+const headerSyncStallTimeout = time.Minute
+
+type bodyWindow struct {
+	peer int
+	sent time.Time
+}
+
+type headerSync struct {
+	mut sync.Mutex
+	// the neighbor the headers are fetched from, -1 if not syncing
+	peer   int
+	target int
+	// when the pending header request was sent
+	requested time.Time
+	// the peer has no more headers
+	complete bool
+	// height of the first header, the headers below synced are dropped
+	base    int
+	parent  block.HashType
+	headers []block.BlockHeader
+	// the highest height whose block is added, and when it last advanced
+	synced      int
+	progress    time.Time
+	windows     map[int]*bodyWindow
+	startTime   time.Time
+	startHeight int
+}
+
+func newHeaderSync() *headerSync {
+	return &headerSync{peer: -1}
+}
+
+func (hs *headerSync) top() int {
+	return hs.base + len(hs.headers) - 1
+}
+
+func (hs *headerSync) hashAt(h int) block.HashType {
+	if h == hs.base-1 {
+		return hs.parent
+	}
+	return hs.headers[h-hs.base].Hash
+}
+
+func (cn *ChainNode) headerSyncing() bool {
+	hs := cn.hsync
+	hs.mut.Lock()
+	defer hs.mut.Unlock()
+	return hs.peer != -1
+}
+
+// whether the block is one of the headers whose bodies are being downloaded
+func (cn *ChainNode) headerSyncHas(k block.HashType) bool {
+	hs := cn.hsync
+	hs.mut.Lock()
+	defer hs.mut.Unlock()
+	if hs.peer == -1 {
+		return false
+	}
+	for h := hs.synced + 1; h <= hs.top() && h <= hs.synced+maxBodyWindows*bodyWindowSize; h++ {
+		if hs.hashAt(h) == k {
+			return true
+		}
+	}
+	return false
+}
+
+// stop the sync if the block is one of its headers, as the chain can't be
+// synced past an invalid block, returns whether it was
+func (cn *ChainNode) headerSyncFailed(k block.HashType) bool {
+	hs := cn.hsync
+	hs.mut.Lock()
+	defer hs.mut.Unlock()
+	if hs.peer == -1 {
+		return false
+	}
+	for h := hs.synced + 1; h <= hs.top(); h++ {
+		if hs.hashAt(h) == k {
+			log.Printf("header sync stopped: invalid block at height %d", h)
+			hs.peer = -1
+			return true
+		}
+	}
+	return false
+}
+
+func (cn *ChainNode) startHeaderSync(peerId, target int, hc []storage.SliceChain) {
+	hs := cn.hsync
+	hs.mut.Lock()
+	defer hs.mut.Unlock()
+	if hs.peer != -1 {
+		return
+	}
+	hs.peer = peerId
+	hs.target = target
+	hs.requested = time.Time{}
+	hs.complete = false
+	hs.base = hc[0].S.Height() + 1
+	hs.parent = block.HashType(hc[0].Key)
+	hs.headers = nil
+	hs.synced = hs.base - 1
+	hs.progress = time.Now()
+	hs.windows = make(map[int]*bodyWindow)
+	hs.startTime = time.Now()
+	hs.startHeight = hc[len(hc)-1].S.Height()
+	log.Printf("header sync from height %d to %d", hs.startHeight, target)
+	cn.advanceHeaderSync()
+}
+
+func (cn *ChainNode) stepHeaderSync() {
+	hs := cn.hsync
+	hs.mut.Lock()
+	defer hs.mut.Unlock()
+	cn.advanceHeaderSync()
+}
+
+// must be called with hsync.mut held
+func (cn *ChainNode) advanceHeaderSync() {
+	hs := cn.hsync
+	if hs.peer == -1 {
+		return
+	}
+	now := time.Now()
+	if !hs.requested.IsZero() && now.Sub(hs.requested) > headerSyncTimeout {
+		log.Printf("header sync timed out at height %d", hs.synced)
+		hs.peer = -1
+		return
+	}
+	if _, ok := cn.nc.PeerHello(hs.peer); !ok {
+		log.Printf("header sync stopped: peer disconnected")
+		hs.peer = -1
+		return
+	}
+	root := cn.se.Head().Chain[0].S.Height()
+	for hs.synced < hs.top() {
+		h := hs.synced + 1
+		if h > root {
+			if _, ok := cn.se.GetSlice(storage.SliceKeyType(hs.hashAt(h))); !ok {
+				break
+			}
+		}
+		hs.synced = h
+		hs.progress = now
+	}
+	// a body may be withheld by all the neighbors
+	if now.Sub(hs.progress) > headerSyncStallTimeout {
+		log.Printf("header sync stalled at height %d", hs.synced)
+		hs.peer = -1
+		return
+	}
+	if cut := hs.synced - hs.base; cut > cnet.MaxHeaderCount {
+		hs.parent = hs.headers[cut-1].Hash
+		hs.headers = append([]block.BlockHeader(nil), hs.headers[cut:]...)
+		hs.base += cut
+	}
+	if hs.complete && hs.synced >= hs.top() {
+		log.Printf("header sync done at height %d", hs.synced)
+		hs.peer = -1
+		return
+	}
+	if hs.requested.IsZero() && !hs.complete && hs.top()-hs.synced < cnet.MaxHeaderCount {
+		var buf bytes.Buffer
+		buf.WriteByte(cnet.PktHeaderRequest)
+		cnet.EncodeHeaderRequest(&buf, cnet.PacketHeaderRequest{
+			MinId: hs.top() + 1,
+			Count: cnet.MaxHeaderCount,
+		})
+		cn.writeTo(hs.peer, buf.Bytes())
+		hs.requested = now
+	}
+	cn.requestBodies(now)
+}
+
+// the neighbors which may send bodies, and their heights
+func (cn *ChainNode) bodyPeers() ([]int, map[int]int) {
+	nh := cn.neighborState.Items()
+	ids := make([]int, 0, len(nh))
+	heights := make(map[int]int)
+	for k, v := range nh {
+		id := int(binary.LittleEndian.Uint64([]byte(k)))
+		if cn.nc.HasCaps(id, cnet.CapHeaders) {
+			ids = append(ids, id)
+			heights[id] = v.Object.(neighborState).Height
+		}
+	}
+	rand.Shuffle(len(ids), func(i, j int) {
+		ids[i], ids[j] = ids[j], ids[i]
+	})
+	return ids, heights
+}
+
+// must be called with hsync.mut held
+func (cn *ChainNode) requestBodies(now time.Time) {
+	hs := cn.hsync
+	for s := range hs.windows {
+		if s+bodyWindowSize-1 <= hs.synced {
+			delete(hs.windows, s)
+		}
+	}
+	ids, heights := cn.bodyPeers()
+	load := make(map[int]int)
+	for _, w := range hs.windows {
+		if now.Sub(w.sent) < headerSyncTimeout {
+			load[w.peer]++
+		}
+	}
+	maxH := hs.top()
+	if maxH > hs.synced+maxBodyWindows*bodyWindowSize {
+		maxH = hs.synced + maxBodyWindows*bodyWindowSize
+	}
+	for s := (hs.synced + 1) / bodyWindowSize * bodyWindowSize; s <= maxH; s += bodyWindowSize {
+		lo := s
+		if lo <= hs.synced {
+			lo = hs.synced + 1
+		}
+		hi := s + bodyWindowSize - 1
+		if hi > hs.top() {
+			hi = hs.top()
+		}
+		w, ok := hs.windows[s]
+		if ok && now.Sub(w.sent) < headerSyncTimeout {
+			continue
+		}
+		p := cnet.PacketBodyRequest{MinId: lo}
+		for h := lo; h <= hi; h++ {
+			k := hs.hashAt(h)
+			if _, ok := cn.blockCache.Get(string(k[:])); !ok {
+				p.Hashes = append(p.Hashes, k)
+			} else if len(p.Hashes) == 0 {
+				p.MinId = h + 1
+			} else {
+				// keep the hashes consecutive
+				p.Hashes = append(p.Hashes, k)
+			}
+		}
+		if len(p.Hashes) == 0 {
+			continue
+		}
+		// the least loaded neighbor having the start of the window, which may
+		// send a part of it, and another one if the window timed out
+		id := -1
+		for _, t := range ids {
+			if (t != hs.peer && heights[t] < lo) || (ok && t == w.peer && len(ids) > 1) {
+				continue
+			}
+			if id == -1 || load[t] < load[id] {
+				id = t
+			}
+		}
+		if id == -1 {
+			continue
+		}
+		var buf bytes.Buffer
+		buf.WriteByte(cnet.PktBodyRequest)
+		cnet.EncodeBodyRequest(&buf, p)
+		cn.writeTo(id, buf.Bytes())
+		hs.windows[s] = &bodyWindow{peer: id, sent: now}
+		load[id]++
+	}
+}
+
+// the state after the last header, built from the state of the highest added
+// block, so the bound of the difficulty doesn't get too loose
+//
+// must be called with hsync.mut held
+func (cn *ChainNode) headerState() (*consensus.ConsensusState, error) {
+	hs := cn.hsync
+	cs, err := cn.getConsensusState(hs.synced, hs.hashAt(hs.synced))
+	if err != nil {
+		return nil, err
+	}
+	cs = cs.Copy()
+	for h := hs.synced + 1; h <= hs.top(); h++ {
+		err = cn.engine.UpdateHeader(cs, &hs.headers[h-hs.base])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+func (cn *ChainNode) handleHeaders(p cnet.PacketHeaders, peerId int, from network.PeerKey) error {
+	hs := cn.hsync
+	hs.mut.Lock()
+	defer hs.mut.Unlock()
+	if peerId != hs.peer || hs.requested.IsZero() || p.MinId != hs.top()+1 {
+		return nil
+	}
+	hs.requested = time.Time{}
+	if len(p.Headers) < cnet.MaxHeaderCount {
+		hs.complete = true
+	}
+	if len(p.Headers) == 0 {
+		cn.advanceHeaderSync()
+		return nil
+	}
+	// the peer may have switched to another chain
+	if p.Headers[0].ParentHash != hs.hashAt(hs.top()) {
+		log.Printf("header sync stopped: chain of the peer changed")
+		hs.peer = -1
+		return nil
+	}
+	cs, err := cn.headerState()
+	if err != nil {
+		cn.nc.ReportPeer(from, network.EventInvalidBlock)
+		hs.peer = -1
+		return nil
+	}
+	for i := range p.Headers {
+		bh := &p.Headers[i]
+		if (i > 0 && bh.ParentHash != p.Headers[i-1].Hash) || cn.engine.UpdateHeader(cs, bh) != nil {
+			cn.nc.ReportPeer(from, network.EventInvalidBlock)
+			hs.peer = -1
+			return nil
+		}
+	}
+	hs.headers = append(hs.headers, p.Headers...)
+	if hs.top() > hs.target {
+		hs.target = hs.top()
+	}
+	cn.advanceHeaderSync()
+	return nil
+}
+
+// the header of the block, without loading the body into the cache
+func (cn *ChainNode) getHeader(height int, hash block.HashType) (block.BlockHeader, error) {
+	t, ok := cn.blockCache.Get(string(hash[:]))
+	if ok {
+		return t.(*block.Block).Header, nil
+	}
+	d, err := cn.se.ReadData(height, storage.SliceKeyType(hash))
+	if err != nil {
+		return block.BlockHeader{}, err
+	}
+	_, b, _, err := decodeBlockData(cn.engine, d)
+	if err != nil && err != errBodyPruned {
+		return block.BlockHeader{}, err
+	}
+	if hash != (block.HashType{}) && b.Header.Hash != hash {
+		return block.BlockHeader{}, errors.New("block hash mismatch, possibly wrong height")
+	}
+	return b.Header, nil
+}
+
+func (cn *ChainNode) handleHeaderRequest(p cnet.PacketHeaderRequest, peerId int) error {
+	hc := cn.se.Head().Chain
+	mh := hc[0].S.Height()
+	rp := cnet.PacketHeaders{MinId: p.MinId}
+	for h := p.MinId; h < p.MinId+p.Count && h-mh < len(hc); h++ {
+		hash := block.HashType{}
+		if h >= mh {
+			hash = block.HashType(hc[h-mh].Key)
+		}
+		bh, err := cn.getHeader(h, hash)
+		if err != nil {
+			break
+		}
+		rp.Headers = append(rp.Headers, bh)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(cnet.PktHeaders)
+	err := cnet.EncodeHeaders(&buf, rp)
+	if err != nil {
+		return err
+	}
+	cn.writeTo(peerId, buf.Bytes())
+	return nil
+}
+
+func (cn *ChainNode) handleBodyRequest(p cnet.PacketBodyRequest, peerId int) error {
+	rp := cnet.NewPacketBlocks(p.MinId)
+	for i, h := range p.Hashes {
+		b, err := cn.getBlock(p.MinId+i, h)
+		if err == errBodyPruned {
+			rp.Add(b.Header, false)
+			continue
+		}
+		if err != nil {
+			break
+		}
+		rp.Add(b, true)
+	}
+	if len(rp.Body) == 0 {
+		return nil
+	}
+	rp.TotalWork = cn.highestWork(cn.se.Head().Chain)
+	var buf bytes.Buffer
+	buf.WriteByte(cnet.PktBlocks)
+	err := cnet.EncodeBlocks(&buf, rp)
+	if err != nil {
+		return err
+	}
+	cn.writeTo(peerId, buf.Bytes())
+	return nil
+}
+
+type SyncStatus struct {
+	Syncing      bool `json:"syncing"`
+	Height       int  `json:"height"`
+	HeaderHeight int  `json:"header_height"`
+	TargetHeight int  `json:"target_height"`
+	// fraction of the blocks added since the sync started
+	Progress float64 `json:"progress"`
+	// estimated seconds left, -1 if unknown
+	Eta int64 `json:"eta"`
+}
+
+func (cn *ChainNode) GetSyncStatus() SyncStatus {
+	hc := cn.se.Head().Chain
+	mh := hc[len(hc)-1].S.Height()
+	hs := cn.hsync
+	hs.mut.Lock()
+	defer hs.mut.Unlock()
+	if hs.peer == -1 {
+		return SyncStatus{
+			Height:       mh,
+			HeaderHeight: mh,
+			TargetHeight: mh,
+			Progress:     1,
+		}
+	}
+	res := SyncStatus{
+		Syncing:      true,
+		Height:       mh,
+		HeaderHeight: hs.top(),
+		TargetHeight: hs.target,
+		Eta:          -1,
+	}
+	done := hs.synced - hs.startHeight
+	if done < 0 {
+		done = 0
+	}
+	if hs.target > hs.startHeight {
+		res.Progress = float64(done) / float64(hs.target-hs.startHeight)
+	}
+	if done > 0 && hs.target >= hs.synced {
+		t := time.Since(hs.startTime) * time.Duration(hs.target-hs.synced) / time.Duration(done)
+		res.Eta = int64(t / time.Second)
+	}
+	return res
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/mcfx/tcoin/core/consensus"
+	"github.com/mcfx/tcoin/storage"
+)
+
+// Consensus states stored by older versions have no total work and recent
+// times, so the work of a node would count from its stored root and its
+// median time past would miss blocks. The stored root is migrated once on
+// start from the states of all heights below it, and the slices above it are
+// migrated by the storage engine from their parents when loaded.
+
+// the block data with its consensus state migrated on top of the parent data
+func migrateBlockData(engine consensus.Engine, parent, data []byte) []byte {
+	if !consensus.LegacyEncoded(data) {
+		return data
+	}
+	pcs, err := engine.DecodeState(bytes.NewReader(parent))
+	if err != nil {
+		return data
+	}
+	r := bytes.NewReader(data)
+	cs, err := engine.DecodeState(r)
+	if err != nil {
+		return data
+	}
+	cs.Migrate(pcs)
+	var buf bytes.Buffer
+	err = engine.EncodeState(&buf, cs)
+	if err != nil {
+		return data
+	}
+	buf.Write(data[len(data)-r.Len():])
+	return buf.Bytes()
+}
+
+// migrate the data of the stored root if it's legacy, the genesis data is the
+// one built on start
+func migrateStoredRoot(backend storage.Backend, engine consensus.Engine, genesisData []byte) error {
+	h := backend.StateHeight()
+	if h == -1 {
+		return nil
+	}
+	d, err := backend.ReadData(h)
+	if err != nil {
+		return err
+	}
+	if !consensus.LegacyEncoded(d) {
+		return nil
+	}
+	log.Printf("migrating the consensus state at height %d", h)
+	d = genesisData
+	for i := 1; i <= h; i++ {
+		cur, err := backend.ReadData(i)
+		if err != nil {
+			return fmt.Errorf("failed to read data at height %d: %v", i, err)
+		}
+		d = migrateBlockData(engine, d, cur)
+	}
+	k, err := backend.ReadKey(h)
+	if err != nil {
+		return err
+	}
+	return backend.WriteData(h, []storage.SliceKeyType{k}, [][]byte{d})
+}
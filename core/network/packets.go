@@ -13,6 +13,36 @@ import (
 const PktBlockRequest = 1
 const PktBlocks = 2
 const PktTransactions = 3
+const PktHeaderRequest = 4
+const PktHeaders = 5
+const PktBodyRequest = 6
+const PktTxAnnounce = 7
+const PktTxRequest = 8
+
+// capabilities advertised in the peer handshake, a packet is only sent to the
+// peers with its capability
+const CapBlocks = 1 << 0
+const CapTransactions = 1 << 1
+const CapHeaders = 1 << 2
+const CapTxAnnounce = 1 << 3
+
+// the capabilities of this version
+const Capabilities = CapBlocks | CapTransactions | CapHeaders | CapTxAnnounce
+
+var packetCaps = map[byte]uint64{
+	PktBlockRequest:  CapBlocks,
+	PktBlocks:        CapBlocks,
+	PktTransactions:  CapTransactions,
+	PktHeaderRequest: CapHeaders,
+	PktHeaders:       CapHeaders,
+	PktBodyRequest:   CapHeaders,
+	PktTxAnnounce:    CapTxAnnounce,
+	PktTxRequest:     CapTxAnnounce,
+}
+
+func PacketCapability(opcode byte) uint64 {
+	return packetCaps[opcode]
+}
 
 type PacketBlockRequest struct {
 	MinId int
@@ -23,12 +53,42 @@ type PacketBlocks struct {
 	MinId  int
 	isFull []byte
 	Body   []interface{}
+	// total work of the sender's highest chain, zero if sent by older nodes
+	TotalWork block.HashType
 }
 
 type PacketTransactions struct {
 	Txs []*block.Transaction
 }
 
+const MaxHeaderCount = 2000
+const MaxBodyCount = 100
+
+const MaxTxHashCount = 1000
+
+// hashes of new txs in PktTxAnnounce, or of the txs wanted in PktTxRequest,
+// which are sent back as PktTransactions
+type PacketTxHashes struct {
+	Hashes []block.HashType
+}
+
+// headers of the highest chain of the receiver from MinId
+type PacketHeaderRequest struct {
+	MinId int
+	Count int
+}
+
+type PacketHeaders struct {
+	MinId   int
+	Headers []block.BlockHeader
+}
+
+// blocks of the hashes from MinId, which are sent back as PktBlocks
+type PacketBodyRequest struct {
+	MinId  int
+	Hashes []block.HashType
+}
+
 func DecodeBlockRequest(r *bytes.Buffer) (PacketBlockRequest, error) {
 	p := PacketBlockRequest{}
 	t, err := binary.ReadUvarint(r)
@@ -110,6 +170,12 @@ func DecodeBlocks(r *bytes.Buffer) (PacketBlocks, error) {
 		}
 		p.Body = append(p.Body, blk)
 	}
+	if r.Len() >= block.HashLen {
+		_, err = io.ReadFull(r, p.TotalWork[:])
+		if err != nil {
+			return PacketBlocks{}, err
+		}
+	}
 	return p, nil
 }
 
@@ -135,6 +201,10 @@ func EncodeBlocks(w *bytes.Buffer, p PacketBlocks) error {
 			return err
 		}
 	}
+	_, err = w.Write(p.TotalWork[:])
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -161,3 +231,131 @@ func EncodeTransactions(w *bytes.Buffer, p PacketTransactions) error {
 	}
 	return nil
 }
+
+func DecodeHeaderRequest(r *bytes.Buffer) (PacketHeaderRequest, error) {
+	p := PacketHeaderRequest{}
+	t, err := binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	p.MinId = int(t)
+	t, err = binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	if t > MaxHeaderCount {
+		return p, errors.New("too many headers")
+	}
+	p.Count = int(t)
+	return p, nil
+}
+
+func EncodeHeaderRequest(w *bytes.Buffer, p PacketHeaderRequest) error {
+	buf := make([]byte, binary.MaxVarintLen64*2)
+	cur := binary.PutUvarint(buf, uint64(p.MinId))
+	cur = binary.PutUvarint(buf[cur:], uint64(p.Count)) + cur
+	w.Write(buf[:cur])
+	return nil
+}
+
+func DecodeHeaders(r *bytes.Buffer) (PacketHeaders, error) {
+	p := PacketHeaders{}
+	t, err := binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	p.MinId = int(t)
+	t, err = binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	if t > MaxHeaderCount {
+		return p, errors.New("too many headers")
+	}
+	p.Headers = make([]block.BlockHeader, t)
+	for i := range p.Headers {
+		p.Headers[i], err = block.DecodeBlockHeader(r)
+		if err != nil {
+			return PacketHeaders{}, err
+		}
+	}
+	return p, nil
+}
+
+func EncodeHeaders(w *bytes.Buffer, p PacketHeaders) error {
+	buf := make([]byte, binary.MaxVarintLen64*2)
+	cur := binary.PutUvarint(buf, uint64(p.MinId))
+	cur = binary.PutUvarint(buf[cur:], uint64(len(p.Headers))) + cur
+	w.Write(buf[:cur])
+	for _, bh := range p.Headers {
+		err := block.EncodeBlockHeader(w, bh)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DecodeBodyRequest(r *bytes.Buffer) (PacketBodyRequest, error) {
+	p := PacketBodyRequest{}
+	t, err := binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	p.MinId = int(t)
+	t, err = binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	if t > MaxBodyCount {
+		return p, errors.New("too many bodies")
+	}
+	p.Hashes = make([]block.HashType, t)
+	for i := range p.Hashes {
+		_, err = io.ReadFull(r, p.Hashes[i][:])
+		if err != nil {
+			return PacketBodyRequest{}, err
+		}
+	}
+	return p, nil
+}
+
+func EncodeBodyRequest(w *bytes.Buffer, p PacketBodyRequest) error {
+	buf := make([]byte, binary.MaxVarintLen64*2)
+	cur := binary.PutUvarint(buf, uint64(p.MinId))
+	cur = binary.PutUvarint(buf[cur:], uint64(len(p.Hashes))) + cur
+	w.Write(buf[:cur])
+	for _, h := range p.Hashes {
+		w.Write(h[:])
+	}
+	return nil
+}
+
+func DecodeTxHashes(r *bytes.Buffer) (PacketTxHashes, error) {
+	p := PacketTxHashes{}
+	t, err := binary.ReadUvarint(r)
+	if err != nil {
+		return p, err
+	}
+	if t > MaxTxHashCount {
+		return p, errors.New("too many tx hashes")
+	}
+	p.Hashes = make([]block.HashType, t)
+	for i := range p.Hashes {
+		_, err = io.ReadFull(r, p.Hashes[i][:])
+		if err != nil {
+			return PacketTxHashes{}, err
+		}
+	}
+	return p, nil
+}
+
+func EncodeTxHashes(w *bytes.Buffer, p PacketTxHashes) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(len(p.Hashes)))
+	w.Write(buf[:n])
+	for _, h := range p.Hashes {
+		w.Write(h[:])
+	}
+	return nil
+}
@@ -49,6 +49,7 @@ func TestSerializationBlocks(t *testing.T) {
 			p.Add(blk.Header, false)
 		}
 	}
+	rnd.Read(p.TotalWork[:])
 	var b bytes.Buffer
 	err := EncodeBlocks(&b, p)
 	if err != nil {
@@ -95,3 +96,109 @@ func TestSerializationTransactions(t *testing.T) {
 		t.Fatal("not equal")
 	}
 }
+
+func TestSerializationHeaders(t *testing.T) {
+	rnd := rand.New(rand.NewSource(114514))
+	p := PacketHeaders{
+		MinId: rnd.Intn(1919810),
+	}
+	for i := 0; i < 75; i++ {
+		bh := block.BlockHeader{}
+		rnd.Read(bh.ParentHash[:])
+		rnd.Read(bh.BodyHash[:])
+		if i%2 == 1 {
+			rnd.Read(bh.StateRoot[:])
+		}
+		bh.Hash = bh.ComputeHash()
+		p.Headers = append(p.Headers, bh)
+	}
+	var b bytes.Buffer
+	err := EncodeHeaders(&b, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := DecodeHeaders(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, p2) {
+		t.Fatal("not equal")
+	}
+
+	r := PacketHeaderRequest{MinId: rnd.Intn(1919810), Count: MaxHeaderCount}
+	b.Reset()
+	EncodeHeaderRequest(&b, r)
+	r2, err := DecodeHeaderRequest(&b)
+	if err != nil || r != r2 {
+		t.Fatal("not equal")
+	}
+	r.Count++
+	b.Reset()
+	EncodeHeaderRequest(&b, r)
+	_, err = DecodeHeaderRequest(&b)
+	if err == nil {
+		t.Fatal("too many headers accepted")
+	}
+}
+
+func TestSerializationBodyRequest(t *testing.T) {
+	rnd := rand.New(rand.NewSource(114514))
+	p := PacketBodyRequest{
+		MinId: rnd.Intn(1919810),
+	}
+	for i := 0; i < MaxBodyCount; i++ {
+		h := block.HashType{}
+		rnd.Read(h[:])
+		p.Hashes = append(p.Hashes, h)
+	}
+	var b bytes.Buffer
+	err := EncodeBodyRequest(&b, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := DecodeBodyRequest(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, p2) {
+		t.Fatal("not equal")
+	}
+}
+
+func TestSerializationTxHashes(t *testing.T) {
+	rnd := rand.New(rand.NewSource(114514))
+	p := PacketTxHashes{}
+	for i := 0; i < MaxTxHashCount; i++ {
+		h := block.HashType{}
+		rnd.Read(h[:])
+		p.Hashes = append(p.Hashes, h)
+	}
+	var b bytes.Buffer
+	err := EncodeTxHashes(&b, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := DecodeTxHashes(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, p2) {
+		t.Fatal("not equal")
+	}
+	p.Hashes = append(p.Hashes, block.HashType{})
+	b.Reset()
+	EncodeTxHashes(&b, p)
+	_, err = DecodeTxHashes(&b)
+	if err == nil {
+		t.Fatal("too many tx hashes accepted")
+	}
+}
+
+func TestPacketCapability(t *testing.T) {
+	for _, op := range []byte{PktBlockRequest, PktBlocks, PktTransactions, PktHeaderRequest, PktHeaders, PktBodyRequest, PktTxAnnounce, PktTxRequest} {
+		c := PacketCapability(op)
+		if c == 0 || c&Capabilities != c {
+			t.Fatalf("packet %d has no capability", op)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mcfx/tcoin/core/block"
+	"github.com/mcfx/tcoin/core/consensus"
+)
+
+// how often a signer checks whether it may produce a block
+const producePollInterval = time.Millisecond * 100
+
+// a poa signer producing blocks in the node, pow blocks are mined outside of
+// the node by cmd/miner
+type producer struct {
+	engine  *consensus.PoA
+	pubkey  block.PubkeyType
+	privkey block.PrivkeyType
+	// the parent of the last block produced, so it's only built on once
+	parent block.HashType
+}
+
+func newProducer(mc *MinerConfig, engine consensus.Engine) (*producer, error) {
+	if mc == nil {
+		return nil, nil
+	}
+	poa, ok := engine.(*consensus.PoA)
+	if !ok {
+		return nil, errors.New("only poa signers produce blocks in the node")
+	}
+	seed, err := hex.DecodeString(mc.SignerKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid signer key")
+	}
+	p := &producer{engine: poa}
+	k := ed25519.NewKeyFromSeed(seed)
+	copy(p.privkey[:], k)
+	copy(p.pubkey[:], k[ed25519.SeedSize:])
+	for _, s := range poa.Signers {
+		if s == p.pubkey {
+			return p, nil
+		}
+	}
+	return nil, errors.New("signer key not in poa signers")
+}
+
+func (cn *ChainNode) produceLoop() {
+	defer cn.istop()
+	for {
+		slp := time.After(producePollInterval)
+		select {
+		case <-slp:
+		case <-cn.stop:
+			return
+		}
+		if cn.producer != nil {
+			cn.produce()
+		}
+	}
+}
+
+// seal and submit a block on top of the highest one, if it's the turn of the
+// signer
+func (cn *ChainNode) produce() {
+	p := cn.producer
+	hc := cn.se.Head().Chain
+	if block.HashType(hc[len(hc)-1].Key) == p.parent || !cn.CanProduce(p.pubkey) {
+		return
+	}
+	b := cn.GetBlockCandidate(block.PubkeyToAddress(p.pubkey))
+	p.engine.Seal(b, p.pubkey, p.privkey)
+	p.parent = b.Header.ParentHash
+	err := cn.SubmitBlock(b)
+	if err != nil {
+		log.Printf("failed to submit block: %v", err)
+	}
+}
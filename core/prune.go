@@ -0,0 +1,94 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/mcfx/tcoin/core/block"
+	"github.com/mcfx/tcoin/core/consensus"
+	"github.com/mcfx/tcoin/storage"
+)
+
+// the data of a pruned block only keeps the consensus state and the header
+var errBodyPruned = errors.New("block body pruned")
+
+// decode the consensus state and the block in the stored data, the rest of
+// buf is the receipts
+// if the body is pruned, the block only has the header and errBodyPruned is
+// returned
+func decodeBlockData(engine consensus.Engine, data []byte) (*consensus.ConsensusState, *block.Block, *bytes.Buffer, error) {
+	buf := bytes.NewBuffer(data)
+	cs, err := engine.DecodeState(buf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hbuf := bytes.NewBuffer(buf.Bytes())
+	bh, err := block.DecodeBlockHeader(hbuf)
+	if err == nil && hbuf.Len() == 0 {
+		return cs, &block.Block{Header: bh}, nil, errBodyPruned
+	}
+	b, err := block.DecodeBlock(buf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cs, b, buf, nil
+}
+
+func pruneBlockData(engine consensus.Engine, data []byte) ([]byte, error) {
+	cs, b, _, err := decodeBlockData(engine, data)
+	if err == errBodyPruned {
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = engine.EncodeState(&buf, cs)
+	if err != nil {
+		return nil, err
+	}
+	err = block.EncodeBlockHeader(&buf, b.Header)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compacting rewrites the data file, so on startup it waits until this many
+// more heights can be pruned
+const StoragePruneInterval = 1000
+
+// whether the storage at the path should be compacted on startup
+func pruneDue(path string, stateHeight, depth int) (bool, error) {
+	from, err := storage.CompactedHeight(path)
+	if err != nil {
+		return false, err
+	}
+	return stateHeight-depth+1-from >= StoragePruneInterval, nil
+}
+
+// drop the bodies and receipts of the blocks more than depth below the
+// finalized height in the storage at the path, which must not be in use
+func CompactStorage(path string, gConfig ChainGlobalConfig, depth int) (int64, error) {
+	if depth <= 0 {
+		return 0, errors.New("invalid prune depth")
+	}
+	engine, err := gConfig.newEngine()
+	if err != nil {
+		return 0, err
+	}
+	report, err := storage.CheckFileStorage(path, storage.CheckConfig{})
+	if err != nil {
+		return 0, err
+	}
+	if len(report.Problems) > 0 || len(report.Repairable) > 0 {
+		return 0, errors.New("storage inconsistent, run cmd/storagecheck first")
+	}
+	below := report.StateHeight - depth + 1
+	if below <= 0 {
+		return 0, nil
+	}
+	return storage.CompactFileStorage(path, below, func(key storage.SliceKeyType, data []byte) ([]byte, error) {
+		return pruneBlockData(engine, data)
+	})
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/mcfx/tcoin/core/block"
+	"github.com/mcfx/tcoin/storage"
+)
+
+// the index maps a tx hash to the height of the block (plus one) and the
+// position in the block, it's kept in the slice so it follows reorgs, and the
+// explorer reads it too
+func txIndexKey(txh block.HashType) storage.KeyType {
+	k := storage.KeyType{0xf1}
+	copy(k[1:1+block.HashLen], txh[:])
+	return k
+}
+
+func writeTxIndex(s *storage.Slice, b *block.Block) {
+	for i, tx := range b.Txs {
+		v := storage.DataType{}
+		binary.LittleEndian.PutUint64(v[:8], uint64(s.Height())+1)
+		binary.LittleEndian.PutUint64(v[8:16], uint64(i))
+		s.Write(txIndexKey(tx.Hash()), v)
+	}
+}
+
+func readTxIndex(s *storage.Slice, txh block.HashType) (int, int) {
+	v := s.Read(txIndexKey(txh))
+	return int(binary.LittleEndian.Uint64(v[:8])) - 1, int(binary.LittleEndian.Uint64(v[8:16]))
+}
+
+// read the receipts of the block at the height on the chain
+func (cn *ChainNode) getReceipts(height int, hc []storage.SliceChain) ([]*block.Receipt, error) {
+	mh := hc[len(hc)-1].S.Height()
+	hash := block.HashType{}
+	if height >= hc[0].S.Height() && height <= mh {
+		hash = block.HashType(hc[height-hc[0].S.Height()].Key)
+	}
+	d, err := cn.se.ReadData(height, storage.SliceKeyType(hash))
+	if err != nil {
+		return nil, err
+	}
+	_, _, buf, err := decodeBlockData(cn.engine, d)
+	if err != nil {
+		return nil, err
+	}
+	return block.DecodeReceipts(buf)
+}
+
+func (cn *ChainNode) GetReceipt(txh block.HashType) (*block.Receipt, int, error) {
+	head := cn.se.Head()
+	hc := head.Chain
+	height, pos := readTxIndex(head.Slice, txh)
+	if height < 0 {
+		return nil, 0, errors.New("transaction not found")
+	}
+	rs, err := cn.getReceipts(height, hc)
+	if err != nil {
+		return nil, 0, err
+	}
+	if pos < len(rs) && rs[pos].TxHash == txh {
+		return rs[pos], height, nil
+	}
+	// the explorer indexed only the heights of transfers before
+	for _, rc := range rs {
+		if rc.TxHash == txh {
+			return rc, height, nil
+		}
+	}
+	return nil, 0, errors.New("receipt not found")
+}
+
+const MaxLogsQueryRange = 1000
+
+type LogEntry struct {
+	Height int            `json:"height"`
+	TxHash block.HashType `json:"tx_hash"`
+	Log    *block.Log     `json:"log"`
+}
+
+// get the logs in blocks [from, to] of the highest chain, addr and topic are
+// optional filters, a log matches the topic if any of its topics equals it
+func (cn *ChainNode) GetLogs(addr *block.AddressType, topic *block.HashType, from, to int) ([]LogEntry, error) {
+	hc := cn.se.Head().Chain
+	mh := hc[len(hc)-1].S.Height()
+	if to > mh {
+		to = mh
+	}
+	if from < 0 || from > to {
+		return nil, errors.New("invalid height range")
+	}
+	if to-from >= MaxLogsQueryRange {
+		return nil, errors.New("height range too large")
+	}
+	res := make([]LogEntry, 0)
+	for h := from; h <= to; h++ {
+		rs, err := cn.getReceipts(h, hc)
+		if err != nil {
+			return nil, err
+		}
+		for _, rc := range rs {
+			for _, l := range rc.Logs {
+				if addr != nil && l.Address != *addr {
+					continue
+				}
+				if topic != nil {
+					found := false
+					for _, t := range l.Topics {
+						if t == *topic {
+							found = true
+						}
+					}
+					if !found {
+						continue
+					}
+				}
+				res = append(res, LogEntry{Height: h, TxHash: rc.TxHash, Log: l})
+			}
+		}
+	}
+	return res, nil
+}
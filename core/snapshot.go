@@ -0,0 +1,37 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/mcfx/tcoin/core/block"
+	"github.com/mcfx/tcoin/core/consensus"
+	"github.com/mcfx/tcoin/storage"
+)
+
+// start an empty storage from a snapshot made by cmd/snapshot, and return the
+// block at its height
+// the snapshot has to be trusted like the genesis block, as the blocks before
+// it are not checked
+func importSnapshot(backend storage.Backend, fn string, engine consensus.Engine) (*block.Block, error) {
+	var b *block.Block
+	_, err := storage.ImportSnapshot(backend, fn, func(info *storage.SnapshotInfo) error {
+		buf := bytes.NewBuffer(info.Data)
+		cs, err := engine.DecodeState(buf)
+		if err != nil {
+			return err
+		}
+		b, err = block.DecodeBlock(buf)
+		if err != nil {
+			return err
+		}
+		if b.Header.Hash != block.HashType(info.Key) || b.Header.ComputeHash() != b.Header.Hash {
+			return errors.New("block hash mismatch")
+		}
+		if cs.Height != info.Height {
+			return errors.New("consensus state height mismatch")
+		}
+		return nil
+	})
+	return b, err
+}
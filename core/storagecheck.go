@@ -0,0 +1,32 @@
+package core
+
+import (
+	"errors"
+
+	"github.com/mcfx/tcoin/core/block"
+	"github.com/mcfx/tcoin/storage"
+)
+
+// check the storage at the path, see storage.CheckFileStorage
+// the data of each record must contain the block with the hash of its key, or
+// its header if the body is pruned
+func CheckStorage(path string, gConfig ChainGlobalConfig, full, repair bool) (*storage.CheckReport, error) {
+	engine, err := gConfig.newEngine()
+	if err != nil {
+		return nil, err
+	}
+	return storage.CheckFileStorage(path, storage.CheckConfig{
+		Full:   full,
+		Repair: repair,
+		CheckData: func(key storage.SliceKeyType, data []byte) error {
+			_, b, _, err := decodeBlockData(engine, data)
+			if err != nil && err != errBodyPruned {
+				return err
+			}
+			if b.Header.Hash != block.HashType(key) || b.Header.ComputeHash() != b.Header.Hash {
+				return errors.New("block hash mismatch")
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,182 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mcfx/tcoin/core/block"
+	cnet "github.com/mcfx/tcoin/core/network"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// New txs are announced by hash to the peers which don't know them yet, and
+// the bodies are requested from the first peer announcing them, or from the
+// next one if it doesn't send them in time. Peers without the capability get
+// the bodies pushed as before.
+const txRequestTimeout = time.Second * 10
+const maxTxAnnouncers = 8
+const legacyTxPeers = 3
+
+// size of the PktTransactions sent for a request, before another one is started
+const maxTxPacketSize = 1 << 22
+
+// the peers announcing a requested tx, the first is the one requested from
+type txRequest struct {
+	mut   sync.Mutex
+	peers []int
+}
+
+func newTxRequests(cn *ChainNode) *cache.Cache {
+	c := cache.New(txRequestTimeout, time.Second*5)
+	c.OnEvicted(cn.retryTxRequest)
+	return c
+}
+
+func txKnownKey(peerId int, hash block.HashType) string {
+	tmp := make([]byte, 8, 8+block.HashLen)
+	binary.LittleEndian.PutUint64(tmp, uint64(peerId))
+	return string(append(tmp, hash[:]...))
+}
+
+// mark the tx known by the peer, and return whether it was known
+func (cn *ChainNode) markTxKnown(peerId int, hash block.HashType) bool {
+	return cn.txKnown.Add(txKnownKey(peerId, hash), true, cache.DefaultExpiration) != nil
+}
+
+func (cn *ChainNode) sendTxHashes(peerId int, opcode byte, hashes []block.HashType) {
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > cnet.MaxTxHashCount {
+			n = cnet.MaxTxHashCount
+		}
+		var buf bytes.Buffer
+		buf.WriteByte(opcode)
+		err := cnet.EncodeTxHashes(&buf, cnet.PacketTxHashes{Hashes: hashes[:n]})
+		if err != nil {
+			return
+		}
+		cn.writeTo(peerId, buf.Bytes())
+		hashes = hashes[n:]
+	}
+}
+
+// send the txs to the peer in packets of limited size
+func (cn *ChainNode) sendTxs(peerId int, txs []*block.Transaction) {
+	var buf bytes.Buffer
+	buf.WriteByte(cnet.PktTransactions)
+	for _, tx := range txs {
+		err := block.EncodeTx(&buf, tx)
+		if err != nil {
+			return
+		}
+		if buf.Len() >= maxTxPacketSize {
+			cn.writeTo(peerId, buf.Bytes())
+			buf.Reset()
+			buf.WriteByte(cnet.PktTransactions)
+		}
+	}
+	if buf.Len() > 1 {
+		cn.writeTo(peerId, buf.Bytes())
+	}
+}
+
+func (cn *ChainNode) announceTxs(txs []*block.Transaction) {
+	hashes := make([]block.HashType, len(txs))
+	for i, tx := range txs {
+		hashes[i] = tx.Hash()
+	}
+	for _, id := range cn.nc.PeerIds(cnet.CapTxAnnounce) {
+		ann := []block.HashType{}
+		for _, h := range hashes {
+			if !cn.markTxKnown(id, h) {
+				ann = append(ann, h)
+			}
+		}
+		cn.sendTxHashes(id, cnet.PktTxAnnounce, ann)
+	}
+	legacy := []int{}
+	for _, id := range cn.nc.PeerIds(cnet.CapTransactions) {
+		if !cn.nc.HasCaps(id, cnet.CapTxAnnounce) {
+			legacy = append(legacy, id)
+		}
+	}
+	rand.Shuffle(len(legacy), func(i, j int) {
+		legacy[i], legacy[j] = legacy[j], legacy[i]
+	})
+	if len(legacy) > legacyTxPeers {
+		legacy = legacy[:legacyTxPeers]
+	}
+	for _, id := range legacy {
+		push := []*block.Transaction{}
+		for i, tx := range txs {
+			if !cn.markTxKnown(id, hashes[i]) {
+				push = append(push, tx)
+			}
+		}
+		cn.sendTxs(id, push)
+	}
+}
+
+func (cn *ChainNode) handleTxAnnounce(p cnet.PacketTxHashes, peerId int) error {
+	req := []block.HashType{}
+	for _, h := range p.Hashes {
+		cn.markTxKnown(peerId, h)
+		k := string(h[:])
+		if _, ok := cn.txPool.Get(k); ok {
+			continue
+		}
+		err := cn.txRequested.Add(k, &txRequest{peers: []int{peerId}}, cache.DefaultExpiration)
+		if err != nil {
+			// requested from another peer already, this one is a fallback
+			if t, ok := cn.txRequested.Get(k); ok {
+				r := t.(*txRequest)
+				r.mut.Lock()
+				if len(r.peers) < maxTxAnnouncers {
+					r.peers = append(r.peers, peerId)
+				}
+				r.mut.Unlock()
+			}
+			continue
+		}
+		req = append(req, h)
+	}
+	cn.sendTxHashes(peerId, cnet.PktTxRequest, req)
+	return nil
+}
+
+// called when a tx request is done or timed out
+func (cn *ChainNode) retryTxRequest(k string, v interface{}) {
+	if _, ok := cn.txPool.Get(k); ok {
+		return
+	}
+	r := v.(*txRequest)
+	r.mut.Lock()
+	peers := r.peers[1:]
+	r.mut.Unlock()
+	if len(peers) == 0 {
+		return
+	}
+	if cn.txRequested.Add(k, &txRequest{peers: peers}, cache.DefaultExpiration) != nil {
+		return
+	}
+	var h block.HashType
+	copy(h[:], k)
+	cn.sendTxHashes(peers[0], cnet.PktTxRequest, []block.HashType{h})
+}
+
+func (cn *ChainNode) handleTxRequest(p cnet.PacketTxHashes, peerId int) error {
+	txs := []*block.Transaction{}
+	for _, h := range p.Hashes {
+		t, ok := cn.txPool.Get(string(h[:]))
+		if ok {
+			cn.markTxKnown(peerId, h)
+			txs = append(txs, t.(*block.Transaction))
+		}
+	}
+	cn.sendTxs(peerId, txs)
+	return nil
+}
@@ -18,8 +18,9 @@ import (
 )
 
 type ClientPacket struct {
-	PeerId int
-	Data   []byte
+	PeerId  int
+	PeerKey PeerKey
+	Data    []byte
 }
 
 type Client struct {
@@ -31,6 +32,7 @@ type Client struct {
 	cpp         chan peerPacket
 	peerInfo    map[string]time.Time
 	peerBanTime map[string]time.Time
+	scores      map[PeerKey]*PeerScore
 	allPeers    []int
 	allPeerCons []string
 	sendPeers   []byte
@@ -39,6 +41,7 @@ type Client struct {
 	peersMut    sync.Mutex
 	networkId   uint16
 	nonce       []byte
+	key         *staticKey
 }
 
 func NewClient(config *ClientConfig, ccp chan ClientPacket, networkId uint16) (*Client, error) {
@@ -50,6 +53,7 @@ func NewClient(config *ClientConfig, ccp chan ClientPacket, networkId uint16) (*
 		cpp:         make(chan peerPacket, 500),
 		peerInfo:    make(map[string]time.Time),
 		peerBanTime: make(map[string]time.Time),
+		scores:      make(map[PeerKey]*PeerScore),
 		allPeers:    []int{},
 		allPeerCons: []string{},
 		sendPeers:   []byte("{}"),
@@ -68,6 +72,18 @@ func NewClient(config *ClientConfig, ccp chan ClientPacket, networkId uint16) (*
 			return nil, fmt.Errorf("error when creating network client: %v", err)
 		}
 	}
+	c.key, err = loadStaticKey(config.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load node key: %v", err)
+	}
+	if config.Path != "" {
+		b, err := ioutil.ReadFile(filepath.Join(config.Path, "net", "scores.json"))
+		if err == nil {
+			if s, err := decodeScores(b); err == nil {
+				c.scores = s
+			}
+		}
+	}
 	if c.config.Port != -1 {
 		c.ln, err = reuseport.Listen("tcp", ":"+strconv.Itoa(c.config.Port))
 		if err != nil {
@@ -101,6 +117,9 @@ func (c *Client) Stop() {
 	for i := 0; i < 10; i++ {
 		<-c.stopped
 	}
+	if c.config.Path != "" {
+		c.saveScores()
+	}
 }
 
 func (c *Client) istop() {
@@ -126,21 +145,43 @@ func (c *Client) countPeers() int {
 	return len(c.peers)
 }
 
+func (c *Client) hello() PeerHello {
+	h := PeerHello{
+		Version:       ProtocolVersion,
+		ClientVersion: c.config.ClientVersion,
+		Capabilities:  c.config.Capabilities,
+	}
+	if c.config.Status != nil {
+		h.Height, h.Hash = c.config.Status()
+	}
+	return h
+}
+
 func (c *Client) handleConn(id int, conn net.Conn) {
 	c.peers[id] = nil
 	go func() {
-		p, err := NewPeer(id, conn, c.cpp, c.networkId, c.nonce)
+		p, err := NewPeer(id, conn, c.cpp, c.networkId, c.nonce, c.key, c.hello())
 		if err == nil {
 			rm := conn.RemoteAddr().String()
 			c.peersMut.Lock()
-			if p2, ok := c.peers[id]; !ok || p2 == nil {
+			banned := c.scores[p.key] != nil && c.scores[p.key].banned(time.Now())
+			if p2, ok := c.peers[id]; !banned && (!ok || p2 == nil) {
 				//log.Printf("conn: %s - %s", conn.LocalAddr().String(), conn.RemoteAddr().String())
 				c.peers[id] = p
 				c.peerCon[id] = rm
 			}
 			c.peersMut.Unlock()
+			if banned {
+				p.Stop()
+				c.DiscardPeer(id, time.Duration(0))
+			}
 		} else if errors.Is(err, errNetworkIdMismatch) || errors.Is(err, errSelf) {
 			c.DiscardPeer(id, time.Hour*100000)
+		} else if errors.Is(err, errProtocolVersion) {
+			c.DiscardPeer(id, time.Hour)
+		} else if connClosed(err) {
+			// a full peer closes the connections it accepts
+			c.DiscardPeer(id, time.Duration(0))
 		} else {
 			c.DiscardPeer(id, time.Minute*2)
 		}
@@ -177,11 +218,28 @@ func (c *Client) readLoop() {
 			return
 		}
 		//log.Printf("%d got packet: %d %d %s", c.config.Port, pp.id, pp.pkt.tp, pp.pkt.data)
+		ts := time.Now()
+		pktCount := 0
 		c.peersMut.Lock()
 		if si, ok := c.peerCon[pp.id]; ok {
-			c.peerInfo[si] = time.Now()
+			c.peerInfo[si] = ts
+		}
+		if p, ok := c.peers[pp.id]; ok && p != nil {
+			if ts.Sub(p.pktStart) > packetRateWindow {
+				p.pktStart = ts
+				p.pktCount = 0
+			}
+			p.pktCount++
+			pktCount = p.pktCount
 		}
 		c.peersMut.Unlock()
+		if pktCount > MaxPacketRate {
+			// reported once per window
+			if pktCount == MaxPacketRate+1 {
+				c.ReportPeer(pp.key, EventSpam)
+			}
+			continue
+		}
 		err := func() error {
 			if pp.pkt.tp == PktHeartBeat {
 			} else if pp.pkt.tp == PktFindPeer {
@@ -201,8 +259,9 @@ func (c *Client) readLoop() {
 				c.AddPeers(tmp)
 			} else if pp.pkt.tp == PktChain {
 				c.ccp <- ClientPacket{
-					PeerId: pp.id,
-					Data:   pp.pkt.data,
+					PeerId:  pp.id,
+					PeerKey: pp.key,
+					Data:    pp.pkt.data,
 				}
 			} else {
 				return errors.New("unknown packet type")
@@ -210,7 +269,7 @@ func (c *Client) readLoop() {
 			return nil
 		}()
 		if err != nil {
-			c.DiscardPeer(pp.id, time.Minute*2)
+			c.ReportPeer(pp.key, EventInvalidPacket)
 		}
 	}
 }
@@ -271,6 +330,7 @@ func (c *Client) maintainSendPeers() {
 			if err == nil {
 				ioutil.WriteFile(filepath.Join(c.config.Path, "net", "peers.json"), b, 0o755)
 			}
+			c.saveScores()
 		}
 		te := time.Now()
 		slp := time.After(te.Sub(ts)*10 + time.Second)
@@ -291,12 +351,17 @@ func (c *Client) writeTo(id int, pkt packet) {
 	}
 }
 
-func (c *Client) broadcast(pkt packet, count int) {
+// broadcast to count random peers with all the capabilities
+func (c *Client) broadcast(pkt packet, count int, caps uint64) {
 	o := make([]int, count)
 	bpeers := make([]*Peer, count)
 	bpeers = bpeers[:0]
 	c.peersMut.Lock()
-	le := len(c.allPeers)
+	allPeers := c.allPeers
+	if caps != 0 {
+		allPeers = c.peerIds(caps)
+	}
+	le := len(allPeers)
 	for i := 0; i < count && i < le; i++ {
 		var x int
 		for {
@@ -312,7 +377,7 @@ func (c *Client) broadcast(pkt packet, count int) {
 			}
 		}
 		o[i] = x
-		id := c.allPeers[x]
+		id := allPeers[x]
 		if peer, ok := c.peers[id]; ok && peer != nil {
 			bpeers = append(bpeers, peer)
 		}
@@ -323,6 +388,24 @@ func (c *Client) broadcast(pkt packet, count int) {
 	}
 }
 
+// must be called with peersMut held
+func (c *Client) peerIds(caps uint64) []int {
+	res := []int{}
+	for _, id := range c.allPeers {
+		if peer, ok := c.peers[id]; ok && peer != nil && peer.hello.Capabilities&caps == caps {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// the connected peers with all the capabilities
+func (c *Client) PeerIds(caps uint64) []int {
+	c.peersMut.Lock()
+	defer c.peersMut.Unlock()
+	return c.peerIds(caps)
+}
+
 func (c *Client) WriteTo(id int, data []byte) {
 	nd := make([]byte, len(data))
 	copy(nd, data)
@@ -333,12 +416,33 @@ func (c *Client) WriteTo(id int, data []byte) {
 }
 
 func (c *Client) Broadcast(data []byte, count int) {
+	c.BroadcastCaps(data, count, 0)
+}
+
+// broadcast to peers which advertised all the capabilities
+func (c *Client) BroadcastCaps(data []byte, count int, caps uint64) {
 	nd := make([]byte, len(data))
 	copy(nd, data)
 	c.broadcast(packet{
 		tp:   PktChain,
 		data: nd,
-	}, count)
+	}, count, caps)
+}
+
+// what the peer sent in the handshake
+func (c *Client) PeerHello(id int) (PeerHello, bool) {
+	c.peersMut.Lock()
+	defer c.peersMut.Unlock()
+	peer, ok := c.peers[id]
+	if !ok || peer == nil {
+		return PeerHello{}, false
+	}
+	return peer.hello, true
+}
+
+func (c *Client) HasCaps(id int, caps uint64) bool {
+	h, ok := c.PeerHello(id)
+	return ok && h.Capabilities&caps == caps
 }
 
 func (c *Client) tryConn(id int, host string) {
@@ -364,7 +468,9 @@ func (c *Client) tryConn(id int, host string) {
 func (c *Client) maintainPeers() {
 	defer c.istop()
 	for {
-		slp := time.After(time.Second * 5)
+		// the pending dials take slots too, so two peers dialing each other
+		// at the same moment may refuse each other, the jitter keeps them apart
+		slp := time.After(time.Second*4 + time.Duration(rand.Int63n(int64(time.Second*2))))
 		select {
 		case <-slp:
 		case <-c.stop:
@@ -396,16 +502,23 @@ func (c *Client) maintainConns() {
 			return
 		}
 		q := []int{}
+		timedOut := []PeerKey{}
 		c.peersMut.Lock()
 		for id, p := range c.peers {
 			if p != nil && p.Stopped() {
 				q = append(q, id)
+				if p.TimedOut() {
+					timedOut = append(timedOut, p.key)
+				}
 			}
 		}
 		c.peersMut.Unlock()
 		for _, id := range q {
 			go c.DiscardPeer(id, time.Duration(0))
 		}
+		for _, k := range timedOut {
+			c.ReportPeer(k, EventTimeout)
+		}
 	}
 }
 
@@ -418,12 +531,110 @@ func (c *Client) DiscardPeer(id int, banTime time.Duration) {
 	}
 	peer, ok := c.peers[id]
 	delete(c.peers, id)
+	if ok && peer != nil && banTime > 0 {
+		c.score(peer.key).BannedUntil = time.Now().Add(banTime)
+	}
 	c.peersMut.Unlock()
 	if ok && peer != nil {
 		peer.Stop()
 	}
 }
 
+// ban the identity of a peer, wherever it connects from
+func (c *Client) BanPeerKey(key PeerKey, banTime time.Duration) {
+	c.peersMut.Lock()
+	c.score(key).BannedUntil = time.Now().Add(banTime)
+	c.peersMut.Unlock()
+	c.disconnectKey(key)
+}
+
+func (c *Client) disconnectKey(key PeerKey) {
+	ids := []int{}
+	c.peersMut.Lock()
+	for id, p := range c.peers {
+		if p != nil && p.key == key {
+			ids = append(ids, id)
+		}
+	}
+	c.peersMut.Unlock()
+	for _, id := range ids {
+		c.DiscardPeer(id, time.Duration(0))
+	}
+}
+
+func (c *Client) saveScores() {
+	c.peersMut.Lock()
+	b, err := encodeScores(c.scores, time.Now())
+	c.peersMut.Unlock()
+	if err == nil {
+		ioutil.WriteFile(filepath.Join(c.config.Path, "net", "scores.json"), b, 0o644)
+	}
+}
+
+// must be called with peersMut held
+func (c *Client) score(key PeerKey) *PeerScore {
+	s, ok := c.scores[key]
+	if !ok {
+		s = &PeerScore{}
+		c.scores[key] = s
+	}
+	return s
+}
+
+// update the score of a peer, and disconnect or ban it if the score is too low
+func (c *Client) ReportPeer(key PeerKey, ev PeerEvent) {
+	now := time.Now()
+	c.peersMut.Lock()
+	s := c.score(key)
+	s.apply(ev, now)
+	drop := s.Score < DisconnectScore
+	if s.Score < BanScore && !s.banned(now) {
+		s.BannedUntil = now.Add(ScoreBanTime)
+	}
+	c.peersMut.Unlock()
+	if drop {
+		c.disconnectKey(key)
+	}
+}
+
+type PeerBan struct {
+	Key string `json:"key"`
+	PeerScore
+}
+
+// the peers banned now
+func (c *Client) GetBans() []PeerBan {
+	now := time.Now()
+	c.peersMut.Lock()
+	defer c.peersMut.Unlock()
+	res := []PeerBan{}
+	for k, v := range c.scores {
+		if v.banned(now) {
+			res = append(res, PeerBan{
+				Key:       k.String(),
+				PeerScore: *v,
+			})
+		}
+	}
+	return res
+}
+
+func (c *Client) GetPeerScore(key PeerKey) (PeerScore, bool) {
+	c.peersMut.Lock()
+	defer c.peersMut.Unlock()
+	s, ok := c.scores[key]
+	if !ok {
+		return PeerScore{}, false
+	}
+	s.recover(time.Now())
+	return *s, true
+}
+
+// the identity of this node
+func (c *Client) Key() PeerKey {
+	return c.key.pub
+}
+
 func (c *Client) AddPeers(peers []string) {
 	c.peersMut.Lock()
 	for _, ps := range peers {
@@ -444,7 +655,7 @@ func (c *Client) broadcastFindPeer() {
 		c.broadcast(packet{
 			tp:   PktFindPeer,
 			data: empty,
-		}, 3)
+		}, 3, 0)
 		slp := time.After(time.Second * 10)
 		select {
 		case <-c.stop:
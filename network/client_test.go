@@ -59,3 +59,72 @@ func TestClientFullmesh4(t *testing.T) {
 func TestClientFullmesh5(t *testing.T) {
 	testClientFullmesh(t, 10, 6, 3, 300, 25000, []int{0, 1, 0, 2, 0, 3, 1, 4, 1, 5, 2, 6, 2, 7, 3, 8, 3, 9})
 }
+
+func TestClientHello(t *testing.T) {
+	rs := []chan ClientPacket{make(chan ClientPacket, 100), make(chan ClientPacket, 100)}
+	caps := []uint64{1, 3}
+	cs := []*Client{}
+	for i := 0; i < 2; i++ {
+		h := i
+		c, err := NewClient(&ClientConfig{
+			Port:           26000 + i,
+			MaxConnections: 10,
+			ClientVersion:  "test",
+			Capabilities:   caps[i],
+			Status: func() (int, [32]byte) {
+				return 100 + h, [32]byte{byte(h)}
+			},
+		}, rs[i], 8888)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Stop()
+		cs = append(cs, c)
+	}
+	cs[0].AddPeers([]string{"127.0.0.1:26001"})
+	var cp ClientPacket
+	for i := 0; ; i++ {
+		if i == 30 {
+			t.Fatal("not connected")
+		}
+		time.Sleep(time.Second)
+		cs[0].Broadcast([]byte{1}, 1)
+		select {
+		case cp = <-rs[1]:
+		default:
+			continue
+		}
+		break
+	}
+	h, ok := cs[1].PeerHello(cp.PeerId)
+	if !ok || h.Version != ProtocolVersion || h.ClientVersion != "test" || h.Height != 100 || h.Hash != [32]byte{0} || h.Capabilities != 1 {
+		t.Fatalf("wrong hello %+v", h)
+	}
+	if cp.PeerKey != cs[0].Key() {
+		t.Fatal("wrong peer key")
+	}
+	if !cs[1].HasCaps(cp.PeerId, 1) || cs[1].HasCaps(cp.PeerId, 2) {
+		t.Fatal("wrong capabilities")
+	}
+	if ids := cs[1].PeerIds(1); len(ids) != 1 || ids[0] != cp.PeerId || len(cs[1].PeerIds(2)) != 0 {
+		t.Fatalf("wrong peers with capabilities %v", ids)
+	}
+	// client 0 doesn't have capability 2
+	for i := 0; i < 5; i++ {
+		cs[1].BroadcastCaps([]byte{2}, 1, 2)
+	}
+	for i := 0; ; i++ {
+		if i == 10 {
+			t.Fatal("packet not received")
+		}
+		cs[1].BroadcastCaps([]byte{3}, 1, 1)
+		select {
+		case cp = <-rs[0]:
+			if cp.Data[0] != 3 {
+				t.Fatal("packet sent without the capability")
+			}
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
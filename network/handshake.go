@@ -0,0 +1,349 @@
+package network
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The handshake follows the Noise XX pattern (-> e; <- e, ee, s, es; -> s, se)
+// with X25519, AES-256-GCM and SHA-256. The static key of a node is its
+// identity, and the hellos exchanged before are the prologue. Each handshake
+// message is prefixed with its length.
+const handshakeProtocolName = "Noise_XX_25519_AESGCM_SHA256"
+
+const PeerKeyLen = 32
+const handshakeTagLen = 16
+
+// X25519 public key
+type PeerKey [PeerKeyLen]byte
+
+func (k PeerKey) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+var errHandshake = errors.New("handshake failed")
+
+type staticKey struct {
+	priv *ecdh.PrivateKey
+	pub  PeerKey
+}
+
+func staticKeyFromPriv(priv []byte) (*staticKey, error) {
+	d, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, errors.New("invalid private key")
+	}
+	k := &staticKey{priv: d}
+	copy(k.pub[:], d.PublicKey().Bytes())
+	return k, nil
+}
+
+func generateStaticKey() (*staticKey, error) {
+	d, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return staticKeyFromPriv(d.Bytes())
+}
+
+// load the key in net/node.key under the path, or create it, an empty path
+// gives a new key every time
+func loadStaticKey(path string) (*staticKey, error) {
+	if path == "" {
+		return generateStaticKey()
+	}
+	fn := filepath.Join(path, "net", "node.key")
+	b, err := ioutil.ReadFile(fn)
+	if err == nil {
+		k, err := staticKeyFromPriv(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %v", fn, err)
+		}
+		return k, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	k, err := generateStaticKey()
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(fn, k.priv.Bytes(), 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func dh(priv *ecdh.PrivateKey, pub PeerKey) ([]byte, error) {
+	k, err := ecdh.X25519().NewPublicKey(pub[:])
+	if err != nil {
+		return nil, errHandshake
+	}
+	// fails for low order points
+	res, err := priv.ECDH(k)
+	if err != nil {
+		return nil, errHandshake
+	}
+	return res, nil
+}
+
+type cipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newCipherState(k []byte) *cipherState {
+	b, err := aes.NewCipher(k)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		panic(err)
+	}
+	return &cipherState{aead: aead}
+}
+
+func (c *cipherState) nonce() []byte {
+	res := make([]byte, 12)
+	binary.BigEndian.PutUint64(res[4:], c.n)
+	c.n++
+	return res
+}
+
+func (c *cipherState) encrypt(ad, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.nonce(), plaintext, ad)
+}
+
+func (c *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nonce(), ciphertext, ad)
+}
+
+func hmacSum(k []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, k)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func hkdf2(ck, ikm []byte) ([]byte, []byte) {
+	t := hmacSum(ck, ikm)
+	o1 := hmacSum(t, []byte{1})
+	o2 := hmacSum(t, o1, []byte{2})
+	return o1, o2
+}
+
+type symmetricState struct {
+	ck []byte
+	h  []byte
+	cs *cipherState
+}
+
+func newSymmetricState(prologue []byte) *symmetricState {
+	h := make([]byte, 32)
+	copy(h, handshakeProtocolName)
+	s := &symmetricState{ck: h, h: h}
+	s.mixHash(prologue)
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h)
+	h.Write(data)
+	s.h = h.Sum(nil)
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	var k []byte
+	s.ck, k = hkdf2(s.ck, ikm)
+	s.cs = newCipherState(k)
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) []byte {
+	if s.cs == nil {
+		s.mixHash(plaintext)
+		return plaintext
+	}
+	res := s.cs.encrypt(s.h, plaintext)
+	s.mixHash(res)
+	return res
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if s.cs == nil {
+		s.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+	res, err := s.cs.decrypt(s.h, ciphertext)
+	if err != nil {
+		return nil, errHandshake
+	}
+	s.mixHash(ciphertext)
+	return res, nil
+}
+
+func (s *symmetricState) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdf2(s.ck, nil)
+	return newCipherState(k1), newCipherState(k2)
+}
+
+func writeHandshakeMsg(w *bufio.Writer, data ...[]byte) error {
+	n := 0
+	for _, d := range data {
+		n += len(d)
+	}
+	buf := make([]byte, 2, 2+n)
+	binary.LittleEndian.PutUint16(buf, uint16(n))
+	for _, d := range data {
+		buf = append(buf, d...)
+	}
+	_, err := w.Write(buf)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func readHandshakeMsg(r *bufio.Reader, minLen int) ([]byte, error) {
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	buf = make([]byte, binary.LittleEndian.Uint16(buf))
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < minLen {
+		return nil, errHandshake
+	}
+	return buf, nil
+}
+
+// the ciphers to send and receive with after the handshake, and what the remote
+// has sent in it
+type session struct {
+	send    *cipherState
+	recv    *cipherState
+	key     PeerKey
+	payload []byte
+}
+
+// run the handshake, the payload is sent encrypted
+func handshake(r *bufio.Reader, w *bufio.Writer, s *staticKey, initiator bool, prologue []byte, payload []byte) (*session, error) {
+	res := &session{}
+	ss := newSymmetricState(prologue)
+	e, err := generateStaticKey()
+	if err != nil {
+		return nil, err
+	}
+	mixDH := func(priv *ecdh.PrivateKey, pub PeerKey) error {
+		k, err := dh(priv, pub)
+		if err != nil {
+			return err
+		}
+		ss.mixKey(k)
+		return nil
+	}
+	encLen := PeerKeyLen + handshakeTagLen
+	if initiator {
+		ss.mixHash(e.pub[:])
+		err = writeHandshakeMsg(w, e.pub[:], ss.encryptAndHash(nil))
+		if err != nil {
+			return nil, err
+		}
+		m, err := readHandshakeMsg(r, PeerKeyLen+encLen)
+		if err != nil {
+			return nil, err
+		}
+		var re PeerKey
+		copy(re[:], m[:PeerKeyLen])
+		ss.mixHash(re[:])
+		err = mixDH(e.priv, re)
+		if err != nil {
+			return nil, err
+		}
+		t, err := ss.decryptAndHash(m[PeerKeyLen : PeerKeyLen+encLen])
+		if err != nil {
+			return nil, err
+		}
+		copy(res.key[:], t)
+		err = mixDH(e.priv, res.key)
+		if err != nil {
+			return nil, err
+		}
+		res.payload, err = ss.decryptAndHash(m[PeerKeyLen+encLen:])
+		if err != nil {
+			return nil, err
+		}
+		c := ss.encryptAndHash(s.pub[:])
+		err = mixDH(s.priv, re)
+		if err != nil {
+			return nil, err
+		}
+		err = writeHandshakeMsg(w, c, ss.encryptAndHash(payload))
+		if err != nil {
+			return nil, err
+		}
+		res.send, res.recv = ss.split()
+		return res, nil
+	}
+	m, err := readHandshakeMsg(r, PeerKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	var re PeerKey
+	copy(re[:], m[:PeerKeyLen])
+	ss.mixHash(re[:])
+	ss.decryptAndHash(m[PeerKeyLen:])
+	ss.mixHash(e.pub[:])
+	err = mixDH(e.priv, re)
+	if err != nil {
+		return nil, err
+	}
+	c := ss.encryptAndHash(s.pub[:])
+	err = mixDH(s.priv, re)
+	if err != nil {
+		return nil, err
+	}
+	err = writeHandshakeMsg(w, e.pub[:], c, ss.encryptAndHash(payload))
+	if err != nil {
+		return nil, err
+	}
+	m, err = readHandshakeMsg(r, encLen)
+	if err != nil {
+		return nil, err
+	}
+	t, err := ss.decryptAndHash(m[:encLen])
+	if err != nil {
+		return nil, err
+	}
+	copy(res.key[:], t)
+	err = mixDH(e.priv, res.key)
+	if err != nil {
+		return nil, err
+	}
+	res.payload, err = ss.decryptAndHash(m[encLen:])
+	if err != nil {
+		return nil, err
+	}
+	res.recv, res.send = ss.split()
+	return res, nil
+}
@@ -0,0 +1,149 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"testing"
+)
+
+type handshakeResult struct {
+	ses *session
+	err error
+}
+
+func testHandshake(t *testing.T, p1, p2 []byte) (*staticKey, *staticKey, handshakeResult, handshakeResult) {
+	k1, err := generateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := generateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	run := func(conn net.Conn, k *staticKey, initiator bool, prologue []byte, res chan handshakeResult) {
+		var r handshakeResult
+		r.ses, r.err = handshake(bufio.NewReader(conn), bufio.NewWriter(conn), k, initiator, prologue, []byte{byte(len(prologue)), boolByte(initiator)})
+		// unblock the other side
+		conn.Close()
+		res <- r
+	}
+	ch1 := make(chan handshakeResult, 1)
+	ch2 := make(chan handshakeResult, 1)
+	go run(c1, k1, true, p1, ch1)
+	go run(c2, k2, false, p2, ch2)
+	return k1, k2, <-ch1, <-ch2
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestHandshake(t *testing.T) {
+	k1, k2, r1, r2 := testHandshake(t, []byte("hello"), []byte("hello"))
+	if r1.err != nil || r2.err != nil {
+		t.Fatal(r1.err, r2.err)
+	}
+	if r1.ses.key != k2.pub || r2.ses.key != k1.pub {
+		t.Fatal("wrong remote key")
+	}
+	if !bytes.Equal(r1.ses.payload, []byte{5, 0}) || !bytes.Equal(r2.ses.payload, []byte{5, 1}) {
+		t.Fatal("wrong payload")
+	}
+	p := packet{tp: 4, data: []byte("some data")}
+	var b bytes.Buffer
+	for i := 0; i < 3; i++ {
+		err := writeFrame(&b, r1.ses.send, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		p2, err := readFrame(&b, r2.ses.recv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p2.tp != p.tp || !bytes.Equal(p2.data, p.data) {
+			t.Fatal("wrong packet")
+		}
+	}
+	// tampered frames are rejected
+	d := b.Bytes()
+	d[len(d)-1] ^= 1
+	_, err := readFrame(&b, r2.ses.recv)
+	if err == nil {
+		t.Fatal("tampered frame accepted")
+	}
+	// the ciphers of the two directions differ
+	b.Reset()
+	err = writeFrame(&b, r2.ses.send, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readFrame(&b, r2.ses.recv)
+	if err == nil {
+		t.Fatal("frame accepted in the wrong direction")
+	}
+
+	_, _, r1, r2 = testHandshake(t, []byte("hello"), []byte("hellp"))
+	if r1.err == nil && r2.err == nil {
+		t.Fatal("handshake with different prologues succeeded")
+	}
+}
+
+func TestStaticKey(t *testing.T) {
+	path := "/tmp/tcoin_test/net_test_key"
+	err := os.RemoveAll(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path+"/net", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1, err := loadStaticKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := loadStaticKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1.pub != k2.pub {
+		t.Fatal("static key not kept")
+	}
+	k3, err := loadStaticKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k3.pub == k1.pub {
+		t.Fatal("same key without a path")
+	}
+}
+
+func TestPeerHello(t *testing.T) {
+	h := PeerHello{
+		Version:       3,
+		ClientVersion: "tcoin/test",
+		Height:        12345,
+		Hash:          [32]byte{1, 2, 3},
+		Capabilities:  5,
+	}
+	d := encodePeerHello(h)
+	h2, err := decodePeerHello(append(d, 7, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2 != h {
+		t.Fatalf("wrong hello %+v", h2)
+	}
+	_, err = decodePeerHello(d[:len(d)-1])
+	if err == nil {
+		t.Fatal("truncated hello decoded")
+	}
+}
@@ -0,0 +1,49 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// sent by each side in the handshake
+type PeerHello struct {
+	Version       uint32
+	ClientVersion string
+	// the highest block of the peer when connecting
+	Height int
+	Hash   [32]byte
+	// bits of the packet kinds the peer understands, defined by the user of
+	// the client
+	Capabilities uint64
+}
+
+// version, capabilities, height, hash, length and content of the client
+// version, newer versions may append more fields
+const peerHelloMinLen = 4 + 8 + 8 + 32 + 1
+
+func encodePeerHello(h PeerHello) []byte {
+	cv := h.ClientVersion
+	if len(cv) > 255 {
+		cv = cv[:255]
+	}
+	buf := make([]byte, peerHelloMinLen, peerHelloMinLen+len(cv))
+	binary.LittleEndian.PutUint32(buf[:4], h.Version)
+	binary.LittleEndian.PutUint64(buf[4:12], h.Capabilities)
+	binary.LittleEndian.PutUint64(buf[12:20], uint64(h.Height))
+	copy(buf[20:52], h.Hash[:])
+	buf[52] = byte(len(cv))
+	return append(buf, cv...)
+}
+
+func decodePeerHello(d []byte) (PeerHello, error) {
+	var h PeerHello
+	if len(d) < peerHelloMinLen || len(d) < peerHelloMinLen+int(d[52]) {
+		return h, errors.New("invalid peer hello")
+	}
+	h.Version = binary.LittleEndian.Uint32(d[:4])
+	h.Capabilities = binary.LittleEndian.Uint64(d[4:12])
+	h.Height = int(binary.LittleEndian.Uint64(d[12:20]))
+	copy(h.Hash[:], d[20:52])
+	h.ClientVersion = string(d[peerHelloMinLen : peerHelloMinLen+int(d[52])])
+	return h, nil
+}
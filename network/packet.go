@@ -1,6 +1,7 @@
 package network
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -42,3 +43,46 @@ func encodePacket(w io.Writer, p packet) error {
 	}
 	return nil
 }
+
+// the most a frame can be, the header and the data of the largest packet, and
+// the tag
+const maxFrameLen = 4 + 0xffffff + handshakeTagLen
+
+// a frame is the length of the sealed packet, and the packet sealed with the
+// length as additional data
+func writeFrame(w io.Writer, cs *cipherState, p packet) error {
+	var buf bytes.Buffer
+	err := encodePacket(&buf, p)
+	if err != nil {
+		return err
+	}
+	l := make([]byte, 4)
+	binary.LittleEndian.PutUint32(l, uint32(buf.Len()+handshakeTagLen))
+	if _, err := w.Write(l); err != nil {
+		return err
+	}
+	if _, err := w.Write(cs.encrypt(l, buf.Bytes())); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readFrame(r io.Reader, cs *cipherState) (packet, error) {
+	l := make([]byte, 4)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return packet{}, err
+	}
+	x := binary.LittleEndian.Uint32(l)
+	if x > maxFrameLen || x < 4+handshakeTagLen {
+		return packet{}, errors.New("invalid frame length")
+	}
+	buf := make([]byte, x)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return packet{}, err
+	}
+	d, err := cs.decrypt(l, buf)
+	if err != nil {
+		return packet{}, err
+	}
+	return decodePacket(bytes.NewReader(d))
+}
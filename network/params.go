@@ -4,7 +4,9 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"io"
 	"net"
+	"syscall"
 	"time"
 )
 
@@ -20,13 +22,28 @@ const PktChain = 4
 const PeerHelloSalt = "Tc01n_1111aa"
 const PeerHelloNonceLen = 8
 
+// sent in the handshake, peers older than the min version are refused
+const ProtocolVersion = 1
+const MinProtocolVersion = 1
+
 var errNetworkIdMismatch = errors.New("peer network id mismatch")
 var errSelf = errors.New("conneting to self")
+var errProtocolVersion = errors.New("peer protocol version too old")
+
+// whether the connection was closed by the other side
+func connClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
 
 type ClientConfig struct {
 	Port           int
 	MaxConnections int
 	Path           string
+	ClientVersion  string
+	Capabilities   uint64
+	// the highest block, sent to peers when connecting
+	Status func() (int, [32]byte)
 }
 
 func connStrId(s string) int {
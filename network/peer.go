@@ -7,26 +7,41 @@ import (
 	"crypto/sha256"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 type peerPacket struct {
 	id  int
+	key PeerKey
 	pkt packet
 }
 
 type Peer struct {
 	id      int
+	key     PeerKey
+	hello   PeerHello
 	conn    net.Conn
 	r       *bufio.Reader
 	w       *bufio.Writer
 	rq      chan peerPacket
 	wq      chan packet
+	send    *cipherState
+	recv    *cipherState
 	stop    chan bool
 	stopped chan bool
+	// set if the connection timed out
+	timedOut int32
+	// set once the peer is stopping
+	stopping int32
+	// packets received in the current window, guarded by the client
+	pktCount int
+	pktStart time.Time
 }
 
-func NewPeer(id int, conn net.Conn, rq chan peerPacket, networkId uint16, cnonce []byte) (*Peer, error) {
+// key is the static key of this node, and hello is sent to the peer in the
+// handshake
+func NewPeer(id int, conn net.Conn, rq chan peerPacket, networkId uint16, cnonce []byte, key *staticKey, hello PeerHello) (*Peer, error) {
 	//log.Printf("new peer %d", id)
 	p := &Peer{
 		id:      id,
@@ -59,6 +74,7 @@ func NewPeer(id int, conn net.Conn, rq chan peerPacket, networkId uint16, cnonce
 	if err != nil {
 		return nil, err
 	}
+	myHello := append([]byte{}, buf2...)
 	_, err = io.ReadFull(p.r, buf2)
 	if err != nil {
 		return nil, err
@@ -71,6 +87,30 @@ func NewPeer(id int, conn net.Conn, rq chan peerPacket, networkId uint16, cnonce
 	if bytes.Equal(buf2[PeerHelloNonceLen+8:], cnonce) {
 		return nil, errSelf
 	}
+	// both sides may have dialed (a simultaneous open with reuseport), so the
+	// roles come from the random hellos
+	initiator := bytes.Compare(myHello, buf2) < 0
+	prologue := append(myHello, buf2...)
+	if !initiator {
+		prologue = append(append([]byte{}, buf2...), myHello...)
+	}
+	ses, err := handshake(p.r, p.w, key, initiator, prologue, encodePeerHello(hello))
+	if err != nil {
+		return nil, err
+	}
+	if ses.key == key.pub {
+		return nil, errSelf
+	}
+	p.hello, err = decodePeerHello(ses.payload)
+	if err != nil {
+		return nil, err
+	}
+	if p.hello.Version < MinProtocolVersion {
+		return nil, errProtocolVersion
+	}
+	p.key = ses.key
+	p.send = ses.send
+	p.recv = ses.recv
 	go p.readLoop()
 	go p.writeLoop()
 	go p.heartBeat()
@@ -86,6 +126,10 @@ func (p *Peer) Stop() {
 	p.stopped <- true
 }
 
+func (p *Peer) TimedOut() bool {
+	return atomic.LoadInt32(&p.timedOut) == 1
+}
+
 func (p *Peer) Stopped() bool {
 	select {
 	case <-p.stopped:
@@ -97,6 +141,7 @@ func (p *Peer) Stopped() bool {
 }
 
 func (p *Peer) istop() {
+	atomic.StoreInt32(&p.stopping, 1)
 	for i := 0; i < 5; i++ {
 		p.stop <- true
 	}
@@ -110,9 +155,15 @@ func (p *Peer) readLoop() {
 	defer p.istop()
 	for {
 		p.conn.SetDeadline(time.Now().Add(MaxTimeout))
-		pk, err := decodePacket(p.r)
+		pk, err := readFrame(p.r, p.recv)
 		if err != nil {
 			//log.Printf("read error: %v", err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// stopping sets the deadline too
+				if atomic.LoadInt32(&p.stopping) == 0 {
+					atomic.StoreInt32(&p.timedOut, 1)
+				}
+			}
 			return
 		}
 		select {
@@ -122,6 +173,7 @@ func (p *Peer) readLoop() {
 		}
 		p.rq <- peerPacket{
 			id:  p.id,
+			key: p.key,
 			pkt: pk,
 		}
 	}
@@ -132,7 +184,7 @@ func (p *Peer) writeLoop() {
 	for {
 		select {
 		case pk := <-p.wq:
-			err := encodePacket(p.w, pk)
+			err := writeFrame(p.w, p.send, pk)
 			//log.Printf("wrote packet: %v", pk)
 			if err != nil {
 				//log.Printf("write error: %v", err)
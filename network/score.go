@@ -0,0 +1,135 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// what a peer has done, reported by the client or its user
+type PeerEvent int
+
+const (
+	EventUsefulBlock PeerEvent = iota
+	EventInvalidBlock
+	EventInvalidTx
+	EventTimeout
+	EventInvalidPacket
+	EventSpam
+)
+
+var eventScores = map[PeerEvent]int{
+	EventUsefulBlock:   1,
+	EventInvalidBlock:  -20,
+	EventInvalidTx:     -5,
+	EventTimeout:       -10,
+	EventInvalidPacket: -20,
+	EventSpam:          -20,
+}
+
+const MaxPeerScore = 100
+
+// peers are disconnected below DisconnectScore, and banned for ScoreBanTime
+// below BanScore
+const DisconnectScore = -50
+const BanScore = -100
+const ScoreBanTime = time.Hour * 24
+
+// scores move toward 0 by one point in this time
+const scoreRecoverTime = time.Minute
+
+// scores not changed for this long are forgotten, unless banned
+const scoreKeepTime = time.Hour * 24 * 7
+
+// packets from a peer beyond the max in a window are dropped
+const MaxPacketRate = 2000
+const packetRateWindow = time.Second * 10
+
+type PeerScore struct {
+	Score          int       `json:"score"`
+	UsefulBlocks   int       `json:"useful_blocks"`
+	InvalidBlocks  int       `json:"invalid_blocks"`
+	InvalidTxs     int       `json:"invalid_txs"`
+	Timeouts       int       `json:"timeouts"`
+	InvalidPackets int       `json:"invalid_packets"`
+	Spam           int       `json:"spam"`
+	Updated        time.Time `json:"updated"`
+	BannedUntil    time.Time `json:"banned_until"`
+}
+
+func (s *PeerScore) recover(now time.Time) {
+	n := int(now.Sub(s.Updated) / scoreRecoverTime)
+	if n <= 0 {
+		return
+	}
+	if s.Score > 0 {
+		s.Score -= n
+		if s.Score < 0 {
+			s.Score = 0
+		}
+	} else if s.Score < 0 {
+		s.Score += n
+		if s.Score > 0 {
+			s.Score = 0
+		}
+	}
+	s.Updated = s.Updated.Add(time.Duration(n) * scoreRecoverTime)
+}
+
+func (s *PeerScore) apply(ev PeerEvent, now time.Time) {
+	if s.Updated.IsZero() {
+		s.Updated = now
+	}
+	s.recover(now)
+	switch ev {
+	case EventUsefulBlock:
+		s.UsefulBlocks++
+	case EventInvalidBlock:
+		s.InvalidBlocks++
+	case EventInvalidTx:
+		s.InvalidTxs++
+	case EventTimeout:
+		s.Timeouts++
+	case EventInvalidPacket:
+		s.InvalidPackets++
+	case EventSpam:
+		s.Spam++
+	}
+	s.Score += eventScores[ev]
+	if s.Score > MaxPeerScore {
+		s.Score = MaxPeerScore
+	}
+}
+
+func (s *PeerScore) banned(now time.Time) bool {
+	return s.BannedUntil.After(now)
+}
+
+func encodeScores(scores map[PeerKey]*PeerScore, now time.Time) ([]byte, error) {
+	t := make(map[string]*PeerScore)
+	for k, v := range scores {
+		if v.banned(now) || now.Sub(v.Updated) < scoreKeepTime {
+			t[k.String()] = v
+		}
+	}
+	return json.Marshal(t)
+}
+
+func decodeScores(b []byte) (map[PeerKey]*PeerScore, error) {
+	var t map[string]*PeerScore
+	err := json.Unmarshal(b, &t)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[PeerKey]*PeerScore)
+	for k, v := range t {
+		d, err := hex.DecodeString(k)
+		if err != nil || len(d) != PeerKeyLen || v == nil {
+			continue
+		}
+		var pk PeerKey
+		copy(pk[:], d)
+		res[pk] = v
+	}
+	return res, nil
+}
@@ -0,0 +1,79 @@
+package network
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPeerScore(t *testing.T) {
+	now := time.Now()
+	s := &PeerScore{}
+	for i := 0; i < 200; i++ {
+		s.apply(EventUsefulBlock, now)
+	}
+	if s.Score != MaxPeerScore || s.UsefulBlocks != 200 {
+		t.Fatalf("wrong score %+v", s)
+	}
+	s.apply(EventInvalidBlock, now)
+	s.apply(EventInvalidTx, now)
+	if s.Score != MaxPeerScore-25 {
+		t.Fatalf("wrong score %d", s.Score)
+	}
+	// recovers toward 0
+	s.recover(now.Add(scoreRecoverTime * 10))
+	if s.Score != MaxPeerScore-35 {
+		t.Fatalf("wrong score %d", s.Score)
+	}
+	s.recover(now.Add(scoreRecoverTime * 1000))
+	if s.Score != 0 {
+		t.Fatalf("wrong score %d", s.Score)
+	}
+	s.apply(EventTimeout, now.Add(scoreRecoverTime*1000))
+	s.recover(now.Add(scoreRecoverTime * 1005))
+	if s.Score != eventScores[EventTimeout]+5 || s.Timeouts != 1 {
+		t.Fatalf("wrong score %+v", s)
+	}
+}
+
+func TestClientScores(t *testing.T) {
+	config := &ClientConfig{
+		Port:           -1,
+		MaxConnections: 10,
+		Path:           "/tmp/tcoin_test/net_test_scores",
+	}
+	err := os.RemoveAll(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(config, make(chan ClientPacket, 10), 8888)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1 := PeerKey{1}
+	k2 := PeerKey{2}
+	c.ReportPeer(k1, EventUsefulBlock)
+	for i := 0; i < 6; i++ {
+		c.ReportPeer(k2, EventInvalidPacket)
+	}
+	bans := c.GetBans()
+	if len(bans) != 1 || bans[0].Key != k2.String() || bans[0].InvalidPackets != 6 {
+		t.Fatalf("wrong bans %+v", bans)
+	}
+	c.Stop()
+
+	// the scores are kept after restarting
+	c, err = NewClient(config, make(chan ClientPacket, 10), 8888)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	bans = c.GetBans()
+	if len(bans) != 1 || bans[0].Key != k2.String() {
+		t.Fatalf("wrong bans %+v", bans)
+	}
+	s, ok := c.GetPeerScore(k1)
+	if !ok || s.Score != 1 || s.UsefulBlocks != 1 {
+		t.Fatalf("wrong score %+v", s)
+	}
+}
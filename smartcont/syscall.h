@@ -24,6 +24,7 @@ const int SYSCALL_TRANSFER = 19;
 const int SYSCALL_CREATE = 20;
 const int SYSCALL_ED25519_VERIFY = 21;
 const int SYSCALL_LOAD_ELF = 22;
+const int SYSCALL_LOG = 23;
 
 const uint64_t CREATE_TRIMELF = 1;
 const uint64_t CREATE_INIT = 2;
@@ -89,6 +89,10 @@ const auto create = reinterpret_cast<Address (*)(
 const auto loadELF =
     reinterpret_cast<start_t (*)(const Address *addr, size_t offset)>(
         syscall::addr(SYSCALL_LOAD_ELF));
+const auto emitLog =
+    reinterpret_cast<void (*)(const Address *topics, size_t nTopics,
+                              const char *data, size_t len)>(
+        syscall::addr(SYSCALL_LOG));
 } // namespace syscall
 
 namespace msg {
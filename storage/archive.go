@@ -0,0 +1,484 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// In archive mode, the changes of the state (keys below LocalKeyPrefix) at
+// each finalized height are appended to perm/history, which starts with the
+// height archiving started at and the last archived height, followed by the
+// full state at the start height and the changes of the later heights as
+// (height, key, value) records.
+// The records are indexed in perm/history.index, a diskKV with the treaps of
+// index.go: for each key, the heights it changed at, grouped by the hash of
+// the key, with the offset of the record at each height, and for each height
+// the offset its records end at. The indexed keys are also in the treaps of
+// their contracts, so they can be listed in order. The index has the last
+// height it covers, the heights above the root slice are dropped from it on
+// open, and it's built again from perm/history if it's missing or broken.
+const historyHeaderLen = 16
+const historyRecordLen = 8 + KeyLen + DataLen
+
+const (
+	histTagOffset = idxTagRootFlags + 1 + iota
+	histTagEnd
+)
+
+// records are read in chunks of this size when the index is built or scanned
+const historyReadBuffer = 1 << 20
+
+var ErrNotArchived = errors.New("height not archived")
+
+type archive struct {
+	f     *os.File
+	idx   *diskKV
+	path  string
+	size  int64
+	start int
+	top   int
+	mut   sync.RWMutex
+}
+
+func heightPos(height int) HashType {
+	var p HashType
+	binary.BigEndian.PutUint64(p[HashLen-8:], uint64(height))
+	return p
+}
+
+func historyGroup(k KeyType) []byte {
+	g := sha256.Sum256(k[:])
+	return g[:]
+}
+
+func historyEndKey(height int) KeyType {
+	return idxKey(histTagEnd, nil, heightPos(height))
+}
+
+func offsetData(off int64) DataType {
+	var v DataType
+	binary.LittleEndian.PutUint64(v[:8], uint64(off))
+	return v
+}
+
+// the offset the records of the height end at
+func historyEnd(idx *diskKV, height int) (int64, bool) {
+	v := idx.Get(historyEndKey(height))
+	off := int64(binary.LittleEndian.Uint64(v[:8]))
+	return off, off != 0
+}
+
+// add the record of the key at the height to the changes of the index
+func indexRecord(idx *diskKV, changes map[KeyType]DataType, k KeyType, height int, off int64) {
+	t := &idxTx{kv: idx, group: historyGroup(k), changes: changes}
+	if _, ok := t.load(t.rootSlot()); !ok && indexed(k) {
+		kt := &idxTx{kv: idx, group: k[1:33], changes: changes}
+		kt.insert(kt.rootSlot(), indexPos(k))
+	}
+	p := heightPos(height)
+	t.insert(t.rootSlot(), p)
+	changes[idxKey(histTagOffset, t.group, p)] = offsetData(off)
+}
+
+// remove the record of the key at the height from the index
+func unindexRecord(idx *diskKV, changes map[KeyType]DataType, k KeyType, height int) {
+	t := &idxTx{kv: idx, group: historyGroup(k), changes: changes}
+	p := heightPos(height)
+	t.remove(t.rootSlot(), p)
+	changes[idxKey(histTagOffset, t.group, p)] = DataType{}
+	if _, ok := t.load(t.rootSlot()); !ok && indexed(k) {
+		kt := &idxTx{kv: idx, group: k[1:33], changes: changes}
+		kt.remove(kt.rootSlot(), indexPos(k))
+	}
+}
+
+// read the records in [from, to) in order
+func readHistory(f *os.File, from, to int64, fn func(height int, k KeyType, v DataType) error) error {
+	r := bufio.NewReaderSize(io.NewSectionReader(f, from, to-from), historyReadBuffer)
+	rec := make([]byte, historyRecordLen)
+	var k KeyType
+	var v DataType
+	for off := from; off < to; off += historyRecordLen {
+		_, err := io.ReadFull(r, rec)
+		if err != nil {
+			return err
+		}
+		copy(k[:], rec[8:8+KeyLen])
+		copy(v[:], rec[8+KeyLen:])
+		err = fn(int(binary.LittleEndian.Uint64(rec[:8])), k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// each iterates over the full state at the height, to start archiving
+func openArchive(path string, height int, each func(fn func(k KeyType, v DataType)) error) (*archive, error) {
+	err := os.MkdirAll(filepath.Join(path, "perm"), 0o755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(path, "perm", "history"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	a := &archive{
+		f:    f,
+		path: filepath.Join(path, "perm", "history.index"),
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st.Size() < historyHeaderLen {
+		err = a.init(height, each)
+	} else {
+		err = a.load(st.Size(), height)
+	}
+	if err != nil {
+		if a.idx != nil {
+			a.idx.Close()
+		}
+		f.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *archive) init(height int, each func(fn func(k KeyType, v DataType)) error) error {
+	// the last archived height is below the start until the full state is
+	// written, so an interrupted start isn't taken as complete
+	buf := make([]byte, historyHeaderLen)
+	binary.LittleEndian.PutUint64(buf[:8], uint64(height))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(height-1))
+	_, err := a.f.WriteAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	os.Remove(a.path)
+	os.Remove(a.path + ".journal")
+	a.idx, err = openDiskKV(a.path, height-1, 0)
+	if err != nil {
+		return err
+	}
+	a.size = historyHeaderLen
+	a.start = height
+	a.top = height - 1
+	return a.appendEach(height, each)
+}
+
+// open the index, the records above the height of the root slice were
+// written before a crash and will be written again
+func (a *archive) load(size int64, rootHeight int) error {
+	buf := make([]byte, historyHeaderLen)
+	_, err := a.f.ReadAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	a.start = int(binary.LittleEndian.Uint64(buf[:8]))
+	top := int(binary.LittleEndian.Uint64(buf[8:]))
+	if a.start > rootHeight || top < rootHeight {
+		return fmt.Errorf("archive of heights %d-%d doesn't cover the root at %d, remove it to restart archiving", a.start, top, rootHeight)
+	}
+	if diskKVExists(a.path) {
+		a.idx, err = openDiskKV(a.path, 0, 0)
+		if err == nil {
+			err = a.dropIndex(size, rootHeight)
+		}
+		if err != nil && a.idx != nil {
+			a.idx.Close()
+			a.idx = nil
+		}
+	}
+	if a.idx == nil {
+		err = a.buildIndex(size, rootHeight)
+		if err != nil {
+			return fmt.Errorf("failed to build archive index: %v", err)
+		}
+	}
+	a.top = rootHeight
+	a.size, _ = historyEnd(a.idx, rootHeight)
+	return a.f.Truncate(a.size)
+}
+
+// drop the heights above the root from the index
+func (a *archive) dropIndex(size int64, rootHeight int) error {
+	height := a.idx.Height()
+	from, ok := historyEnd(a.idx, rootHeight)
+	to, ok2 := historyEnd(a.idx, height)
+	if height < rootHeight || !ok || !ok2 || to > size {
+		return errors.New("archive index doesn't match the history")
+	}
+	if height == rootHeight {
+		return nil
+	}
+	changes := make(map[KeyType]DataType)
+	err := readHistory(a.f, from, to, func(h int, k KeyType, v DataType) error {
+		unindexRecord(a.idx, changes, k, h)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for h := rootHeight + 1; h <= height; h++ {
+		changes[historyEndKey(h)] = DataType{}
+	}
+	return a.idx.Commit(rootHeight, changes)
+}
+
+// build the index of the records up to the height of the root
+func (a *archive) buildIndex(size int64, rootHeight int) error {
+	os.Remove(a.path + ".init")
+	os.Remove(a.path + ".init.journal")
+	idx, err := openDiskKV(a.path+".init", a.start-1, 0)
+	if err != nil {
+		return err
+	}
+	changes := make(map[KeyType]DataType)
+	last := a.start - 1
+	off := int64(historyHeaderLen)
+	stop := errors.New("stop")
+	err = readHistory(a.f, off, size-(size-historyHeaderLen)%historyRecordLen, func(h int, k KeyType, v DataType) error {
+		if h > rootHeight {
+			return stop
+		}
+		// the heights without records end where the next one starts
+		for ; last < h; last++ {
+			changes[historyEndKey(last)] = offsetData(off)
+		}
+		indexRecord(idx, changes, k, h, off+8+KeyLen)
+		off += historyRecordLen
+		if len(changes) >= idxBatchSize {
+			err := idx.Commit(last-1, changes)
+			changes = make(map[KeyType]DataType)
+			return err
+		}
+		return nil
+	})
+	if err == stop {
+		err = nil
+	}
+	for ; err == nil && last <= rootHeight; last++ {
+		changes[historyEndKey(last)] = offsetData(off)
+	}
+	if err == nil {
+		err = idx.Commit(rootHeight, changes)
+	}
+	if err == nil {
+		err = idx.rename(a.path)
+	}
+	if err != nil {
+		idx.Close()
+		return err
+	}
+	a.idx = idx
+	return nil
+}
+
+// append the changes at the height
+func (a *archive) append(height int, st map[KeyType]DataType) error {
+	return a.appendEach(height, func(fn func(k KeyType, v DataType)) error {
+		for k, v := range st {
+			fn(k, v)
+		}
+		return nil
+	})
+}
+
+func (a *archive) appendEach(height int, each func(fn func(k KeyType, v DataType)) error) error {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if height != a.top+1 {
+		return fmt.Errorf("archive height mismatch: %d after %d", height, a.top)
+	}
+	const bufLen = 4096 * historyRecordLen
+	buf := make([]byte, 0, bufLen)
+	rec := make([]byte, historyRecordLen)
+	binary.LittleEndian.PutUint64(rec[:8], uint64(height))
+	size := a.size
+	changes := make(map[KeyType]DataType)
+	var werr error
+	err := each(func(k KeyType, v DataType) {
+		if k[0] >= LocalKeyPrefix || werr != nil {
+			return
+		}
+		copy(rec[8:8+KeyLen], k[:])
+		copy(rec[8+KeyLen:], v[:])
+		buf = append(buf, rec...)
+		indexRecord(a.idx, changes, k, height, size+8+KeyLen)
+		size += historyRecordLen
+		if len(buf) == bufLen {
+			_, werr = a.f.WriteAt(buf, size-int64(len(buf)))
+			buf = buf[:0]
+		}
+		// the full state at the start is indexed in batches, a crash in the
+		// middle starts archiving again
+		if werr == nil && height == a.start && len(changes) >= idxBatchSize {
+			werr = a.idx.Commit(a.top, changes)
+			changes = make(map[KeyType]DataType)
+		}
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		_, err = a.f.WriteAt(buf, size-int64(len(buf)))
+	}
+	if err == nil {
+		changes[historyEndKey(height)] = offsetData(size)
+		err = a.idx.Commit(height, changes)
+	}
+	if err != nil {
+		return err
+	}
+	a.size = size
+	a.top = height
+	_, err = a.f.WriteAt(rec[:8], 8)
+	return err
+}
+
+func (a *archive) read(k KeyType, height int) (DataType, error) {
+	a.mut.RLock()
+	defer a.mut.RUnlock()
+	if height < a.start || height > a.top {
+		return DataType{}, ErrNotArchived
+	}
+	t := &idxTx{kv: a.idx, group: historyGroup(k), changes: map[KeyType]DataType{}}
+	p, ok := t.floor(heightPos(height))
+	if !ok {
+		return DataType{}, nil
+	}
+	ov := a.idx.Get(idxKey(histTagOffset, t.group, p))
+	var v DataType
+	_, err := a.f.ReadAt(v[:], int64(binary.LittleEndian.Uint64(ov[:8])))
+	if err != nil {
+		return DataType{}, err
+	}
+	return v, nil
+}
+
+// list the indexed keys with the prefix at the height like Slice.Iterate, the
+// prefix must be the first 33 bytes of the keys
+func (a *archive) list(prefix []byte, start KeyType, limit int, height int) ([]KeyValue, error) {
+	res := []KeyValue{}
+	for {
+		a.mut.RLock()
+		keys := listIndex(a.idx, prefix, start, limit)
+		a.mut.RUnlock()
+		for _, k := range keys {
+			v, err := a.read(k, height)
+			if err != nil {
+				return nil, err
+			}
+			if v != (DataType{}) {
+				res = append(res, KeyValue{Key: k, Value: v})
+			}
+		}
+		// the keys removed at the height are listed too, so list more of them
+		if limit < 0 || len(keys) < limit || len(res) >= limit {
+			break
+		}
+		next := keys[len(keys)-1]
+		i := KeyLen - 1
+		for ; i >= 33 && next[i] == 0xff; i-- {
+			next[i] = 0
+		}
+		if i < 33 {
+			break
+		}
+		next[i]++
+		start = next
+	}
+	if limit >= 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// scan the keys with the prefix at the height by reading the records up to it
+func (a *archive) scan(prefix []byte, height int, fn func(k KeyType, v DataType)) error {
+	a.mut.RLock()
+	ok := height >= a.start && height <= a.top
+	var end int64
+	if ok {
+		end, _ = historyEnd(a.idx, height)
+	}
+	a.mut.RUnlock()
+	if !ok {
+		return ErrNotArchived
+	}
+	// the records up to the height are never changed, and the later ones of a
+	// key are after them
+	found := make(map[KeyType]DataType)
+	err := readHistory(a.f, historyHeaderLen, end, func(h int, k KeyType, v DataType) error {
+		if bytes.HasPrefix(k[:], prefix) {
+			found[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range found {
+		fn(k, v)
+	}
+	return nil
+}
+
+func (a *archive) sync() error {
+	return a.f.Sync()
+}
+
+func (a *archive) close() {
+	a.idx.Close()
+	a.f.Close()
+}
+
+// read the key at a finalized height, which needs archive mode
+func (e *StorageEngine) ReadHistory(k KeyType, height int) (DataType, error) {
+	if e.archive == nil {
+		return DataType{}, errors.New("archive mode disabled")
+	}
+	return e.archive.read(k, height)
+}
+
+// a read-only slice of the state at a finalized height, which needs archive mode
+func (e *StorageEngine) HistorySlice(height int) (*Slice, error) {
+	if e.archive == nil {
+		return nil, errors.New("archive mode disabled")
+	}
+	a := e.archive
+	a.mut.RLock()
+	ok := height >= a.start && height <= a.top
+	a.mut.RUnlock()
+	if !ok {
+		return nil, ErrNotArchived
+	}
+	s := EmptySlice()
+	s.height = height
+	s.reader = func(k KeyType) DataType {
+		v, _ := a.read(k, height)
+		return v
+	}
+	s.scan = func(prefix []byte, fn func(k KeyType, v DataType)) error {
+		return a.scan(prefix, height, fn)
+	}
+	s.list = func(prefix []byte, start KeyType, limit int) ([]KeyValue, error) {
+		if len(prefix) != 33 || prefix[0] != IndexedKeyPrefix {
+			return listByScan(s.scan, prefix, start, limit)
+		}
+		return a.list(prefix, start, limit, height)
+	}
+	s.Freeze()
+	return s, nil
+}
@@ -0,0 +1,46 @@
+package storage
+
+// Backend persists the storage engine: the data of finalized slices by height,
+// the state of the root slice, and the slices not finalized yet
+type Backend interface {
+	// height of the stored root state, -1 if nothing is stored yet
+	StateHeight() int
+	ReadState(k KeyType) DataType
+	// iterate over the keys with the prefix in the stored root state, in no
+	// particular order
+	ForEachState(prefix []byte, fn func(k KeyType, v DataType)) error
+	// list the keys with the prefix in the stored root state from start on in
+	// ascending order, at most limit of them (no limit if negative), without
+	// scanning the whole state if the prefix is a contract (see index.go)
+	IterateState(prefix []byte, start KeyType, limit int) ([]KeyValue, error)
+	// write the changes of the root state and its new height, keys with zero
+	// values are deleted
+	CommitState(height int, st map[KeyType]DataType) error
+
+	// write the keys and data of the slices from the height on, the data of
+	// larger heights stored before is dropped
+	WriteData(height int, keys []SliceKeyType, data [][]byte) error
+	ReadKey(height int) (SliceKeyType, error)
+	ReadData(height int) ([]byte, error)
+
+	// append an entry to the write-ahead log, and sync it
+	AppendLog(l *LogEntry) error
+	// the complete entries of the log, a partial one at the end is dropped
+	ReadLog() ([]*LogEntry, error)
+	ClearLog() error
+
+	StoreTemp(t *TempSlice) error
+	// load the stored temp slices, their bases are not set
+	LoadTemps() ([]*TempSlice, error)
+	RemoveTemp(k SliceKeyType) error
+
+	Close() error
+}
+
+// a slice not finalized yet, with the key of its parent and its data
+type TempSlice struct {
+	Key    SliceKeyType
+	Parent SliceKeyType
+	S      *Slice
+	Data   []byte
+}
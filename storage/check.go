@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type CheckConfig struct {
+	// check every record in perm/datapos, instead of only the root one
+	Full bool
+	// truncate dangling tails and remove broken or stale temp slices
+	Repair bool
+	// check the data of a record against its key, e.g. the block hash
+	CheckData func(key SliceKeyType, data []byte) error
+}
+
+type CheckReport struct {
+	// height of the root state, -1 if the storage is empty
+	StateHeight int
+	// number of records up to the state height
+	Records int
+	// inconsistencies left, the storage can't be loaded if there are any
+	Problems []string
+	// inconsistencies found and repaired (or to be repaired, if not in repair mode)
+	Repairable []string
+}
+
+func (r *CheckReport) problem(format string, a ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, a...))
+}
+
+func (r *CheckReport) repairable(format string, a ...interface{}) {
+	r.Repairable = append(r.Repairable, fmt.Sprintf(format, a...))
+}
+
+// height of the root state stored in the file backend at the path, -1 if there
+// isn't one
+func storedStateHeight(path string) (int, error) {
+	stateFn := filepath.Join(path, "perm", "state")
+	if diskKVExists(stateFn) {
+		f, err := os.Open(stateFn)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		buf := make([]byte, diskKVHeaderLen)
+		_, err = io.ReadFull(f, buf)
+		if err != nil || string(buf[:8]) != diskKVMagic {
+			return 0, fmt.Errorf("invalid state file: %v", err)
+		}
+		h := int(binary.LittleEndian.Uint64(buf[8:16]))
+		// a complete journal is applied on startup
+		if jh, _, err := readJournal(stateFn + ".journal"); err == nil {
+			h = jh
+		}
+		return h, nil
+	}
+	ssFn := filepath.Join(path, "perm", "ss")
+	if diskKVExists(ssFn) {
+		f, err := os.Open(ssFn)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		buf := make([]byte, 8)
+		_, err = io.ReadFull(f, buf)
+		if err != nil {
+			return 0, fmt.Errorf("invalid root dump: %v", err)
+		}
+		return int(binary.LittleEndian.Uint64(buf)), nil
+	}
+	return -1, nil
+}
+
+// check that the files of the file backend at the path agree with each other
+func CheckFileStorage(path string, config CheckConfig) (*CheckReport, error) {
+	r := &CheckReport{}
+	if compactionInterrupted(path) {
+		r.repairable("interrupted compaction")
+		if !config.Repair {
+			return r, nil
+		}
+		err := finishCompaction(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	r.StateHeight, err = storedStateHeight(path)
+	if err != nil {
+		r.problem("%v", err)
+		return r, nil
+	}
+	flag := os.O_RDONLY
+	if config.Repair {
+		flag = os.O_RDWR
+	}
+	fData, err := os.OpenFile(filepath.Join(path, "perm", "data"), flag, 0)
+	if os.IsNotExist(err) && r.StateHeight == -1 {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fData.Close()
+	fDataPos, err := os.OpenFile(filepath.Join(path, "perm", "datapos"), flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fDataPos.Close()
+	st, err := fDataPos.Stat()
+	if err != nil {
+		return nil, err
+	}
+	posSize := st.Size()
+	st, err = fData.Stat()
+	if err != nil {
+		return nil, err
+	}
+	dataSize := st.Size()
+
+	// the records above the root are written before the root state, and
+	// written again after restarting
+	n := int(posSize / SliceDataPosLen)
+	if posSize%SliceDataPosLen != 0 {
+		r.repairable("partial record at the end of datapos")
+	}
+	if n < r.StateHeight+1 {
+		r.problem("datapos ends at height %d, below the state height %d", n-1, r.StateHeight)
+		return r, nil
+	}
+	if n > r.StateHeight+1 {
+		r.repairable("%d records above the state height %d", n-r.StateHeight-1, r.StateHeight)
+		n = r.StateHeight + 1
+	}
+	r.Records = n
+
+	from := 0
+	if !config.Full && n > 0 {
+		from = n - 1
+	}
+	td := make([]byte, SliceDataPosLen*1024)
+	var end int64
+	prevStored := false
+	for h := from; h < n; {
+		cnt := n - h
+		if cnt > 1024 {
+			cnt = 1024
+		}
+		_, err = fDataPos.ReadAt(td[:cnt*SliceDataPosLen], int64(h*SliceDataPosLen))
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < cnt; i, h = i+1, h+1 {
+			p := td[i*SliceDataPosLen : (i+1)*SliceDataPosLen]
+			off := int64(binary.LittleEndian.Uint64(p[:8]))
+			length := int64(binary.LittleEndian.Uint64(p[8:16]))
+			var key SliceKeyType
+			copy(key[:], p[16:])
+			if length == 0 && key == (SliceKeyType{}) {
+				// below a snapshot
+				if h == r.StateHeight {
+					r.problem("record of the state height %d not stored", h)
+				}
+				prevStored = false
+				continue
+			}
+			if off < 0 || length < 0 || off+length > dataSize {
+				r.problem("record of height %d out of the data file", h)
+				prevStored = false
+				continue
+			}
+			if prevStored && off != end {
+				r.problem("record of height %d at %d, but the last one ends at %d", h, off, end)
+			}
+			end = off + length
+			prevStored = true
+			if config.CheckData != nil {
+				d := make([]byte, length)
+				_, err = fData.ReadAt(d, off)
+				if err != nil {
+					return nil, err
+				}
+				err = config.CheckData(key, d)
+				if err != nil {
+					r.problem("invalid data of height %d (%s): %v", h, hex.EncodeToString(key[:]), err)
+				}
+			}
+		}
+	}
+	if len(r.Problems) > 0 {
+		return r, nil
+	}
+	// the record of the state height ends the data file
+	if dataSize > end {
+		r.repairable("%d bytes of data above the state height", dataSize-end)
+	}
+	if config.Repair {
+		err = fDataPos.Truncate(int64(n * SliceDataPosLen))
+		if err != nil {
+			return nil, err
+		}
+		err = fData.Truncate(end)
+		if err != nil {
+			return nil, err
+		}
+		if r.StateHeight == -1 {
+			os.Remove(filepath.Join(path, "perm", "state.init"))
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(path, "temp"))
+	if err != nil {
+		return r, nil
+	}
+	for _, file := range files {
+		name := file.Name()
+		if len(name) == SliceKeyLen*2+2 && name[SliceKeyLen*2:] == ".b" {
+			if _, err := os.Stat(filepath.Join(path, "temp", name[:SliceKeyLen*2])); err != nil {
+				r.repairable("temp slice %s without the slice", name[:SliceKeyLen*2])
+				if config.Repair {
+					os.Remove(filepath.Join(path, "temp", name))
+				}
+			}
+			continue
+		}
+		if len(name) != SliceKeyLen*2 {
+			continue
+		}
+		fn := filepath.Join(path, "temp", name)
+		height, err := tempSliceHeight(fn)
+		if err == nil {
+			var d []byte
+			d, err = ioutil.ReadFile(fn + ".b")
+			if err == nil && len(d) < SliceKeyLen {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if err != nil {
+			r.repairable("broken temp slice %s: %v", name, err)
+		} else if height < r.StateHeight {
+			r.repairable("temp slice %s at height %d already finalized", name, height)
+		} else {
+			// the one at the state height is the root, removed after the next store
+			continue
+		}
+		if config.Repair {
+			os.Remove(fn)
+			os.Remove(fn + ".b")
+		}
+	}
+	return r, nil
+}
+
+// the height of a temp slice, the file is checked to be complete
+func tempSliceHeight(fn string) (int, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 16)
+	_, err = io.ReadFull(f, buf)
+	if err != nil {
+		return 0, err
+	}
+	cnt := int64(binary.LittleEndian.Uint64(buf[8:]))
+	if st.Size() != 16+cnt*(KeyLen+DataLen) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(binary.LittleEndian.Uint64(buf[:8])), nil
+}
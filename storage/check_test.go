@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckFileStorage(t *testing.T) {
+	config := StorageEngineConfig{
+		FinalizeDepth: 3,
+		DumpDiskRatio: 0.8,
+		Path:          "/tmp/tcoin_test/sto_test_check",
+	}
+	err := os.RemoveAll(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := EmptySlice()
+	is.Write(KeyType{1}, DataType{1})
+	e, err := NewStorageEngine(config, is, SliceKeyType{}, []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := SliceKeyType{}
+	for i := 1; i <= 10; i++ {
+		s := ForkSlice(e.ss[cur])
+		s.Write(KeyType{2, byte(i)}, DataType{byte(i)})
+		s.Freeze()
+		sk := SliceKeyType{byte(i)}
+		err = e.AddFreezedSlice(s, sk, cur, []byte{byte(i), 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur = sk
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Stop()
+
+	cc := CheckConfig{
+		Full: true,
+		CheckData: func(key SliceKeyType, data []byte) error {
+			if key[0] != data[0] {
+				return errors.New("key mismatch")
+			}
+			return nil
+		},
+	}
+	r, err := CheckFileStorage(config.Path, cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StateHeight != 7 || r.Records != 8 || len(r.Problems) != 0 || len(r.Repairable) != 0 {
+		t.Fatalf("wrong report of a clean storage: %+v", r)
+	}
+
+	// dangling tails, as if the process died while storing the root
+	appendFile := func(name string, d []byte) {
+		f, err := os.OpenFile(config.Path+"/"+name, os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	appendFile("perm/datapos", make([]byte, SliceDataPosLen*2+5))
+	appendFile("perm/data", []byte{1, 2, 3})
+	f, err := os.Create(config.Path + "/temp/" + strings.Repeat("0", SliceKeyLen*2-2) + "ff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2})
+	f.Close()
+	r, err = CheckFileStorage(config.Path, cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || len(r.Repairable) != 4 {
+		t.Fatalf("wrong report: %+v", r)
+	}
+	cc.Repair = true
+	_, err = CheckFileStorage(config.Path, cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Repair = false
+	r, err = CheckFileStorage(config.Path, cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || len(r.Repairable) != 0 {
+		t.Fatalf("not repaired: %+v", r)
+	}
+	e, err = NewStorageEngine(config, is, SliceKeyType{}, []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Head().Slice.Height() != 10 || e.Head().Slice.Read(KeyType{2, 10}) != (DataType{10}) {
+		t.Fatal("wrong state after repairing")
+	}
+	e.Stop()
+
+	cc.CheckData = func(key SliceKeyType, data []byte) error {
+		if data[0] == 5 {
+			return errors.New("bad block")
+		}
+		return nil
+	}
+	r, err = CheckFileStorage(config.Path, cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 1 {
+		t.Fatalf("bad record not found: %+v", r)
+	}
+	err = os.Truncate(config.Path+"/perm/datapos", SliceDataPosLen*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = CheckFileStorage(config.Path, CheckConfig{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 1 {
+		t.Fatalf("missing records not found: %+v", r)
+	}
+}
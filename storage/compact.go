@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Compaction rewrites perm/data and perm/datapos into perm/data.compact and
+// perm/datapos.compact. Once both are complete, perm/compact.done is created
+// and they are renamed over the old files, so an interrupted compaction is
+// either dropped or finished later.
+const compactDoneName = "compact.done"
+
+// the heights below it are compacted, so they aren't read again
+const compactHeightName = "compact.height"
+
+// the height below which the storage at the path is compacted
+func CompactedHeight(path string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(path, "perm", compactHeightName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, errors.New("invalid compacted height")
+	}
+	return int(binary.LittleEndian.Uint64(b)), nil
+}
+
+func writeCompactedHeight(path string, height int) error {
+	fn := filepath.Join(path, "perm", compactHeightName)
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(height))
+	err := ioutil.WriteFile(fn+".tmp", b, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+func compactionInterrupted(path string) bool {
+	perm := filepath.Join(path, "perm")
+	return diskKVExists(filepath.Join(perm, "data.compact")) || diskKVExists(filepath.Join(perm, "datapos.compact")) ||
+		diskKVExists(filepath.Join(perm, compactDoneName))
+}
+
+// finish or drop an interrupted compaction
+func finishCompaction(path string) error {
+	perm := filepath.Join(path, "perm")
+	done := filepath.Join(perm, compactDoneName)
+	if !diskKVExists(done) {
+		os.Remove(filepath.Join(perm, "data.compact"))
+		os.Remove(filepath.Join(perm, "datapos.compact"))
+		return nil
+	}
+	for _, name := range []string{"data", "datapos"} {
+		fn := filepath.Join(perm, name)
+		if diskKVExists(fn + ".compact") {
+			err := os.Rename(fn+".compact", fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(done)
+}
+
+// rewrite the data of the heights below the given one with prune, which returns
+// the data to keep, e.g. without the block body, the heights compacted before
+// are skipped. The storage must not be in use. Returns the number of bytes saved.
+func CompactFileStorage(path string, below int, prune func(key SliceKeyType, data []byte) ([]byte, error)) (int64, error) {
+	err := finishCompaction(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to finish last compaction: %v", err)
+	}
+	stateHeight, err := storedStateHeight(path)
+	if err != nil {
+		return 0, err
+	}
+	if below > stateHeight {
+		return 0, errors.New("can't compact above the state height")
+	}
+	from, err := CompactedHeight(path)
+	if err != nil {
+		return 0, err
+	}
+	if below <= from {
+		return 0, nil
+	}
+	perm := filepath.Join(path, "perm")
+	fData, err := os.Open(filepath.Join(perm, "data"))
+	if err != nil {
+		return 0, err
+	}
+	defer fData.Close()
+	fDataPos, err := os.Open(filepath.Join(perm, "datapos"))
+	if err != nil {
+		return 0, err
+	}
+	defer fDataPos.Close()
+	st, err := fDataPos.Stat()
+	if err != nil {
+		return 0, err
+	}
+	n := int(st.Size() / SliceDataPosLen)
+	if n != stateHeight+1 {
+		return 0, errors.New("datapos doesn't end at the state height, check the storage first")
+	}
+	pos := make([]byte, n*SliceDataPosLen)
+	_, err = io.ReadFull(fDataPos, pos)
+	if err != nil {
+		return 0, err
+	}
+
+	newData := make(map[int][]byte)
+	var saved int64
+	for h := from; h < below; h++ {
+		p := pos[h*SliceDataPosLen : (h+1)*SliceDataPosLen]
+		off := int64(binary.LittleEndian.Uint64(p[:8]))
+		length := int64(binary.LittleEndian.Uint64(p[8:16]))
+		var key SliceKeyType
+		copy(key[:], p[16:])
+		if length == 0 && key == (SliceKeyType{}) {
+			continue
+		}
+		d := make([]byte, length)
+		_, err = fData.ReadAt(d, off)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read data of height %d: %v", h, err)
+		}
+		nd, err := prune(key, d)
+		if err != nil {
+			return 0, fmt.Errorf("failed to prune data of height %d: %v", h, err)
+		}
+		if len(nd) < len(d) {
+			newData[h] = nd
+			saved += int64(len(d) - len(nd))
+		}
+	}
+	// the files are only rewritten if something is pruned
+	if len(newData) == 0 {
+		return 0, writeCompactedHeight(path, below)
+	}
+
+	fNewData, err := os.Create(filepath.Join(perm, "data.compact"))
+	if err != nil {
+		return 0, err
+	}
+	defer fNewData.Close()
+	w := bufio.NewWriter(fNewData)
+	var cur int64
+	for h := 0; h < n; h++ {
+		p := pos[h*SliceDataPosLen : (h+1)*SliceDataPosLen]
+		off := int64(binary.LittleEndian.Uint64(p[:8]))
+		length := int64(binary.LittleEndian.Uint64(p[8:16]))
+		var key SliceKeyType
+		copy(key[:], p[16:])
+		if length == 0 && key == (SliceKeyType{}) {
+			continue
+		}
+		if d, ok := newData[h]; ok {
+			_, err = w.Write(d)
+			length = int64(len(d))
+		} else {
+			_, err = io.Copy(w, io.NewSectionReader(fData, off, length))
+		}
+		if err != nil {
+			return 0, err
+		}
+		binary.LittleEndian.PutUint64(p[:8], uint64(cur))
+		binary.LittleEndian.PutUint64(p[8:16], uint64(length))
+		cur += length
+	}
+	err = w.Flush()
+	if err == nil {
+		err = fNewData.Sync()
+	}
+	if err != nil {
+		return 0, err
+	}
+	fNewDataPos, err := os.Create(filepath.Join(perm, "datapos.compact"))
+	if err != nil {
+		return 0, err
+	}
+	defer fNewDataPos.Close()
+	_, err = fNewDataPos.Write(pos)
+	if err == nil {
+		err = fNewDataPos.Sync()
+	}
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Create(filepath.Join(perm, compactDoneName))
+	if err != nil {
+		return 0, err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	err = finishCompaction(path)
+	if err == nil {
+		err = writeCompactedHeight(path, below)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return saved, nil
+}
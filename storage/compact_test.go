@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCompactFileStorage(t *testing.T) {
+	config := StorageEngineConfig{
+		FinalizeDepth: 3,
+		DumpDiskRatio: 0.8,
+		Path:          "/tmp/tcoin_test/sto_test_compact",
+	}
+	err := os.RemoveAll(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := EmptySlice()
+	is.Write(KeyType{1}, DataType{1})
+	body := bytes.Repeat([]byte{7}, 100)
+	e, err := NewStorageEngine(config, is, SliceKeyType{}, append([]byte{0}, body...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := SliceKeyType{}
+	add := func(i int) {
+		s := ForkSlice(e.ss[cur])
+		s.Freeze()
+		sk := SliceKeyType{byte(i)}
+		err := e.AddFreezedSlice(s, sk, cur, append([]byte{byte(i)}, body...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur = sk
+	}
+	for i := 1; i <= 10; i++ {
+		add(i)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Stop()
+
+	// keep the first byte of the heights below 5
+	prune := func(key SliceKeyType, data []byte) ([]byte, error) {
+		return data[:1], nil
+	}
+	saved, err := CompactFileStorage(config.Path, 5, prune)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != 5*100 {
+		t.Fatalf("wrong bytes saved %d", saved)
+	}
+	// nothing left to prune, and the compacted heights aren't read again
+	if h, err := CompactedHeight(config.Path); err != nil || h != 5 {
+		t.Fatalf("wrong compacted height %d: %v", h, err)
+	}
+	saved, err = CompactFileStorage(config.Path, 5, func(key SliceKeyType, data []byte) ([]byte, error) {
+		t.Fatal("compacted height read again")
+		return nil, nil
+	})
+	if err != nil || saved != 0 {
+		t.Fatalf("compacted twice: %d %v", saved, err)
+	}
+	_, err = CompactFileStorage(config.Path, 8, prune)
+	if err == nil {
+		t.Fatal("compacted above the state height")
+	}
+	r, err := CheckFileStorage(config.Path, CheckConfig{Full: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || len(r.Repairable) != 0 {
+		t.Fatalf("storage inconsistent after compaction: %+v", r)
+	}
+
+	e, err = NewStorageEngine(config, is, SliceKeyType{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur = SliceKeyType{10}
+	for i := 11; i <= 12; i++ {
+		add(i)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := 0; h <= 9; h++ {
+		d, err := e.backend.ReadData(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d[0] != byte(h) || (h < 5) != (len(d) == 1) {
+			t.Fatalf("wrong data of height %d", h)
+		}
+	}
+	e.Stop()
+
+	// an incomplete compaction is dropped, a complete one is finished
+	err = ioutil.WriteFile(config.Path+"/perm/data.compact", []byte{1}, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = CheckFileStorage(config.Path, CheckConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Repairable) != 1 {
+		t.Fatalf("interrupted compaction not found: %+v", r)
+	}
+	b, err := NewFileBackend(config.Path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.StateHeight() != 9 || compactionInterrupted(config.Path) {
+		t.Fatal("incomplete compaction not dropped")
+	}
+	b.Close()
+	d, err := ioutil.ReadFile(config.Path + "/perm/datapos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(config.Path+"/perm/datapos.compact", d[:len(d)-SliceDataPosLen], 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(config.Path+"/perm/"+compactDoneName, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = finishCompaction(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(config.Path + "/perm/datapos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != int64(len(d)-SliceDataPosLen) || compactionInterrupted(config.Path) {
+		t.Fatal("complete compaction not finished")
+	}
+}
@@ -0,0 +1,534 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// The state of the root slice is kept in perm/state, an on-disk hash table
+// with linear probing, so it doesn't have to be kept in memory.
+// The file starts with a header (magic, height, slot count, key count), then
+// the slots, each of which is a used flag, the key and the value.
+// A batch of changes is first written to a journal, so a crash in the middle
+// of applying it can be recovered by applying it again.
+const diskKVMagic = "tcoinkv1"
+const diskKVHeaderLen = 32
+const diskKVSlotLen = 1 + KeyLen + DataLen
+const diskKVMinSlots = 1 << 12
+const diskKVReadSlots = 16
+
+const DefaultStateCacheSize = 1 << 16
+
+// reads share mut, and scans only hold it to read each chunk, so a long scan
+// holds up neither the reads nor the commits
+type diskKV struct {
+	path   string
+	f      *os.File
+	height int
+	slots  uint64
+	count  uint64
+	cache  *kvCache
+	mut    sync.RWMutex
+}
+
+func diskKVExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func createDiskKV(path string, height int, slots uint64) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(int64(diskKVHeaderLen + slots*diskKVSlotLen))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	err = writeDiskKVHeader(f, height, slots, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func writeDiskKVHeader(f *os.File, height int, slots, count uint64) error {
+	buf := make([]byte, diskKVHeaderLen)
+	copy(buf[:8], diskKVMagic)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(height))
+	binary.LittleEndian.PutUint64(buf[16:24], slots)
+	binary.LittleEndian.PutUint64(buf[24:32], count)
+	_, err := f.WriteAt(buf, 0)
+	return err
+}
+
+// open the table at the path, or create an empty one at the height
+func openDiskKV(path string, height int, cacheSize int) (*diskKV, error) {
+	if cacheSize <= 0 {
+		cacheSize = DefaultStateCacheSize
+	}
+	kv := &diskKV{
+		path:  path,
+		cache: newKVCache(cacheSize),
+	}
+	if !diskKVExists(path) {
+		f, err := createDiskKV(path+".next", height, diskKVMinSlots)
+		if err != nil {
+			return nil, err
+		}
+		err = f.Sync()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.Close()
+		err = os.Rename(path+".next", path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	kv.f = f
+	buf := make([]byte, diskKVHeaderLen)
+	_, err = f.ReadAt(buf, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if string(buf[:8]) != diskKVMagic {
+		f.Close()
+		return nil, errors.New("invalid state file")
+	}
+	kv.height = int(binary.LittleEndian.Uint64(buf[8:16]))
+	kv.slots = binary.LittleEndian.Uint64(buf[16:24])
+	kv.count = binary.LittleEndian.Uint64(buf[24:32])
+	err = kv.replayJournal()
+	if err != nil {
+		kv.f.Close()
+		return nil, err
+	}
+	return kv, nil
+}
+
+func (kv *diskKV) Height() int {
+	kv.mut.RLock()
+	defer kv.mut.RUnlock()
+	return kv.height
+}
+
+func kvHash(k KeyType) uint64 {
+	h := fnv.New64a()
+	h.Write(k[:])
+	return h.Sum64()
+}
+
+// find the slot of the key, or the empty slot to put it
+func (kv *diskKV) find(f *os.File, slots uint64, k KeyType) (uint64, bool, DataType, error) {
+	buf := make([]byte, diskKVSlotLen*diskKVReadSlots)
+	pos := kvHash(k) % slots
+	for i := uint64(0); i < slots; {
+		n := uint64(diskKVReadSlots)
+		if pos+n > slots {
+			n = slots - pos
+		}
+		_, err := f.ReadAt(buf[:n*diskKVSlotLen], int64(diskKVHeaderLen+pos*diskKVSlotLen))
+		if err != nil {
+			return 0, false, DataType{}, err
+		}
+		for j := uint64(0); j < n; j++ {
+			sb := buf[j*diskKVSlotLen : (j+1)*diskKVSlotLen]
+			if sb[0] == 0 {
+				return pos + j, false, DataType{}, nil
+			}
+			if bytes.Equal(sb[1:1+KeyLen], k[:]) {
+				var v DataType
+				copy(v[:], sb[1+KeyLen:])
+				return pos + j, true, v, nil
+			}
+		}
+		i += n
+		pos = (pos + n) % slots
+	}
+	return 0, false, DataType{}, errors.New("state file full")
+}
+
+func (kv *diskKV) Get(k KeyType) DataType {
+	kv.mut.RLock()
+	defer kv.mut.RUnlock()
+	if v, ok := kv.cache.get(k); ok {
+		return v
+	}
+	_, _, v, err := kv.find(kv.f, kv.slots, k)
+	if err != nil {
+		// a missing value would silently fork the state
+		panic(fmt.Errorf("failed to read state: %v", err))
+	}
+	kv.cache.put(k, v)
+	return v
+}
+
+func putSlot(f *os.File, slots uint64, k KeyType, v DataType, find func(*os.File, uint64, KeyType) (uint64, bool, DataType, error)) (bool, error) {
+	pos, found, _, err := find(f, slots, k)
+	if err != nil {
+		return false, err
+	}
+	buf := make([]byte, diskKVSlotLen)
+	buf[0] = 1
+	copy(buf[1:1+KeyLen], k[:])
+	copy(buf[1+KeyLen:], v[:])
+	_, err = f.WriteAt(buf, int64(diskKVHeaderLen+pos*diskKVSlotLen))
+	return !found, err
+}
+
+// iterate over all keys, in no particular order, the lock is only held to read
+// each chunk, so a commit in the middle may be seen in part, and the scan
+// fails if the table is rebuilt meanwhile
+func (kv *diskKV) ForEach(fn func(k KeyType, v DataType)) error {
+	kv.mut.RLock()
+	f, slots := kv.f, kv.slots
+	kv.mut.RUnlock()
+	return forEachSlot(func(b []byte, off int64) error {
+		kv.mut.RLock()
+		defer kv.mut.RUnlock()
+		if kv.f != f {
+			return errors.New("state file rebuilt during the scan")
+		}
+		_, err := f.ReadAt(b, off)
+		return err
+	}, slots, fn)
+}
+
+func fileReader(f *os.File) func(b []byte, off int64) error {
+	return func(b []byte, off int64) error {
+		_, err := f.ReadAt(b, off)
+		return err
+	}
+}
+
+func forEachSlot(readAt func(b []byte, off int64) error, slots uint64, fn func(k KeyType, v DataType)) error {
+	const chunk = 4096
+	buf := make([]byte, diskKVSlotLen*chunk)
+	var k KeyType
+	var v DataType
+	for pos := uint64(0); pos < slots; pos += chunk {
+		n := uint64(chunk)
+		if pos+n > slots {
+			n = slots - pos
+		}
+		err := readAt(buf[:n*diskKVSlotLen], int64(diskKVHeaderLen+pos*diskKVSlotLen))
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < n; j++ {
+			sb := buf[j*diskKVSlotLen : (j+1)*diskKVSlotLen]
+			if sb[0] == 0 {
+				continue
+			}
+			copy(k[:], sb[1:1+KeyLen])
+			copy(v[:], sb[1+KeyLen:])
+			fn(k, v)
+		}
+	}
+	return nil
+}
+
+// write the changes and the new height, which is atomic
+func (kv *diskKV) Commit(height int, st map[KeyType]DataType) error {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	err := writeJournal(kv.path+".journal", height, st)
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	err = kv.apply(height, st)
+	if err != nil {
+		return err
+	}
+	return os.Remove(kv.path + ".journal")
+}
+
+func (kv *diskKV) apply(height int, st map[KeyType]DataType) error {
+	if (kv.count+uint64(len(st)))*10 > kv.slots*7 {
+		err := kv.grow(kv.count + uint64(len(st)))
+		if err != nil {
+			return fmt.Errorf("failed to grow state file: %v", err)
+		}
+	}
+	for k, v := range st {
+		if v == (DataType{}) {
+			removed, err := kv.remove(k)
+			if err != nil {
+				return err
+			}
+			if removed {
+				kv.count--
+			}
+		} else {
+			added, err := putSlot(kv.f, kv.slots, k, v, kv.find)
+			if err != nil {
+				return err
+			}
+			if added {
+				kv.count++
+			}
+		}
+		kv.cache.put(k, v)
+	}
+	err := writeDiskKVHeader(kv.f, height, kv.slots, kv.count)
+	if err != nil {
+		return err
+	}
+	err = kv.f.Sync()
+	if err != nil {
+		return err
+	}
+	kv.height = height
+	return nil
+}
+
+// remove the key, the keys after it in the same run are moved back so that
+// they can still be found
+func (kv *diskKV) remove(k KeyType) (bool, error) {
+	hole, found, _, err := kv.find(kv.f, kv.slots, k)
+	if err != nil || !found {
+		return false, err
+	}
+	buf := make([]byte, diskKVSlotLen)
+	var t KeyType
+	for i := uint64(1); i < kv.slots; i++ {
+		pos := (hole + i) % kv.slots
+		_, err = kv.f.ReadAt(buf, int64(diskKVHeaderLen+pos*diskKVSlotLen))
+		if err != nil {
+			return false, err
+		}
+		if buf[0] == 0 {
+			break
+		}
+		copy(t[:], buf[1:1+KeyLen])
+		home := kvHash(t) % kv.slots
+		// the key can be moved if the hole is between its home and it
+		if (pos+kv.slots-home)%kv.slots >= i {
+			_, err = kv.f.WriteAt(buf, int64(diskKVHeaderLen+hole*diskKVSlotLen))
+			if err != nil {
+				return false, err
+			}
+			hole = pos
+			i = 0
+		}
+	}
+	_, err = kv.f.WriteAt(make([]byte, diskKVSlotLen), int64(diskKVHeaderLen+hole*diskKVSlotLen))
+	return true, err
+}
+
+// rehash into a table with enough slots for n keys
+func (kv *diskKV) grow(n uint64) error {
+	slots := kv.slots
+	for n*10 > slots*7 {
+		slots *= 2
+	}
+	return kv.rehash(slots)
+}
+
+// copy the keys into a new table with the slots, which also drops the zero
+// values left by older versions and the keys duplicated by an interrupted
+// remove
+func (kv *diskKV) rehash(slots uint64) error {
+	f, err := createDiskKV(kv.path+".next", kv.height, slots)
+	if err != nil {
+		return err
+	}
+	var werr error
+	var count uint64
+	err = forEachSlot(fileReader(kv.f), kv.slots, func(k KeyType, v DataType) {
+		if werr == nil && v != (DataType{}) {
+			var added bool
+			added, werr = putSlot(f, slots, k, v, kv.find)
+			if added {
+				count++
+			}
+		}
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = writeDiskKVHeader(f, kv.height, slots, count)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = os.Rename(kv.path+".next", kv.path)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	kv.f.Close()
+	kv.f = f
+	kv.slots = slots
+	kv.count = count
+	return nil
+}
+
+// the journal is the height, the number of changes, the changes and the
+// sha256 of all of them
+func writeJournal(path string, height int, st map[KeyType]DataType) error {
+	var buf bytes.Buffer
+	tmp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tmp, uint64(height))
+	buf.Write(tmp)
+	binary.LittleEndian.PutUint64(tmp, uint64(len(st)))
+	buf.Write(tmp)
+	for k, v := range st {
+		buf.Write(k[:])
+		buf.Write(v[:])
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readJournal(path string) (int, map[KeyType]DataType, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(d) < 16+HashLen {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	sum := sha256.Sum256(d[:len(d)-HashLen])
+	if !bytes.Equal(sum[:], d[len(d)-HashLen:]) {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	height := int(binary.LittleEndian.Uint64(d[:8]))
+	n := binary.LittleEndian.Uint64(d[8:16])
+	if uint64(len(d)-16-HashLen) != n*(KeyLen+DataLen) {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	st := make(map[KeyType]DataType, n)
+	var k KeyType
+	var v DataType
+	for p := 16; p < len(d)-HashLen; p += KeyLen + DataLen {
+		copy(k[:], d[p:p+KeyLen])
+		copy(v[:], d[p+KeyLen:p+KeyLen+DataLen])
+		st[k] = v
+	}
+	return height, st, nil
+}
+
+// apply a complete journal left by a crash, an incomplete one was never
+// committed
+func (kv *diskKV) replayJournal() error {
+	jp := kv.path + ".journal"
+	if !diskKVExists(jp) {
+		return nil
+	}
+	height, st, err := readJournal(jp)
+	if err == nil {
+		// some of the changes may be written already, so the table is rebuilt
+		// to count the keys again
+		err = kv.rehash(kv.slots)
+		if err == nil {
+			err = kv.apply(height, st)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replay journal: %v", err)
+		}
+	}
+	return os.Remove(jp)
+}
+
+func (kv *diskKV) rename(path string) error {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	err := os.Rename(kv.path, path)
+	if err != nil {
+		return err
+	}
+	kv.path = path
+	return nil
+}
+
+func (kv *diskKV) Close() error {
+	kv.mut.Lock()
+	defer kv.mut.Unlock()
+	return kv.f.Close()
+}
+
+// a LRU cache of the values read, it has its own lock as the reads sharing
+// the lock of the table all update it
+type kvCache struct {
+	size int
+	l    *list.List
+	m    map[KeyType]*list.Element
+	mut  sync.Mutex
+}
+
+type kvCacheEntry struct {
+	k KeyType
+	v DataType
+}
+
+func newKVCache(size int) *kvCache {
+	return &kvCache{
+		size: size,
+		l:    list.New(),
+		m:    make(map[KeyType]*list.Element),
+	}
+}
+
+func (c *kvCache) get(k KeyType) (DataType, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	e, ok := c.m[k]
+	if !ok {
+		return DataType{}, false
+	}
+	c.l.MoveToFront(e)
+	return e.Value.(*kvCacheEntry).v, true
+}
+
+func (c *kvCache) put(k KeyType, v DataType) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if e, ok := c.m[k]; ok {
+		e.Value.(*kvCacheEntry).v = v
+		c.l.MoveToFront(e)
+		return
+	}
+	c.m[k] = c.l.PushFront(&kvCacheEntry{k: k, v: v})
+	if c.l.Len() > c.size {
+		e := c.l.Back()
+		c.l.Remove(e)
+		delete(c.m, e.Value.(*kvCacheEntry).k)
+	}
+}
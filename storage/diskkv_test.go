@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestDiskKV(t *testing.T) {
+	err := os.MkdirAll("/tmp/tcoin_test", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/tmp/tcoin_test/kv_test"
+	os.Remove(path)
+	os.Remove(path + ".journal")
+	key := func(i int) KeyType {
+		var k KeyType
+		binary.LittleEndian.PutUint64(k[:8], uint64(i))
+		return k
+	}
+	val := func(i int) DataType {
+		var v DataType
+		binary.LittleEndian.PutUint64(v[:8], uint64(i*i+1))
+		return v
+	}
+	kv, err := openDiskKV(path, 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough keys to grow the table a few times
+	n := diskKVMinSlots * 3
+	for h := 1; h <= 3; h++ {
+		st := make(map[KeyType]DataType)
+		for i := (h - 1) * n / 3; i < h*n/3; i++ {
+			st[key(i)] = val(i)
+		}
+		st[key(0)] = val(h)
+		err = kv.Commit(h, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(kv *diskKV, height int) {
+		if kv.Height() != height {
+			t.Fatalf("wrong height %d", kv.Height())
+		}
+		if kv.Get(key(0)) != val(height) {
+			t.Fatal("wrong value of key 0")
+		}
+		for i := 1; i < n; i++ {
+			if kv.Get(key(i)) != val(i) {
+				t.Fatalf("wrong value of key %d", i)
+			}
+		}
+		if kv.Get(key(n)) != (DataType{}) {
+			t.Fatal("missing key should be zero")
+		}
+		cnt := 0
+		err := kv.ForEach(func(k KeyType, v DataType) {
+			cnt++
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cnt != n {
+			t.Fatalf("wrong key count %d", cnt)
+		}
+	}
+	check(kv, 3)
+	kv.Close()
+
+	kv, err = openDiskKV(path, 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(kv, 3)
+	kv.Close()
+
+	// a complete journal is applied on open, a broken one is dropped
+	err = writeJournal(path+".journal", 4, map[KeyType]DataType{key(0): val(4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err = openDiskKV(path, 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(kv, 4)
+	kv.Close()
+	err = writeJournal(path+".journal", 5, map[KeyType]DataType{key(0): val(5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path+".journal", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err = openDiskKV(path, 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(kv, 4)
+	kv.Close()
+	if diskKVExists(path + ".journal") {
+		t.Fatal("journal not removed")
+	}
+}
+
+func TestDiskKVDelete(t *testing.T) {
+	path := "/tmp/tcoin_test/kv_test_delete"
+	os.Remove(path)
+	os.Remove(path + ".journal")
+	key := func(i int) KeyType {
+		var k KeyType
+		binary.LittleEndian.PutUint64(k[:8], uint64(i))
+		return k
+	}
+	kv, err := openDiskKV(path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// crowded enough to have long runs of slots
+	n := diskKVMinSlots * 6 / 10
+	st := make(map[KeyType]DataType)
+	for i := 0; i < n; i++ {
+		st[key(i)] = DataType{1}
+	}
+	err = kv.Commit(1, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := 2; h <= 3; h++ {
+		st = make(map[KeyType]DataType)
+		for i := h; i < n; i += 4 {
+			st[key(i)] = DataType{}
+		}
+		err = kv.Commit(h, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept := 0
+	for i := 0; i < n; i++ {
+		exp := DataType{}
+		if i%4 < 2 {
+			exp = DataType{1}
+			kept++
+		}
+		if kv.Get(key(i)) != exp {
+			t.Fatalf("wrong value of key %d", i)
+		}
+	}
+	cnt := 0
+	err = kv.ForEach(func(k KeyType, v DataType) {
+		cnt++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != kept || kv.count != uint64(kept) {
+		t.Fatalf("wrong key count %d %d, expected %d", cnt, kv.count, kept)
+	}
+	kv.Close()
+
+	// deletions in a journal are applied on open
+	err = writeJournal(path+".journal", 4, map[KeyType]DataType{key(0): {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err = openDiskKV(path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if kv.Get(key(0)) != (DataType{}) || kv.Get(key(1)) != (DataType{1}) || kv.count != uint64(kept-1) {
+		t.Fatal("wrong state after replaying journal")
+	}
+}
+
+func TestDiskKVScanConcurrent(t *testing.T) {
+	path := "/tmp/tcoin_test/kv_test_scan"
+	os.Remove(path)
+	os.Remove(path + ".journal")
+	key := func(i int) KeyType {
+		var k KeyType
+		binary.LittleEndian.PutUint64(k[:8], uint64(i))
+		return k
+	}
+	kv, err := openDiskKV(path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	// enough keys for a table of a few chunks
+	n := diskKVMinSlots
+	st := make(map[KeyType]DataType)
+	for i := 0; i < n; i++ {
+		st[key(i)] = DataType{1}
+	}
+	err = kv.Commit(1, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reads and commits go on while a scan is paused in the middle
+	paused := make(chan struct{})
+	resume := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		first := true
+		done <- kv.ForEach(func(k KeyType, v DataType) {
+			if first {
+				first = false
+				close(paused)
+				<-resume
+			}
+		})
+	}()
+	<-paused
+	if kv.Get(key(1)) != (DataType{1}) {
+		t.Fatal("wrong value during scan")
+	}
+	err = kv.Commit(2, map[KeyType]DataType{key(n): {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv.Height() != 2 || kv.Get(key(n)) != (DataType{2}) {
+		t.Fatal("commit not seen during scan")
+	}
+	close(resume)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a scan fails if the table is rebuilt in the middle
+	paused = make(chan struct{})
+	resume = make(chan struct{})
+	go func() {
+		first := true
+		done <- kv.ForEach(func(k KeyType, v DataType) {
+			if first {
+				first = false
+				close(paused)
+				<-resume
+			}
+		})
+	}()
+	<-paused
+	st = make(map[KeyType]DataType)
+	for i := n; i < n*2; i++ {
+		st[key(i)] = DataType{3}
+	}
+	err = kv.Commit(3, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(resume)
+	if <-done == nil {
+		t.Fatal("scan not failed after rebuild")
+	}
+}
@@ -0,0 +1,417 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// the file backend stores under the path:
+// perm/data: data of finalized slices, concatenated
+// perm/datapos: offset, length and key of each height in perm/data
+// perm/state: the root state, see diskkv.go
+// perm/index: the ordered index of the keys of contracts, see index.go
+// perm/wal: the write-ahead log, see wal.go
+// perm/*.compact: an interrupted compaction, see compact.go
+// temp/<key>, temp/<key>.b: a temp slice, and its parent key and data
+type fileBackend struct {
+	path     string
+	cache    int
+	fData    *os.File
+	fDataPos *os.File
+	fLog     *os.File
+	kv       *diskKV
+	idx      *diskKV
+	// set if the index failed to be written, then the keys are listed by
+	// scanning until it's built again on the next start
+	idxBroken int32
+}
+
+// cacheSize is the number of state entries cached in memory
+func NewFileBackend(path string, cacheSize int) (Backend, error) {
+	err := os.MkdirAll(filepath.Join(path, "perm"), 0o755)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Join(path, "temp"), 0o755)
+	if err != nil {
+		return nil, err
+	}
+	err = finishCompaction(path)
+	if err != nil {
+		return nil, fmt.Errorf("error when finishing compaction: %v", err)
+	}
+	b := &fileBackend{
+		path:  path,
+		cache: cacheSize,
+	}
+	b.fData, err = os.OpenFile(filepath.Join(path, "perm", "data"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	b.fDataPos, err = os.OpenFile(filepath.Join(path, "perm", "datapos"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		b.fData.Close()
+		return nil, err
+	}
+	b.fLog, err = os.OpenFile(filepath.Join(path, "perm", "wal"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		b.fData.Close()
+		b.fDataPos.Close()
+		return nil, err
+	}
+	stateFn := filepath.Join(path, "perm", "state")
+	ssFn := filepath.Join(path, "perm", "ss")
+	if !diskKVExists(stateFn) && diskKVExists(ssFn) {
+		err = migrateRootDump(ssFn, stateFn)
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("error when migrating root slice: %v", err)
+		}
+	}
+	if diskKVExists(stateFn) {
+		b.kv, err = openDiskKV(stateFn, 0, cacheSize)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.idx, err = openIndex(filepath.Join(path, "perm", "index"), b.kv, cacheSize)
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("error when building index: %v", err)
+		}
+	}
+	return b, nil
+}
+
+// convert the root slice dumped by older versions to the state file
+func migrateRootDump(ssFn, stateFn string) error {
+	f, err := os.Open(ssFn)
+	if err != nil {
+		return err
+	}
+	st := EmptySlice()
+	err = st.LoadFile(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	os.Remove(stateFn + ".init")
+	kv, err := openDiskKV(stateFn+".init", st.height, 1)
+	if err != nil {
+		return err
+	}
+	err = kv.Commit(st.height, st.st)
+	if err == nil {
+		err = kv.rename(stateFn)
+	}
+	kv.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(ssFn)
+}
+
+func (b *fileBackend) StateHeight() int {
+	if b.kv == nil {
+		return -1
+	}
+	return b.kv.Height()
+}
+
+func (b *fileBackend) ReadState(k KeyType) DataType {
+	if b.kv == nil {
+		return DataType{}
+	}
+	return b.kv.Get(k)
+}
+
+func (b *fileBackend) ForEachState(prefix []byte, fn func(k KeyType, v DataType)) error {
+	if b.kv == nil {
+		return nil
+	}
+	return b.kv.ForEach(func(k KeyType, v DataType) {
+		if bytes.HasPrefix(k[:], prefix) {
+			fn(k, v)
+		}
+	})
+}
+
+func (b *fileBackend) IterateState(prefix []byte, start KeyType, limit int) ([]KeyValue, error) {
+	if b.kv == nil {
+		return nil, nil
+	}
+	if atomic.LoadInt32(&b.idxBroken) == 1 || len(prefix) != 33 || prefix[0] != IndexedKeyPrefix {
+		return listByScan(b.ForEachState, prefix, start, limit)
+	}
+	keys := listIndex(b.idx, prefix, start, limit)
+	res := make([]KeyValue, len(keys))
+	for i, k := range keys {
+		res[i] = KeyValue{Key: k, Value: b.kv.Get(k)}
+	}
+	return res, nil
+}
+
+func (b *fileBackend) CommitState(height int, st map[KeyType]DataType) error {
+	if b.kv != nil {
+		broken := atomic.LoadInt32(&b.idxBroken) == 1
+		var changes map[KeyType]DataType
+		if !broken {
+			changes = indexChanges(b.idx, st, b.kv.Get)
+		}
+		err := b.kv.Commit(height, st)
+		if err != nil || broken {
+			return err
+		}
+		err = b.idx.Commit(height, changes)
+		if err != nil {
+			log.Printf("failed to write index: %v", err)
+			atomic.StoreInt32(&b.idxBroken, 1)
+		}
+		return nil
+	}
+	// the state file only appears after the first state is stored
+	stateFn := filepath.Join(b.path, "perm", "state")
+	os.Remove(stateFn + ".init")
+	kv, err := openDiskKV(stateFn+".init", height, b.cache)
+	if err != nil {
+		return err
+	}
+	err = kv.Commit(height, st)
+	if err == nil {
+		err = kv.rename(stateFn)
+	}
+	if err != nil {
+		kv.Close()
+		return err
+	}
+	b.idx, err = openIndex(filepath.Join(b.path, "perm", "index"), kv, b.cache)
+	if err != nil {
+		kv.Close()
+		return fmt.Errorf("error when building index: %v", err)
+	}
+	b.kv = kv
+	return nil
+}
+
+func (b *fileBackend) readPos(height int) (int64, int64, SliceKeyType, error) {
+	td := make([]byte, SliceDataPosLen)
+	_, err := b.fDataPos.ReadAt(td, int64(SliceDataPosLen*height))
+	if err != nil {
+		return 0, 0, SliceKeyType{}, err
+	}
+	var k SliceKeyType
+	copy(k[:], td[16:])
+	return int64(binary.LittleEndian.Uint64(td[:8])), int64(binary.LittleEndian.Uint64(td[8:16])), k, nil
+}
+
+var errNotStored = errors.New("not stored")
+
+// heights below a snapshot have empty entries in perm/datapos
+func (b *fileBackend) readStoredPos(height int) (int64, int64, SliceKeyType, error) {
+	off, length, k, err := b.readPos(height)
+	if err == nil && length == 0 && k == (SliceKeyType{}) {
+		err = errNotStored
+	}
+	return off, length, k, err
+}
+
+func (b *fileBackend) WriteData(height int, keys []SliceKeyType, data [][]byte) error {
+	st, err := b.fDataPos.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() < int64(SliceDataPosLen*height) {
+		err = b.fDataPos.Truncate(int64(SliceDataPosLen * height))
+		if err != nil {
+			return err
+		}
+	}
+	var pos int64
+	if height > 0 {
+		off, length, _, err := b.readPos(height - 1)
+		if err != nil {
+			return err
+		}
+		pos = off + length
+	}
+	td := make([]byte, SliceDataPosLen*len(keys))
+	var buf []byte
+	for i := range keys {
+		p := td[i*SliceDataPosLen : (i+1)*SliceDataPosLen]
+		binary.LittleEndian.PutUint64(p[:8], uint64(pos+int64(len(buf))))
+		binary.LittleEndian.PutUint64(p[8:16], uint64(len(data[i])))
+		copy(p[16:], keys[i][:])
+		buf = append(buf, data[i]...)
+	}
+	_, err = b.fData.WriteAt(buf, pos)
+	if err != nil {
+		return err
+	}
+	_, err = b.fDataPos.WriteAt(td, int64(SliceDataPosLen*height))
+	if err != nil {
+		return err
+	}
+	err = b.fDataPos.Sync()
+	if err != nil {
+		return err
+	}
+	return b.fData.Sync()
+}
+
+func (b *fileBackend) ReadKey(height int) (SliceKeyType, error) {
+	_, _, k, err := b.readStoredPos(height)
+	return k, err
+}
+
+func (b *fileBackend) ReadData(height int) ([]byte, error) {
+	off, length, _, err := b.readStoredPos(height)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, length)
+	_, err = b.fData.ReadAt(res, off)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (b *fileBackend) AppendLog(l *LogEntry) error {
+	st, err := b.fLog.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = b.fLog.WriteAt(encodeLogEntry(l), st.Size())
+	if err != nil {
+		return err
+	}
+	return b.fLog.Sync()
+}
+
+func (b *fileBackend) ReadLog() ([]*LogEntry, error) {
+	st, err := b.fLog.Stat()
+	if err != nil {
+		return nil, err
+	}
+	d := make([]byte, st.Size())
+	_, err = b.fLog.ReadAt(d, 0)
+	if err != nil {
+		return nil, err
+	}
+	res, n := decodeLog(d)
+	// later entries are appended after the complete ones
+	if int64(n) != st.Size() {
+		err = b.fLog.Truncate(int64(n))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (b *fileBackend) ClearLog() error {
+	err := b.fLog.Truncate(0)
+	if err != nil {
+		return err
+	}
+	return b.fLog.Sync()
+}
+
+func (b *fileBackend) tempFileName(k SliceKeyType) string {
+	return filepath.Join(b.path, "temp", hex.EncodeToString(k[:]))
+}
+
+func (b *fileBackend) StoreTemp(t *TempSlice) error {
+	fn := b.tempFileName(t.Key)
+	fl, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("error when creating file %s: %v", fn, err)
+	}
+	bf := bufio.NewWriter(fl)
+	err = t.S.DumpFile(bf)
+	if err != nil {
+		fl.Close()
+		return fmt.Errorf("error when writing file %s: %v", fn, err)
+	}
+	err = bf.Flush()
+	if err != nil {
+		fl.Close()
+		return fmt.Errorf("error when writing file %s: %v", fn, err)
+	}
+	err = fl.Close()
+	if err != nil {
+		return fmt.Errorf("error when closing file %s: %v", fn, err)
+	}
+	err = ioutil.WriteFile(fn+".b", append(t.Parent[:], t.Data...), 0o755)
+	if err != nil {
+		return fmt.Errorf("error when writing file %s: %v", fn+".b", err)
+	}
+	return nil
+}
+
+func (b *fileBackend) LoadTemps() ([]*TempSlice, error) {
+	files, err := ioutil.ReadDir(filepath.Join(b.path, "temp"))
+	if err != nil {
+		return nil, err
+	}
+	res := []*TempSlice{}
+	for _, file := range files {
+		if len(file.Name()) != SliceKeyLen*2 {
+			continue
+		}
+		bs, err := hex.DecodeString(file.Name())
+		if err != nil || len(bs) != SliceKeyLen {
+			continue
+		}
+		t := &TempSlice{}
+		copy(t.Key[:], bs)
+		f, err := os.Open(b.tempFileName(t.Key))
+		if err != nil {
+			continue
+		}
+		t.S = EmptySlice()
+		err = t.S.LoadFile(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			continue
+		}
+		d, err := ioutil.ReadFile(b.tempFileName(t.Key) + ".b")
+		if err != nil || len(d) < SliceKeyLen {
+			continue
+		}
+		copy(t.Parent[:], d[:SliceKeyLen])
+		t.Data = d[SliceKeyLen:]
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+func (b *fileBackend) RemoveTemp(k SliceKeyType) error {
+	err := os.Remove(b.tempFileName(k))
+	err2 := os.Remove(b.tempFileName(k) + ".b")
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+func (b *fileBackend) Close() error {
+	if b.kv != nil {
+		b.kv.Close()
+	}
+	if b.idx != nil {
+		b.idx.Close()
+	}
+	b.fData.Close()
+	b.fLog.Close()
+	return b.fDataPos.Close()
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+)
+
+// The keys of each contract in the stored state (the keys starting with
+// IndexedKeyPrefix, then the 32 bytes of the contract) are indexed in
+// perm/index, so they can be listed in order from a position without scanning
+// the whole state. For each contract the positions (the last 32 bytes) form a
+// treap, whose priorities are the hashes of the keys, stored in a diskKV:
+// for each node, its flags (whether it has children) and its two children,
+// and for each contract, the root. The index has the height of the state it
+// was built from, and it's built again if they differ.
+const IndexedKeyPrefix = 2
+
+const (
+	idxTagFlags = iota
+	idxTagLeft
+	idxTagRight
+	idxTagRoot
+	idxTagRootFlags
+)
+
+const (
+	idxFlagNode  = 1
+	idxFlagLeft  = 2
+	idxFlagRight = 4
+)
+
+// the changes are written in batches when building the index
+const idxBatchSize = 1 << 16
+
+func indexed(k KeyType) bool {
+	return k[0] == IndexedKeyPrefix
+}
+
+func indexPos(k KeyType) HashType {
+	var p HashType
+	copy(p[:], k[33:])
+	return p
+}
+
+func idxKey(tag byte, group []byte, pos HashType) KeyType {
+	var k KeyType
+	k[0] = tag
+	copy(k[1:33], group)
+	copy(k[33:], pos[:])
+	return k
+}
+
+// a pointer to a node: the flag in flagKey, and the node in ptrKey
+type idxSlot struct {
+	flagKey KeyType
+	bit     byte
+	ptrKey  KeyType
+}
+
+// changes to the index of a contract, read on top of the stored index
+type idxTx struct {
+	kv      *diskKV
+	group   []byte
+	changes map[KeyType]DataType
+}
+
+func (t *idxTx) get(k KeyType) DataType {
+	if v, ok := t.changes[k]; ok {
+		return v
+	}
+	return t.kv.Get(k)
+}
+
+func (t *idxTx) rootSlot() idxSlot {
+	return idxSlot{
+		flagKey: idxKey(idxTagRootFlags, t.group, HashType{}),
+		bit:     1,
+		ptrKey:  idxKey(idxTagRoot, t.group, HashType{}),
+	}
+}
+
+func (t *idxTx) leftSlot(p HashType) idxSlot {
+	return idxSlot{
+		flagKey: idxKey(idxTagFlags, t.group, p),
+		bit:     idxFlagLeft,
+		ptrKey:  idxKey(idxTagLeft, t.group, p),
+	}
+}
+
+func (t *idxTx) rightSlot(p HashType) idxSlot {
+	return idxSlot{
+		flagKey: idxKey(idxTagFlags, t.group, p),
+		bit:     idxFlagRight,
+		ptrKey:  idxKey(idxTagRight, t.group, p),
+	}
+}
+
+func (t *idxTx) load(s idxSlot) (HashType, bool) {
+	if t.get(s.flagKey)[0]&s.bit == 0 {
+		return HashType{}, false
+	}
+	return HashType(t.get(s.ptrKey)), true
+}
+
+func (t *idxTx) store(s idxSlot, p HashType, ok bool) {
+	f := t.get(s.flagKey)
+	if ok {
+		f[0] |= s.bit
+	} else {
+		f[0] &^= s.bit
+		p = HashType{}
+	}
+	t.changes[s.flagKey] = f
+	t.changes[s.ptrKey] = DataType(p)
+}
+
+func (t *idxTx) priority(p HashType) uint64 {
+	var k KeyType
+	k[0] = IndexedKeyPrefix
+	copy(k[1:33], t.group)
+	copy(k[33:], p[:])
+	return kvHash(k)
+}
+
+// whether a is above b in the treap
+func (t *idxTx) above(a, b HashType) bool {
+	pa, pb := t.priority(a), t.priority(b)
+	return pa > pb || (pa == pb && bytes.Compare(a[:], b[:]) < 0)
+}
+
+func (t *idxTx) rotateRight(s idxSlot) {
+	c, _ := t.load(s)
+	l, _ := t.load(t.leftSlot(c))
+	lr, ok := t.load(t.rightSlot(l))
+	t.store(t.leftSlot(c), lr, ok)
+	t.store(t.rightSlot(l), c, true)
+	t.store(s, l, true)
+}
+
+func (t *idxTx) rotateLeft(s idxSlot) {
+	c, _ := t.load(s)
+	r, _ := t.load(t.rightSlot(c))
+	rl, ok := t.load(t.leftSlot(r))
+	t.store(t.rightSlot(c), rl, ok)
+	t.store(t.leftSlot(r), c, true)
+	t.store(s, r, true)
+}
+
+func (t *idxTx) insert(s idxSlot, p HashType) {
+	c, ok := t.load(s)
+	if !ok {
+		t.changes[idxKey(idxTagFlags, t.group, p)] = DataType{idxFlagNode}
+		t.store(s, p, true)
+		return
+	}
+	switch bytes.Compare(p[:], c[:]) {
+	case 0:
+		return
+	case -1:
+		ls := t.leftSlot(c)
+		t.insert(ls, p)
+		if l, _ := t.load(ls); t.above(l, c) {
+			t.rotateRight(s)
+		}
+	default:
+		rs := t.rightSlot(c)
+		t.insert(rs, p)
+		if r, _ := t.load(rs); t.above(r, c) {
+			t.rotateLeft(s)
+		}
+	}
+}
+
+func (t *idxTx) remove(s idxSlot, p HashType) {
+	c, ok := t.load(s)
+	if !ok {
+		return
+	}
+	switch bytes.Compare(p[:], c[:]) {
+	case -1:
+		t.remove(t.leftSlot(c), p)
+		return
+	case 1:
+		t.remove(t.rightSlot(c), p)
+		return
+	}
+	// rotate the node down until it's a leaf
+	l, lok := t.load(t.leftSlot(c))
+	r, rok := t.load(t.rightSlot(c))
+	switch {
+	case !lok && !rok:
+		t.store(s, HashType{}, false)
+		t.changes[idxKey(idxTagFlags, t.group, c)] = DataType{}
+		t.changes[idxKey(idxTagLeft, t.group, c)] = DataType{}
+		t.changes[idxKey(idxTagRight, t.group, c)] = DataType{}
+	case !rok || (lok && t.above(l, r)):
+		t.rotateRight(s)
+		t.remove(t.rightSlot(l), p)
+	default:
+		t.rotateLeft(s)
+		t.remove(t.leftSlot(r), p)
+	}
+}
+
+// the keys of the group from the position on in ascending order, at most limit
+// of them (no limit if negative)
+func (t *idxTx) list(start HashType, limit int) []HashType {
+	res := []HashType{}
+	stack := []HashType{}
+	s := t.rootSlot()
+	for {
+		c, ok := t.load(s)
+		if !ok {
+			break
+		}
+		if bytes.Compare(c[:], start[:]) >= 0 {
+			stack = append(stack, c)
+			s = t.leftSlot(c)
+		} else {
+			s = t.rightSlot(c)
+		}
+	}
+	for len(stack) > 0 && (limit < 0 || len(res) < limit) {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		res = append(res, c)
+		s = t.rightSlot(c)
+		for {
+			c, ok := t.load(s)
+			if !ok {
+				break
+			}
+			stack = append(stack, c)
+			s = t.leftSlot(c)
+		}
+	}
+	return res
+}
+
+// the largest position of the group not above p
+func (t *idxTx) floor(p HashType) (HashType, bool) {
+	var res HashType
+	found := false
+	s := t.rootSlot()
+	for {
+		c, ok := t.load(s)
+		if !ok {
+			return res, found
+		}
+		if bytes.Compare(c[:], p[:]) <= 0 {
+			res, found = c, true
+			s = t.rightSlot(c)
+		} else {
+			s = t.leftSlot(c)
+		}
+	}
+}
+
+// the changes of the index for the changes of the state, old reads the
+// current value of a key
+func indexChanges(idx *diskKV, st map[KeyType]DataType, old func(k KeyType) DataType) map[KeyType]DataType {
+	changes := make(map[KeyType]DataType)
+	for k, v := range st {
+		if !indexed(k) {
+			continue
+		}
+		added := v != (DataType{})
+		if added == (old(k) != (DataType{})) {
+			continue
+		}
+		t := &idxTx{kv: idx, group: k[1:33], changes: changes}
+		if added {
+			t.insert(t.rootSlot(), indexPos(k))
+		} else {
+			t.remove(t.rootSlot(), indexPos(k))
+		}
+	}
+	return changes
+}
+
+// list the indexed keys with the prefix from start on, the prefix must be the
+// first 33 bytes of the keys
+func listIndex(idx *diskKV, prefix []byte, start KeyType, limit int) []KeyType {
+	var p HashType
+	switch bytes.Compare(start[:33], prefix) {
+	case -1:
+	case 0:
+		copy(p[:], start[33:])
+	default:
+		return nil
+	}
+	t := &idxTx{kv: idx, group: prefix[1:33], changes: map[KeyType]DataType{}}
+	ps := t.list(p, limit)
+	res := make([]KeyType, len(ps))
+	for i, p := range ps {
+		copy(res[i][:33], prefix)
+		copy(res[i][33:], p[:])
+	}
+	return res
+}
+
+// build the index of the state at the path, or open it if it's up to date
+func openIndex(path string, kv *diskKV, cacheSize int) (*diskKV, error) {
+	if diskKVExists(path) {
+		idx, err := openDiskKV(path, 0, cacheSize)
+		if err == nil && idx.Height() == kv.Height() {
+			return idx, nil
+		}
+		if err == nil {
+			idx.Close()
+		}
+	}
+	os.Remove(path + ".init")
+	os.Remove(path + ".init.journal")
+	idx, err := openDiskKV(path+".init", kv.Height(), cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	height := kv.Height()
+	changes := make(map[KeyType]DataType)
+	var werr error
+	err = kv.ForEach(func(k KeyType, v DataType) {
+		if werr != nil || !indexed(k) || v == (DataType{}) {
+			return
+		}
+		t := &idxTx{kv: idx, group: k[1:33], changes: changes}
+		t.insert(t.rootSlot(), indexPos(k))
+		if len(changes) >= idxBatchSize {
+			werr = idx.Commit(height, changes)
+			changes = make(map[KeyType]DataType)
+		}
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = idx.Commit(height, changes)
+	}
+	if err == nil {
+		err = idx.rename(path)
+	}
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return idx, nil
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	path := "/tmp/tcoin_test/index_test"
+	err := os.RemoveAll(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewFileBackend(path, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	key := func(c byte, pos int) KeyType {
+		var k KeyType
+		k[0] = IndexedKeyPrefix
+		k[1] = c
+		// small positions, and some spread over the whole range
+		if pos%3 == 0 {
+			k[33] = byte(pos * 37)
+		}
+		k[64] = byte(pos)
+		return k
+	}
+	ref := make(map[KeyType]DataType)
+	for h := 0; h < 20; h++ {
+		st := make(map[KeyType]DataType)
+		for i := 0; i < 50; i++ {
+			k := key(byte(rnd.Intn(2)), rnd.Intn(256))
+			if rnd.Intn(3) == 0 {
+				st[k] = DataType{}
+			} else {
+				st[k] = DataType{byte(h + 1)}
+			}
+		}
+		// other keys aren't indexed
+		st[KeyType{1, byte(h)}] = DataType{1}
+		err = b.CommitState(h, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range st {
+			if v == (DataType{}) {
+				delete(ref, k)
+			} else {
+				ref[k] = v
+			}
+		}
+	}
+	check := func(b Backend) {
+		for c := byte(0); c < 3; c++ {
+			prefix := append([]byte{IndexedKeyPrefix, c}, make([]byte, 31)...)
+			all := []KeyValue{}
+			for k, v := range ref {
+				if bytes.HasPrefix(k[:], prefix) {
+					all = append(all, KeyValue{Key: k, Value: v})
+				}
+			}
+			sort.Slice(all, func(i, j int) bool {
+				return bytes.Compare(all[i].Key[:], all[j].Key[:]) < 0
+			})
+			for i := 0; i <= len(all); i += 7 {
+				start := KeyType{IndexedKeyPrefix, c}
+				if i < len(all) {
+					start = all[i].Key
+				}
+				res, err := b.IterateState(prefix, start, 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				exp := all[i:]
+				if len(exp) > 10 {
+					exp = exp[:10]
+				}
+				if len(res) != len(exp) {
+					t.Fatalf("contract %d from %d: %d keys, expected %d", c, i, len(res), len(exp))
+				}
+				for j := range res {
+					if res[j] != exp[j] {
+						t.Fatalf("contract %d from %d: wrong key %d", c, i, j)
+					}
+				}
+			}
+			res, err := b.IterateState(prefix, KeyType{}, -1)
+			if err != nil || len(res) != len(all) {
+				t.Fatalf("contract %d: %d keys, expected %d", c, len(res), len(all))
+			}
+		}
+	}
+	check(b)
+	b.Close()
+
+	// the index is built again if it's behind the state
+	b, err = NewFileBackend(path, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(b)
+	fb := b.(*fileBackend)
+	err = fb.kv.Commit(20, map[KeyType]DataType{key(2, 1): {1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref[key(2, 1)] = DataType{1}
+	b.Close()
+	b, err = NewFileBackend(path, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if b.(*fileBackend).idx.Height() != 20 {
+		t.Fatal("index not built again")
+	}
+	check(b)
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// the memory backend keeps everything in memory, for tests and local chains
+type memoryBackend struct {
+	height int
+	state  map[KeyType]DataType
+	keys   []SliceKeyType
+	data   [][]byte
+	temps  map[SliceKeyType]*TempSlice
+	log    []*LogEntry
+	mut    sync.Mutex
+}
+
+func NewMemoryBackend() Backend {
+	return &memoryBackend{
+		height: -1,
+		state:  make(map[KeyType]DataType),
+		keys:   []SliceKeyType{},
+		data:   [][]byte{},
+		temps:  make(map[SliceKeyType]*TempSlice),
+	}
+}
+
+// the slices are copied, so the stored temps don't share the maps of the slices
+func copyTempSlice(t *TempSlice) *TempSlice {
+	s := EmptySlice()
+	s.height = t.S.height
+	for k, v := range t.S.st {
+		s.st[k] = v
+	}
+	s.Freeze()
+	return &TempSlice{
+		Key:    t.Key,
+		Parent: t.Parent,
+		S:      s,
+		Data:   append([]byte{}, t.Data...),
+	}
+}
+
+func (b *memoryBackend) StateHeight() int {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.height
+}
+
+func (b *memoryBackend) ReadState(k KeyType) DataType {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.state[k]
+}
+
+func (b *memoryBackend) ForEachState(prefix []byte, fn func(k KeyType, v DataType)) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for k, v := range b.state {
+		if bytes.HasPrefix(k[:], prefix) {
+			fn(k, v)
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) IterateState(prefix []byte, start KeyType, limit int) ([]KeyValue, error) {
+	return listByScan(b.ForEachState, prefix, start, limit)
+}
+
+func (b *memoryBackend) CommitState(height int, st map[KeyType]DataType) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for k, v := range st {
+		if v == (DataType{}) {
+			delete(b.state, k)
+		} else {
+			b.state[k] = v
+		}
+	}
+	b.height = height
+	return nil
+}
+
+func (b *memoryBackend) WriteData(height int, keys []SliceKeyType, data [][]byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	// heights below a snapshot are not stored
+	for len(b.keys) < height {
+		b.keys = append(b.keys, SliceKeyType{})
+		b.data = append(b.data, nil)
+	}
+	b.keys = append(b.keys[:height], keys...)
+	b.data = b.data[:height]
+	for _, d := range data {
+		b.data = append(b.data, append([]byte{}, d...))
+	}
+	return nil
+}
+
+func (b *memoryBackend) ReadKey(height int) (SliceKeyType, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if height < 0 || height >= len(b.keys) || b.data[height] == nil {
+		return SliceKeyType{}, fmt.Errorf("height %d not stored", height)
+	}
+	return b.keys[height], nil
+}
+
+func (b *memoryBackend) ReadData(height int) ([]byte, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if height < 0 || height >= len(b.data) || b.data[height] == nil {
+		return nil, fmt.Errorf("height %d not stored", height)
+	}
+	return b.data[height], nil
+}
+
+func (b *memoryBackend) AppendLog(l *LogEntry) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	t := &LogEntry{
+		Height:  l.Height,
+		Key:     l.Key,
+		Data:    append([]byte{}, l.Data...),
+		Changes: make(map[KeyType]DataType, len(l.Changes)),
+	}
+	for k, v := range l.Changes {
+		t.Changes[k] = v
+	}
+	b.log = append(b.log, t)
+	return nil
+}
+
+func (b *memoryBackend) ReadLog() ([]*LogEntry, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return append([]*LogEntry{}, b.log...), nil
+}
+
+func (b *memoryBackend) ClearLog() error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.log = nil
+	return nil
+}
+
+func (b *memoryBackend) StoreTemp(t *TempSlice) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.temps[t.Key] = copyTempSlice(t)
+	return nil
+}
+
+func (b *memoryBackend) LoadTemps() ([]*TempSlice, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	res := []*TempSlice{}
+	for _, t := range b.temps {
+		res = append(res, copyTempSlice(t))
+	}
+	return res, nil
+}
+
+func (b *memoryBackend) RemoveTemp(k SliceKeyType) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	delete(b.temps, k)
+	return nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
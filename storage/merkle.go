@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The state root is a compact sparse merkle tree over sha256(key), a subtree
+// containing only one leaf is replaced by the leaf itself. Zero values are
+// treated as absent. The nodes are kept in the slice itself (under local
+// keys), so they fork, merge and persist together with the state.
+// For the node at (depth, prefix), merkleLeafPrefix holds the path of the leaf
+// (zero if it's not a leaf), and merkleNodePrefix holds the value of the leaf
+// or the hash of an inner node.
+const merkleLeafPrefix = 0xfd
+const merkleNodePrefix = 0xfe
+
+type merkleNode struct {
+	path HashType
+	val  DataType
+}
+
+func (n merkleNode) isLeaf() bool {
+	return n.path != HashType{}
+}
+
+func (n merkleNode) hash() HashType {
+	if n.isLeaf() {
+		return merkleLeafHash(n.path, n.val)
+	}
+	return HashType(n.val)
+}
+
+func merkleLeafHash(path HashType, val DataType) HashType {
+	buf := make([]byte, 1+HashLen+DataLen)
+	buf[0] = 0
+	copy(buf[1:1+HashLen], path[:])
+	copy(buf[1+HashLen:], val[:])
+	return sha256.Sum256(buf)
+}
+
+func merkleInnerHash(l, r HashType) HashType {
+	buf := make([]byte, 1+HashLen*2)
+	buf[0] = 1
+	copy(buf[1:1+HashLen], l[:])
+	copy(buf[1+HashLen:], r[:])
+	return sha256.Sum256(buf)
+}
+
+func merklePath(k KeyType) HashType {
+	return sha256.Sum256(k[:])
+}
+
+func merklePrefix(p HashType, d int) HashType {
+	var res HashType
+	copy(res[:d>>3], p[:d>>3])
+	if d&7 != 0 {
+		res[d>>3] = p[d>>3] & byte(0xff<<(8-uint(d&7)))
+	}
+	return res
+}
+
+func merkleKey(tp byte, d int, p HashType) KeyType {
+	k := KeyType{tp}
+	binary.BigEndian.PutUint16(k[1:3], uint16(d))
+	copy(k[3:3+HashLen], p[:])
+	return k
+}
+
+func (s *Slice) merkleRead(d int, p HashType) merkleNode {
+	return merkleNode{
+		path: HashType(s.Read(merkleKey(merkleLeafPrefix, d, p))),
+		val:  s.Read(merkleKey(merkleNodePrefix, d, p)),
+	}
+}
+
+func (s *Slice) merkleWrite(d int, p HashType, n merkleNode) {
+	k := merkleKey(merkleLeafPrefix, d, p)
+	if HashType(s.Read(k)) != n.path {
+		s.Write(k, DataType(n.path))
+	}
+	k = merkleKey(merkleNodePrefix, d, p)
+	if s.Read(k) != n.val {
+		s.Write(k, n.val)
+	}
+}
+
+func (s *Slice) merkleUpdate(d int, q HashType, v DataType) {
+	p := merklePrefix(q, d)
+	n := s.merkleRead(d, p)
+	if n.isLeaf() {
+		if n.path == q {
+			if v == (DataType{}) {
+				s.merkleWrite(d, p, merkleNode{})
+			} else {
+				s.merkleWrite(d, p, merkleNode{path: q, val: v})
+			}
+			return
+		}
+		if v == (DataType{}) {
+			return
+		}
+		// push the old leaf down, then insert the new one next to it
+		s.merkleWrite(d+1, merklePrefix(n.path, d+1), n)
+	} else if n.val == (DataType{}) {
+		if v != (DataType{}) {
+			s.merkleWrite(d, p, merkleNode{path: q, val: v})
+		}
+		return
+	}
+	s.merkleUpdate(d+1, q, v)
+	lp := p
+	rp := p
+	rp[d>>3] |= 1 << (7 - uint(d&7))
+	l := s.merkleRead(d+1, lp)
+	r := s.merkleRead(d+1, rp)
+	lh := l.hash()
+	rh := r.hash()
+	if lh == (HashType{}) && rh == (HashType{}) {
+		s.merkleWrite(d, p, merkleNode{})
+	} else if lh == (HashType{}) && r.isLeaf() {
+		s.merkleWrite(d+1, rp, merkleNode{})
+		s.merkleWrite(d, p, r)
+	} else if rh == (HashType{}) && l.isLeaf() {
+		s.merkleWrite(d+1, lp, merkleNode{})
+		s.merkleWrite(d, p, l)
+	} else {
+		s.merkleWrite(d, p, merkleNode{val: DataType(merkleInnerHash(lh, rh))})
+	}
+}
+
+// get the state root, all non-local keys of the slice (and its bases) are committed
+func (s *Slice) StateRoot() HashType {
+	return s.merkleRead(0, HashType{}).hash()
+}
+
+// fold the non-local keys written in this slice (not its bases) into the
+// state tree, and return the new state root
+func (s *Slice) UpdateStateRoot() HashType {
+	keys := make([]KeyType, 0, len(s.st))
+	for k := range s.st {
+		if k[0] < LocalKeyPrefix {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	for _, k := range keys {
+		s.merkleUpdate(0, merklePath(k), s.st[k])
+	}
+	return s.StateRoot()
+}
+
+// build the state tree over all non-local keys of the state, for a state whose
+// tree isn't kept yet, and return the state root
+func (s *Slice) BuildStateRoot() (HashType, error) {
+	kvs, err := s.Iterate(nil, KeyType{}, -1)
+	if err != nil {
+		return HashType{}, err
+	}
+	for _, kv := range kvs {
+		if kv.Key[0] < LocalKeyPrefix {
+			s.merkleUpdate(0, merklePath(kv.Key), kv.Value)
+		}
+	}
+	return s.StateRoot(), nil
+}
+
+// the proof lists the sibling hashes from the root down to the node where the
+// lookup ends, and that node itself: either empty (zero path), the leaf of the
+// key, or a leaf of another key sharing the same prefix
+type StateProof struct {
+	Siblings  []HashType
+	LeafPath  HashType
+	LeafValue DataType
+}
+
+func (s *Slice) ProveState(k KeyType) *StateProof {
+	q := merklePath(k)
+	p := &StateProof{Siblings: []HashType{}}
+	for d := 0; ; d++ {
+		n := s.merkleRead(d, merklePrefix(q, d))
+		if n.isLeaf() || n.val == (DataType{}) {
+			p.LeafPath = n.path
+			p.LeafValue = n.val
+			return p
+		}
+		sp := merklePrefix(q, d+1)
+		sp[d>>3] ^= 1 << (7 - uint(d&7))
+		p.Siblings = append(p.Siblings, s.merkleRead(d+1, sp).hash())
+	}
+}
+
+// check that k has value v under root, a zero v means k is absent
+func VerifyStateProof(root HashType, k KeyType, v DataType, p *StateProof) error {
+	q := merklePath(k)
+	d := len(p.Siblings)
+	if d > HashLen*8 {
+		return errors.New("state proof too long")
+	}
+	var h HashType
+	if v != (DataType{}) {
+		if p.LeafPath != q || p.LeafValue != v {
+			return errors.New("state proof leaf mismatch")
+		}
+		h = merkleLeafHash(q, v)
+	} else if p.LeafPath != (HashType{}) {
+		if p.LeafPath == q || merklePrefix(p.LeafPath, d) != merklePrefix(q, d) || p.LeafValue == (DataType{}) {
+			return errors.New("state proof leaf mismatch")
+		}
+		h = merkleLeafHash(p.LeafPath, p.LeafValue)
+	}
+	for i := d - 1; i >= 0; i-- {
+		if (q[i>>3]>>(7-uint(i&7)))&1 == 0 {
+			h = merkleInnerHash(h, p.Siblings[i])
+		} else {
+			h = merkleInnerHash(p.Siblings[i], h)
+		}
+	}
+	if h != root {
+		return errors.New("state proof root mismatch")
+	}
+	return nil
+}
+
+func EncodeStateProof(w io.Writer, p *StateProof) error {
+	buf := make([]byte, 2, 2+HashLen*(len(p.Siblings)+1)+DataLen)
+	binary.LittleEndian.PutUint16(buf, uint16(len(p.Siblings)))
+	for _, h := range p.Siblings {
+		buf = append(buf, h[:]...)
+	}
+	buf = append(buf, p.LeafPath[:]...)
+	buf = append(buf, p.LeafValue[:]...)
+	_, err := w.Write(buf)
+	if err != nil {
+		return fmt.Errorf("error when encoding state proof: %v", err)
+	}
+	return nil
+}
+
+func DecodeStateProof(r io.Reader) (*StateProof, error) {
+	lbuf := make([]byte, 2)
+	_, err := io.ReadFull(r, lbuf)
+	if err != nil {
+		return nil, fmt.Errorf("error when decoding state proof: %v", err)
+	}
+	cnt := int(binary.LittleEndian.Uint16(lbuf))
+	if cnt > HashLen*8 {
+		return nil, errors.New("state proof too long")
+	}
+	p := &StateProof{Siblings: make([]HashType, cnt)}
+	for i := 0; i < cnt; i++ {
+		_, err = io.ReadFull(r, p.Siblings[i][:])
+		if err != nil {
+			return nil, fmt.Errorf("error when decoding state proof: %v", err)
+		}
+	}
+	_, err = io.ReadFull(r, p.LeafPath[:])
+	if err != nil {
+		return nil, fmt.Errorf("error when decoding state proof: %v", err)
+	}
+	_, err = io.ReadFull(r, p.LeafValue[:])
+	if err != nil {
+		return nil, fmt.Errorf("error when decoding state proof: %v", err)
+	}
+	return p, nil
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func testMerkleRef(leaves map[KeyType]DataType) HashType {
+	var f func(ps []HashType, vs []DataType, d int) HashType
+	f = func(ps []HashType, vs []DataType, d int) HashType {
+		if len(ps) == 0 {
+			return HashType{}
+		}
+		if len(ps) == 1 {
+			return merkleLeafHash(ps[0], vs[0])
+		}
+		var lp, rp []HashType
+		var lv, rv []DataType
+		for i, p := range ps {
+			if (p[d>>3]>>(7-uint(d&7)))&1 == 0 {
+				lp = append(lp, p)
+				lv = append(lv, vs[i])
+			} else {
+				rp = append(rp, p)
+				rv = append(rv, vs[i])
+			}
+		}
+		return merkleInnerHash(f(lp, lv, d+1), f(rp, rv, d+1))
+	}
+	ps := []HashType{}
+	vs := []DataType{}
+	for k, v := range leaves {
+		if v != (DataType{}) {
+			ps = append(ps, merklePath(k))
+			vs = append(vs, v)
+		}
+	}
+	return f(ps, vs, 0)
+}
+
+func TestStateRoot(t *testing.T) {
+	rnd := rand.New(rand.NewSource(114514))
+	keys := make([]KeyType, 300)
+	for i := range keys {
+		rnd.Read(keys[i][:])
+		keys[i][0] = byte(rnd.Intn(3))
+	}
+	ref := make(map[KeyType]DataType)
+	s := EmptySlice()
+	if s.UpdateStateRoot() != (HashType{}) {
+		t.Fatal("empty root should be zero")
+	}
+	for i := 0; i < 50; i++ {
+		s.Freeze()
+		s = ForkSlice(s)
+		for j := 0; j < rnd.Intn(40); j++ {
+			k := keys[rnd.Intn(len(keys))]
+			v := DataType{}
+			if rnd.Intn(4) != 0 {
+				rnd.Read(v[:])
+			}
+			s.Write(k, v)
+			ref[k] = v
+		}
+		local := KeyType{0xf0}
+		rnd.Read(local[1:])
+		s.Write(local, DataType{1})
+		if s.UpdateStateRoot() != testMerkleRef(ref) {
+			t.Fatalf("state root mismatch at round %d", i)
+		}
+	}
+	// the root only depends on the content, not the history
+	s2 := EmptySlice()
+	for k, v := range ref {
+		s2.Write(k, v)
+	}
+	if s2.UpdateStateRoot() != s.StateRoot() {
+		t.Fatal("state root depends on history")
+	}
+	s = ForkSlice(s)
+	for k := range ref {
+		s.Write(k, DataType{})
+	}
+	if s.UpdateStateRoot() != (HashType{}) {
+		t.Fatal("root of cleared state should be zero")
+	}
+}
+
+func TestStateProof(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1919810))
+	s := EmptySlice()
+	var k KeyType
+	p := s.ProveState(k)
+	if VerifyStateProof(s.StateRoot(), k, DataType{}, p) != nil {
+		t.Fatal("exclusion proof on empty state failed")
+	}
+	keys := make([]KeyType, 200)
+	vals := make([]DataType, 200)
+	for i := range keys {
+		rnd.Read(keys[i][:])
+		keys[i][0] = byte(rnd.Intn(3))
+		rnd.Read(vals[i][:])
+		s.Write(keys[i], vals[i])
+	}
+	root := s.UpdateStateRoot()
+	for i, k := range keys {
+		p := s.ProveState(k)
+		var buf bytes.Buffer
+		if err := EncodeStateProof(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+		p2, err := DecodeStateProof(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyStateProof(root, k, vals[i], p2); err != nil {
+			t.Fatalf("inclusion proof %d failed: %v", i, err)
+		}
+		if VerifyStateProof(root, k, vals[(i+1)%len(vals)], p2) == nil {
+			t.Fatalf("proof %d accepted a wrong value", i)
+		}
+		if VerifyStateProof(root, k, DataType{}, p2) == nil {
+			t.Fatalf("proof %d accepted absence of an existing key", i)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		var k KeyType
+		rnd.Read(k[:])
+		p := s.ProveState(k)
+		if err := VerifyStateProof(root, k, DataType{}, p); err != nil {
+			t.Fatalf("exclusion proof %d failed: %v", i, err)
+		}
+		if VerifyStateProof(root, keys[i], DataType{}, p) == nil {
+			t.Fatalf("exclusion proof %d accepted for an existing key", i)
+		}
+	}
+}
@@ -6,13 +6,32 @@ const KeyLen = 65
 const DataLen = 32
 const SliceKeyLen = sha256.Size
 const SliceDataPosLen = 16 + SliceKeyLen
+const HashLen = sha256.Size
+
+// keys starting with a byte not less than LocalKeyPrefix are node-local
+// (explorer indexes, merkle nodes, ...) and are not committed to the state root
+const LocalKeyPrefix = 0xf0
 
 type KeyType [KeyLen]byte
 type DataType [DataLen]byte
 type SliceKeyType [SliceKeyLen]byte
+type HashType [HashLen]byte
 
 type StorageEngineConfig struct {
 	FinalizeDepth int
 	DumpDiskRatio float64
 	Path          string
+	// total work of the chain ending at a slice, decoded from its data, the
+	// highest slice is the one with the most work (or height if it's nil)
+	SliceWork func(data []byte) HashType
+	// if set, the data of the slices above the stored root is passed through it
+	// when they are loaded, parents first, with the data of the parent, to
+	// upgrade data stored by older versions
+	MigrateData func(parent, data []byte) []byte
+	// keep the history of the state on disk, see archive.go
+	Archive bool
+	// number of finalized state entries cached in memory, see diskkv.go
+	StateCacheSize int
+	// where the engine is stored, NewFileBackend(Path, StateCacheSize) if nil
+	Backend Backend
 }
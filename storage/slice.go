@@ -1,22 +1,40 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"sync/atomic"
 )
 
+// A frozen slice is never changed, so it can be read without locks. The only
+// exception is its base, which the storage engine may replace by another slice
+// with the same state, after storing the root (see StorageEngine.storeRoot).
 type Slice struct {
-	base    *Slice
+	// *Slice
+	base    atomic.Value
 	height  int
 	st      map[KeyType]DataType
 	freezed bool
+	// reads the keys missing in the bottom slice, if set
+	reader func(k KeyType) DataType
+	// iterates over the keys of reader with the prefix
+	scan func(prefix []byte, fn func(k KeyType, v DataType)) error
+	// lists the keys of reader in order like Iterate, if set, otherwise they
+	// are listed with scan
+	list func(prefix []byte, start KeyType, limit int) ([]KeyValue, error)
+}
+
+type KeyValue struct {
+	Key   KeyType
+	Value DataType
 }
 
 func EmptySlice() *Slice {
 	return &Slice{
-		base:    nil,
 		height:  0,
 		st:      make(map[KeyType]DataType),
 		freezed: false,
@@ -24,12 +42,22 @@ func EmptySlice() *Slice {
 }
 
 func ForkSlice(base *Slice) *Slice {
-	return &Slice{
-		base:    base,
+	s := &Slice{
 		height:  base.height + 1,
 		st:      make(map[KeyType]DataType),
 		freezed: false,
 	}
+	s.setBase(base)
+	return s
+}
+
+func (s *Slice) getBase() *Slice {
+	b, _ := s.base.Load().(*Slice)
+	return b
+}
+
+func (s *Slice) setBase(b *Slice) {
+	s.base.Store(b)
 }
 
 func (s *Slice) Height() int {
@@ -37,22 +65,117 @@ func (s *Slice) Height() int {
 }
 
 func (s *Slice) Merge() {
+	base := s.getBase()
 	for k, v := range s.st {
-		s.base.st[k] = v
+		base.put(k, v)
 	}
 }
 
+// a zero value deletes the key: it's kept as a tombstone if it shadows a value
+// below, and dropped otherwise
+func (s *Slice) put(k KeyType, v DataType) {
+	if v == (DataType{}) && s.getBase() == nil && (s.reader == nil || s.reader(k) == (DataType{})) {
+		delete(s.st, k)
+		return
+	}
+	s.st[k] = v
+}
+
 func (s *Slice) Read(k KeyType) DataType {
 	u := s
 	for {
 		if v, ok := u.st[k]; ok {
 			return v
 		}
-		if u.base == nil {
+		b := u.getBase()
+		if b == nil {
+			if u.reader != nil {
+				return u.reader(k)
+			}
 			return DataType{}
 		}
-		u = u.base
+		u = b
+	}
+}
+
+// list the keys with the prefix, from start on in ascending order, at most
+// limit of them (no limit if negative), keys with zero values are skipped
+func (s *Slice) Iterate(prefix []byte, start KeyType, limit int) ([]KeyValue, error) {
+	over := make(map[KeyType]DataType)
+	u := s
+	for {
+		addKeyValues(over, u.st, prefix, start)
+		b := u.getBase()
+		if b == nil {
+			break
+		}
+		u = b
+	}
+	// the keys below may be shadowed by the ones above
+	n := limit
+	if n >= 0 {
+		n += len(over)
+	}
+	var below []KeyValue
+	var err error
+	if u.list != nil {
+		below, err = u.list(prefix, start, n)
+	} else if u.scan != nil {
+		below, err = listByScan(u.scan, prefix, start, n)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when iterating slice: %v", err)
 	}
+	return mergeKeyValues(below, over, limit), nil
+}
+
+// add the keys in st with the prefix from start on to over, unless they are
+// there already
+func addKeyValues(over, st map[KeyType]DataType, prefix []byte, start KeyType) {
+	for k, v := range st {
+		if _, ok := over[k]; ok {
+			continue
+		}
+		if bytes.HasPrefix(k[:], prefix) && bytes.Compare(k[:], start[:]) >= 0 {
+			over[k] = v
+		}
+	}
+}
+
+// the keys listed, with the keys in over replacing them, without zero values
+func mergeKeyValues(list []KeyValue, over map[KeyType]DataType, limit int) []KeyValue {
+	res := make([]KeyValue, 0, len(list)+len(over))
+	for _, kv := range list {
+		if _, ok := over[kv.Key]; !ok && kv.Value != (DataType{}) {
+			res = append(res, kv)
+		}
+	}
+	for k, v := range over {
+		if v != (DataType{}) {
+			res = append(res, KeyValue{Key: k, Value: v})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return bytes.Compare(res[i].Key[:], res[j].Key[:]) < 0
+	})
+	if limit >= 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+// list the keys like Iterate by scanning all the keys with the prefix
+func listByScan(scan func(prefix []byte, fn func(k KeyType, v DataType)) error, prefix []byte, start KeyType, limit int) ([]KeyValue, error) {
+	found := make(map[KeyType]DataType)
+	err := scan(prefix, func(k KeyType, v DataType) {
+		if bytes.Compare(k[:], start[:]) >= 0 {
+			found[k] = v
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeKeyValues(nil, found, limit), nil
 }
 
 func (s *Slice) Write(k KeyType, v DataType) {
@@ -101,19 +224,30 @@ func (s *Slice) LoadFile(f io.Reader) error {
 	return nil
 }
 
+// tombstones are only dumped if the slice has something below
 func (s *Slice) DumpFile(f io.Writer) error {
+	tombstones := s.getBase() != nil || s.reader != nil
+	cnt := 0
+	for _, v := range s.st {
+		if tombstones || v != (DataType{}) {
+			cnt++
+		}
+	}
 	lbuf := make([]byte, 8)
 	binary.LittleEndian.PutUint64(lbuf, uint64(s.height))
 	_, err := f.Write(lbuf)
 	if err != nil {
 		return fmt.Errorf("error when dumping slice: %v", err)
 	}
-	binary.LittleEndian.PutUint64(lbuf, uint64(len(s.st)))
+	binary.LittleEndian.PutUint64(lbuf, uint64(cnt))
 	_, err = f.Write(lbuf)
 	if err != nil {
 		return fmt.Errorf("error when dumping slice: %v", err)
 	}
 	for k, v := range s.st {
+		if !tombstones && v == (DataType{}) {
+			continue
+		}
 		_, err = f.Write(k[:])
 		if err != nil {
 			return fmt.Errorf("error when dumping slice: %v", err)
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
 	"os"
 	"testing"
@@ -68,3 +69,94 @@ func TestSliceBase(t *testing.T) {
 		}
 	}
 }
+
+func TestSliceIterate(t *testing.T) {
+	key := func(p byte, i int) KeyType {
+		k := KeyType{p}
+		binary.BigEndian.PutUint64(k[1:9], uint64(i))
+		return k
+	}
+	a := EmptySlice()
+	for i := 0; i < 10; i++ {
+		a.Write(key(1, i), DataType{byte(i + 1)})
+		a.Write(key(2, i), DataType{byte(i + 1)})
+	}
+	a.Freeze()
+	b := ForkSlice(a)
+	b.Write(key(1, 3), DataType{})
+	b.Write(key(1, 4), DataType{100})
+	b.Write(key(1, 20), DataType{20})
+	b.Freeze()
+	c := ForkSlice(b)
+	c.Write(key(1, 3), DataType{30})
+	c.Write(key(1, 5), DataType{})
+
+	res, err := b.Iterate([]byte{1}, KeyType{}, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []int{0, 1, 2, 4, 5, 6, 7, 8, 9, 20}
+	if len(res) != len(exp) {
+		t.Fatalf("wrong length %d", len(res))
+	}
+	for i, kv := range res {
+		if kv.Key != key(1, exp[i]) || kv.Value != b.Read(kv.Key) {
+			t.Fatalf("wrong entry %d: %x", i, kv.Key)
+		}
+	}
+	res, err = c.Iterate([]byte{1}, key(1, 3), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || res[0].Value != (DataType{30}) || res[1].Value != (DataType{100}) || res[2].Key != key(1, 6) {
+		t.Fatalf("wrong result: %v", res)
+	}
+}
+
+func TestSliceTombstone(t *testing.T) {
+	a := EmptySlice()
+	a.Write(KeyType{1}, DataType{1})
+	a.Write(KeyType{2}, DataType{2})
+	a.Freeze()
+	b := ForkSlice(a)
+	b.Write(KeyType{1}, DataType{})
+	b.Write(KeyType{3}, DataType{})
+	c := ForkSlice(b)
+	c.Write(KeyType{2}, DataType{})
+	if c.Read(KeyType{1}) != (DataType{}) || b.Read(KeyType{2}) != (DataType{2}) {
+		t.Fatal("tombstone should shadow the parent value")
+	}
+	// merging into an overlay keeps the tombstone
+	c.Merge()
+	if v, ok := b.st[KeyType{2}]; !ok || v != (DataType{}) {
+		t.Fatal("tombstone dropped from overlay")
+	}
+	var buf bytes.Buffer
+	err := b.DumpFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := EmptySlice()
+	err = d.LoadFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.st) != 3 {
+		t.Fatalf("tombstones not dumped: %d", len(d.st))
+	}
+	// merging into the bottom deletes the keys
+	a.freezed = false
+	b.Merge()
+	if len(a.st) != 0 {
+		t.Fatalf("deleted keys left in the bottom slice: %d", len(a.st))
+	}
+	a.Write(KeyType{4}, DataType{})
+	buf.Reset()
+	err = a.DumpFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 16 {
+		t.Fatal("zero values dumped from the bottom slice")
+	}
+}
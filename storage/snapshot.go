@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A snapshot is the stored root state of a backend, with the key and data of
+// the slice at its height, so a node can start from it instead of the init
+// slice. The file is the magic, the height, the key, the length and content
+// of the data, the number of state entries, the entries, and the sha256 of all
+// of them.
+const snapshotMagic = "tcoinsn1"
+
+// the state is stored in batches when importing
+const snapshotBatchSize = 1 << 16
+
+var ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+type SnapshotInfo struct {
+	Height int
+	Key    SliceKeyType
+	Data   []byte
+}
+
+// export the stored root state, the backend must not be written meanwhile
+func ExportSnapshot(b Backend, w io.Writer) (*SnapshotInfo, error) {
+	info := &SnapshotInfo{Height: b.StateHeight()}
+	if info.Height == -1 {
+		return nil, errors.New("nothing stored")
+	}
+	var err error
+	info.Key, err = b.ReadKey(info.Height)
+	if err != nil {
+		return nil, err
+	}
+	info.Data, err = b.ReadData(info.Height)
+	if err != nil {
+		return nil, err
+	}
+	// zero values may be left by older versions
+	cnt := 0
+	err = b.ForEachState(nil, func(k KeyType, v DataType) {
+		if v != (DataType{}) {
+			cnt++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	tmp := make([]byte, 8)
+	bw.WriteString(snapshotMagic)
+	binary.LittleEndian.PutUint64(tmp, uint64(info.Height))
+	bw.Write(tmp)
+	bw.Write(info.Key[:])
+	binary.LittleEndian.PutUint64(tmp, uint64(len(info.Data)))
+	bw.Write(tmp)
+	bw.Write(info.Data)
+	binary.LittleEndian.PutUint64(tmp, uint64(cnt))
+	bw.Write(tmp)
+	err = b.ForEachState(nil, func(k KeyType, v DataType) {
+		if v == (DataType{}) {
+			return
+		}
+		bw.Write(k[:])
+		bw.Write(v[:])
+		cnt--
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cnt != 0 {
+		return nil, errors.New("state changed while exporting")
+	}
+	err = bw.Flush()
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func readSnapshotHeader(r io.Reader) (*SnapshotInfo, uint64, error) {
+	head := make([]byte, len(snapshotMagic)+16+SliceKeyLen)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return nil, 0, err
+	}
+	if string(head[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, 0, errors.New("not a snapshot")
+	}
+	head = head[len(snapshotMagic):]
+	info := &SnapshotInfo{Height: int(binary.LittleEndian.Uint64(head[:8]))}
+	copy(info.Key[:], head[8:8+SliceKeyLen])
+	n := binary.LittleEndian.Uint64(head[8+SliceKeyLen:])
+	if n > 1<<30 {
+		return nil, 0, errors.New("snapshot data too long")
+	}
+	info.Data = make([]byte, n)
+	_, err = io.ReadFull(r, info.Data)
+	if err != nil {
+		return nil, 0, err
+	}
+	tmp := make([]byte, 8)
+	_, err = io.ReadFull(r, tmp)
+	if err != nil {
+		return nil, 0, err
+	}
+	return info, binary.LittleEndian.Uint64(tmp), nil
+}
+
+// verify the checksum of the snapshot file, and read its header
+func ReadSnapshotInfo(fn string) (*SnapshotInfo, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() < HashLen {
+		return nil, ErrSnapshotChecksum
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, bufio.NewReader(io.NewSectionReader(f, 0, st.Size()-HashLen)))
+	if err != nil {
+		return nil, err
+	}
+	sum := make([]byte, HashLen)
+	_, err = f.ReadAt(sum, st.Size()-HashLen)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return nil, ErrSnapshotChecksum
+	}
+	info, cnt, err := readSnapshotHeader(bufio.NewReader(io.NewSectionReader(f, 0, st.Size()-HashLen)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(st.Size())-HashLen-uint64(len(snapshotMagic)+24+SliceKeyLen+len(info.Data)) != cnt*(KeyLen+DataLen) {
+		return nil, errors.New("snapshot size mismatch")
+	}
+	return info, nil
+}
+
+// store the snapshot into an empty backend, check is called with its header
+// before anything is written
+func ImportSnapshot(b Backend, fn string, check func(info *SnapshotInfo) error) (*SnapshotInfo, error) {
+	if b.StateHeight() != -1 {
+		return nil, errors.New("backend not empty")
+	}
+	info, err := ReadSnapshotInfo(fn)
+	if err != nil {
+		return nil, err
+	}
+	if check != nil {
+		err = check(info)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	_, cnt, err := readSnapshotHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	// the data is written last, so an interrupted import can't be loaded
+	st := make(map[KeyType]DataType)
+	var k KeyType
+	var v DataType
+	for i := uint64(0); i < cnt; i++ {
+		_, err = io.ReadFull(r, k[:])
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(r, v[:])
+		if err != nil {
+			return nil, err
+		}
+		st[k] = v
+		if len(st) == snapshotBatchSize || i == cnt-1 {
+			err = b.CommitState(info.Height, st)
+			if err != nil {
+				return nil, fmt.Errorf("failed to store state: %v", err)
+			}
+			st = make(map[KeyType]DataType)
+		}
+	}
+	if cnt == 0 {
+		err = b.CommitState(info.Height, st)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store state: %v", err)
+		}
+	}
+	err = b.WriteData(info.Height, []SliceKeyType{info.Key}, [][]byte{info.Data})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store data: %v", err)
+	}
+	return info, nil
+}
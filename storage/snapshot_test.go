@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	config := StorageEngineConfig{
+		FinalizeDepth: 3,
+		DumpDiskRatio: 0.8,
+		Path:          "/tmp/tcoin_test/sto_test_snapshot",
+	}
+	err := os.RemoveAll(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := EmptySlice()
+	is.Write(KeyType{1}, DataType{1})
+	e, err := NewStorageEngine(config, is, SliceKeyType{}, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := SliceKeyType{}
+	for i := 1; i <= 10; i++ {
+		s := ForkSlice(e.ss[cur])
+		s.Write(KeyType{2, byte(i)}, DataType{byte(i)})
+		s.Freeze()
+		sk := SliceKeyType{byte(i)}
+		err = e.AddFreezedSlice(s, sk, cur, []byte{byte(i), 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur = sk
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Stop()
+
+	b, err := NewFileBackend(config.Path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := "/tmp/tcoin_test/snapshot"
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ExportSnapshot(b, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	b.Close()
+	if info.Height != 7 || info.Key != (SliceKeyType{7}) || !bytes.Equal(info.Data, []byte{7, 100}) {
+		t.Fatalf("wrong snapshot info: %v", info)
+	}
+
+	mb := NewMemoryBackend()
+	_, err = ImportSnapshot(mb, fn, func(info *SnapshotInfo) error {
+		if info.Height != 7 {
+			t.Fatalf("wrong height %d", info.Height)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Backend = mb
+	e, err = NewStorageEngine(config, EmptySlice(), SliceKeyType{}, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Head().Slice.Height() != 7 {
+		t.Fatalf("wrong height %d", e.Head().Slice.Height())
+	}
+	if e.Head().Slice.Read(KeyType{1}) != (DataType{1}) || e.Head().Slice.Read(KeyType{2, 7}) != (DataType{7}) {
+		t.Fatal("wrong state")
+	}
+	d, err := e.ReadData(7, SliceKeyType{7})
+	if err != nil || !bytes.Equal(d, []byte{7, 100}) {
+		t.Fatalf("wrong data: %v %v", d, err)
+	}
+	_, err = e.ReadData(6, SliceKeyType{6})
+	if err == nil {
+		t.Fatal("data below the snapshot should be missing")
+	}
+	// go on from the snapshot
+	s := ForkSlice(e.Head().Slice)
+	s.Write(KeyType{2, 8}, DataType{8})
+	s.Freeze()
+	err = e.AddFreezedSlice(s, SliceKeyType{8}, SliceKeyType{7}, []byte{8, 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Head().Slice.Height() != 8 {
+		t.Fatal("can't extend the snapshot")
+	}
+	e.Stop()
+
+	_, err = ImportSnapshot(NewMemoryBackend(), fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[100] ^= 1
+	err = ioutil.WriteFile(fn, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ImportSnapshot(NewMemoryBackend(), fn, nil)
+	if err != ErrSnapshotChecksum {
+		t.Fatalf("corrupted snapshot accepted: %v", err)
+	}
+}
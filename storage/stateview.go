@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// A view of the stored root state as it was when the view was created. When
+// the state is committed past it, the values the changed keys had before are
+// kept in undo, so the slices reading through the view don't see later heights.
+type stateView struct {
+	backend Backend
+	// set before closed, and not changed after
+	undo   map[KeyType]DataType
+	next   *stateView
+	closed int32
+}
+
+func newStateView(backend Backend) *stateView {
+	return &stateView{backend: backend}
+}
+
+// the first open view from this one, with the undo values on the way
+func (v *stateView) open(fn func(undo map[KeyType]DataType) bool) *stateView {
+	u := v
+	for atomic.LoadInt32(&u.closed) == 1 {
+		if !fn(u.undo) {
+			return nil
+		}
+		u = u.next
+	}
+	return u
+}
+
+func (v *stateView) read(k KeyType) DataType {
+	for {
+		var res DataType
+		found := false
+		u := v.open(func(undo map[KeyType]DataType) bool {
+			res, found = undo[k]
+			return !found
+		})
+		if found {
+			return res
+		}
+		res = v.backend.ReadState(k)
+		// the state wasn't committed during the read
+		if atomic.LoadInt32(&u.closed) == 0 {
+			return res
+		}
+	}
+}
+
+func (v *stateView) scan(prefix []byte, fn func(k KeyType, v DataType)) error {
+	for {
+		over := make(map[KeyType]DataType)
+		u := v.open(func(undo map[KeyType]DataType) bool {
+			for k, d := range undo {
+				if _, ok := over[k]; !ok && bytes.HasPrefix(k[:], prefix) {
+					over[k] = d
+				}
+			}
+			return true
+		})
+		res := []KeyValue{}
+		err := v.backend.ForEachState(prefix, func(k KeyType, d DataType) {
+			if _, ok := over[k]; !ok {
+				res = append(res, KeyValue{Key: k, Value: d})
+			}
+		})
+		// a scan may fail when the table is rebuilt by a commit
+		if atomic.LoadInt32(&u.closed) == 1 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, kv := range res {
+			fn(kv.Key, kv.Value)
+		}
+		for k, d := range over {
+			if d != (DataType{}) {
+				fn(k, d)
+			}
+		}
+		return nil
+	}
+}
+
+func (v *stateView) list(prefix []byte, start KeyType, limit int) ([]KeyValue, error) {
+	for {
+		over := make(map[KeyType]DataType)
+		u := v.open(func(undo map[KeyType]DataType) bool {
+			addKeyValues(over, undo, prefix, start)
+			return true
+		})
+		n := limit
+		if n >= 0 {
+			n += len(over)
+		}
+		res, err := v.backend.IterateState(prefix, start, n)
+		if atomic.LoadInt32(&u.closed) == 1 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return mergeKeyValues(res, over, limit), nil
+	}
+}
+
+// called before the changes are committed to the backend, with the values
+// they replace, returns the view of the state after them
+func (v *stateView) close(undo map[KeyType]DataType) *stateView {
+	v.undo = undo
+	v.next = newStateView(v.backend)
+	atomic.StoreInt32(&v.closed, 1)
+	return v.next
+}
+
+// a bottom slice reading the view
+func (v *stateView) slice(height int) *Slice {
+	return &Slice{
+		height:  height,
+		st:      make(map[KeyType]DataType),
+		freezed: true,
+		reader:  v.read,
+		scan:    v.scan,
+		list:    v.list,
+	}
+}
@@ -1,16 +1,11 @@
 package storage
 
 import (
-	"bufio"
-	"encoding/binary"
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"os"
-	"path/filepath"
 	"sort"
 	"sync"
 	"time"
@@ -26,6 +21,19 @@ type SliceChain struct {
 	S   *Slice
 }
 
+// a view of the highest chain, the slices in it are never changed
+type Head struct {
+	// the highest slice
+	Slice *Slice
+	// the slices from the root to the highest one
+	Chain []SliceChain
+}
+
+// The maps below are changed with mut held, the slices are never changed once
+// added, so they are read without it. Merging a slice into the root only moves
+// the root up, the root and the slices below it down to the stored state are
+// committed together when storing it. Adding and finalizing slices is
+// serialized by addMut, and merging into the root and storing it by rootMut.
 type StorageEngine struct {
 	config       StorageEngineConfig
 	ss           map[SliceKeyType]*Slice
@@ -35,31 +43,37 @@ type StorageEngine struct {
 	ldata        map[int][]byte
 	root         SliceKeyType
 	rq           []recycle
-	fDataPosR    *os.File
-	fDataPosW    *os.File
-	fDataR       *os.File
-	fDataW       *os.File
-	HighestSlice *Slice
-	HighestChain []SliceChain
-	stop         chan bool
-	stopped      chan bool
-	flush        chan bool
-	flushed      chan error
-	ldMut        sync.Mutex
-	rootMut      chan bool
+	backend      Backend
+	highest      *Slice
+	highestChain []SliceChain
+	highestWork  HashType
+	archive      *archive
+	// the stored state, read by the bottom slice
+	state *stateView
+	// an entry failed to be written to the log since the last store, so the
+	// temp slices have to be kept
+	logBroken bool
+	stop      chan bool
+	stopped   chan bool
+	flush     chan bool
+	flushed   chan error
+	ldMut     sync.Mutex
+	rootMut   chan bool
+	mut       sync.RWMutex
+	addMut    sync.Mutex
 }
 
 func NewStorageEngine(config StorageEngineConfig, initSlice *Slice, initKey SliceKeyType, initData []byte) (*StorageEngine, error) {
 	if initSlice.height != 0 {
 		return nil, errors.New("init slice must have height 0")
 	}
-	err := os.MkdirAll(filepath.Join(config.Path, "perm"), 0o755)
-	if err != nil {
-		return nil, fmt.Errorf("error when creating storage engine: %v", err)
-	}
-	err = os.MkdirAll(filepath.Join(config.Path, "temp"), 0o755)
-	if err != nil {
-		return nil, fmt.Errorf("error when creating storage engine: %v", err)
+	backend := config.Backend
+	if backend == nil {
+		var err error
+		backend, err = NewFileBackend(config.Path, config.StateCacheSize)
+		if err != nil {
+			return nil, fmt.Errorf("error when creating storage engine: %v", err)
+		}
 	}
 	e := &StorageEngine{
 		config:  config,
@@ -70,6 +84,7 @@ func NewStorageEngine(config StorageEngineConfig, initSlice *Slice, initKey Slic
 		ldata:   make(map[int][]byte),
 		root:    SliceKeyType{},
 		rq:      []recycle{},
+		backend: backend,
 		stop:    make(chan bool, 1),
 		stopped: make(chan bool, 1),
 		flush:   make(chan bool, 1),
@@ -77,87 +92,50 @@ func NewStorageEngine(config StorageEngineConfig, initSlice *Slice, initKey Slic
 		ldMut:   sync.Mutex{},
 		rootMut: make(chan bool, 1),
 	}
-	dataFn := filepath.Join(config.Path, "perm", "data")
-	dataPosFn := filepath.Join(config.Path, "perm", "datapos")
-	ssFn := filepath.Join(e.config.Path, "perm", "ss")
-	if _, err := os.Stat(ssFn); errors.Is(err, os.ErrNotExist) {
+	e.state = newStateView(backend)
+	if backend.StateHeight() == -1 {
+		initSlice.reader = e.state.read
+		initSlice.scan = e.state.scan
+		initSlice.list = e.state.list
 		e.ss[initKey] = initSlice
 		e.data[initKey] = initData
 		e.root = initKey
-		e.fDataW, err = os.OpenFile(dataFn, os.O_CREATE|os.O_WRONLY, 0o644)
-		if err != nil {
-			return nil, fmt.Errorf("error when creating storage engine: %v", err)
-		}
-		e.fDataPosW, err = os.OpenFile(dataPosFn, os.O_CREATE|os.O_WRONLY, 0o644)
-		if err != nil {
-			return nil, fmt.Errorf("error when creating storage engine: %v", err)
-		}
-		e.fDataR, err = os.Open(dataFn)
-		if err != nil {
-			return nil, fmt.Errorf("error when creating storage engine: %v", err)
-		}
-		e.fDataPosR, err = os.Open(dataPosFn)
-		if err != nil {
-			return nil, fmt.Errorf("error when creating storage engine: %v", err)
-		}
 		e.rq = append(e.rq, recycle{
 			height: -1,
 			id:     SliceKeyType{},
 		})
 		e.ldata[0] = initData
-		err = e.storeRoot()
+		err := e.storeRoot()
 		if err != nil {
 			return nil, fmt.Errorf("error when creating storage engine: %v", err)
 		}
 	} else {
-		e.fDataW, err = os.OpenFile(dataFn, os.O_APPEND|os.O_WRONLY, 0o644)
-		if err != nil {
-			return nil, fmt.Errorf("error when loading storage engine: %v", err)
-		}
-		e.fDataPosW, err = os.OpenFile(dataPosFn, os.O_APPEND|os.O_WRONLY, 0o644)
-		if err != nil {
-			return nil, fmt.Errorf("error when loading storage engine: %v", err)
-		}
-		e.fDataR, err = os.Open(dataFn)
-		if err != nil {
-			return nil, fmt.Errorf("error when loading storage engine: %v", err)
-		}
-		e.fDataPosR, err = os.Open(dataPosFn)
-		if err != nil {
-			return nil, fmt.Errorf("error when loading storage engine: %v", err)
-		}
-		f, err := os.Open(ssFn)
-		if err != nil {
-			return nil, fmt.Errorf("error when loading storage engine: %v", err)
-		}
-		st := EmptySlice()
-		err = st.LoadFile(bufio.NewReader(f))
-		if err != nil {
-			return nil, fmt.Errorf("error when loading storage engine: %v", err)
-		}
+		st := e.state.slice(backend.StateHeight())
 		key, err := e.ReadKey(st.height)
 		if err != nil {
 			return nil, fmt.Errorf("error when loading storage engine: %v", err)
 		}
-		offset, length, err := e.ReadOffset(st.height)
-		if err != nil {
-			return nil, fmt.Errorf("error when loading storage engine: %v", err)
-		}
-		_, err = e.fDataPosW.Seek(int64((st.height+1)*SliceDataPosLen), io.SeekStart)
-		if err != nil {
-			return nil, fmt.Errorf("error when loading storage engine: %v", err)
+		e.ss[key] = st
+		e.root = key
+	}
+	if config.Archive {
+		if config.Path == "" {
+			return nil, errors.New("archive mode needs a storage path")
 		}
-		_, err = e.fDataW.Seek(int64(offset+length), io.SeekStart)
+		var err error
+		e.archive, err = openArchive(config.Path, e.ss[e.root].height, e.forEachRoot)
 		if err != nil {
-			return nil, fmt.Errorf("error when loading storage engine: %v", err)
+			return nil, fmt.Errorf("error when opening archive: %v", err)
 		}
-		e.ss[key] = st
-		e.root = key
+	}
+	err := e.replayLog()
+	if err != nil {
+		return nil, fmt.Errorf("error when replaying log: %v", err)
 	}
 	e.loadSubtrees()
 	ts := EmptySlice()
 	ts.height = -1
-	e.HighestSlice = ts
+	e.highest = ts
 	for k := range e.ss {
 		e.maintainHighest(k)
 	}
@@ -165,84 +143,126 @@ func NewStorageEngine(config StorageEngineConfig, initSlice *Slice, initKey Slic
 	return e, nil
 }
 
-type subtreeCandidate struct {
-	key SliceKeyType
-	s   *Slice
-}
-
-type subtreeCandidates []subtreeCandidate
-
-func (s subtreeCandidates) Len() int {
-	return len(s)
-}
-
-func (s subtreeCandidates) Less(i, j int) bool {
-	return s[i].s.height < s[j].s.height
-}
-
-func (s subtreeCandidates) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
-}
-
 func (e *StorageEngine) loadSubtrees() {
-	files, err := ioutil.ReadDir(filepath.Join(e.config.Path, "temp"))
+	ts, err := e.backend.LoadTemps()
 	if err != nil {
 		return
 	}
-	var keys []SliceKeyType
-	for _, file := range files {
-		if len(file.Name()) == SliceKeyLen*2 {
-			bs, err := hex.DecodeString(file.Name())
-			if err == nil && len(bs) == SliceKeyLen {
-				var key SliceKeyType
-				copy(key[:], bs)
-				keys = append(keys, key)
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].S.height < ts[j].S.height
+	})
+	for _, t := range ts {
+		if fas, ok := e.ss[t.Parent]; ok {
+			d, err := e.migrateData(fas.height, t.Parent, t.Data)
+			if err != nil {
+				continue
+			}
+			t.S.setBase(fas)
+			e.ss[t.Key] = t.S
+			e.fa[t.Key] = t.Parent
+			e.data[t.Key] = d
+			u, ok := e.son[t.Parent]
+			if ok {
+				e.son[t.Parent] = append(u, t.Key)
+			} else {
+				e.son[t.Parent] = []SliceKeyType{t.Key}
 			}
 		}
 	}
-	ss := subtreeCandidates{}
-	for _, key := range keys {
-		f, err := os.Open(e.GetTempFileName(key))
-		if err != nil {
+}
+
+// apply the log on top of the stored root state, the slices in it are written
+// again at the next store
+func (e *StorageEngine) replayLog() error {
+	ls, err := e.backend.ReadLog()
+	if err != nil {
+		return err
+	}
+	root := e.ss[e.root]
+	for _, l := range ls {
+		if l.Height <= root.height {
 			continue
 		}
-		s := EmptySlice()
-		err = s.LoadFile(bufio.NewReader(f))
+		if l.Height != root.height+1 {
+			e.logBroken = true
+			break
+		}
+		d, err := e.migrateData(root.height, e.root, l.Data)
 		if err != nil {
-			f.Close()
-			continue
+			return err
+		}
+		if e.archive != nil {
+			err := e.archive.append(l.Height, l.Changes)
+			if err != nil {
+				log.Printf("failed to archive height %d: %v", l.Height, err)
+			}
+		}
+		for k, v := range l.Changes {
+			root.put(k, v)
+		}
+		if d, ok := e.data[e.root]; ok {
+			e.ldata[root.height] = d
+			delete(e.data, e.root)
 		}
-		f.Close()
-		ss = append(ss, subtreeCandidate{
-			key: key,
-			s:   s,
+		e.rq = append(e.rq, recycle{
+			height: root.height,
+			id:     e.root,
 		})
+		delete(e.ss, e.root)
+		root.height = l.Height
+		e.root = l.Key
+		e.ss[e.root] = root
+		e.data[e.root] = d
 	}
-	sort.Sort(ss)
-	for _, sc := range ss {
-		d, err := ioutil.ReadFile(e.GetTempFileName(sc.key) + ".b")
-		if err != nil || len(d) < SliceKeyLen {
-			continue
-		}
-		var fa SliceKeyType
-		copy(fa[:], d[:SliceKeyLen])
-		if fas, ok := e.ss[fa]; ok {
-			sc.s.base = fas
-			e.ss[sc.key] = sc.s
-			e.fa[sc.key] = fa
-			e.data[sc.key] = d[SliceKeyLen:]
-			u, ok := e.son[fa]
-			if ok {
-				e.son[fa] = append(u, sc.key)
-			} else {
-				e.son[fa] = []SliceKeyType{sc.key}
+	return nil
+}
+
+// the data of a slice loaded on top of the parent, see MigrateData
+func (e *StorageEngine) migrateData(height int, parent SliceKeyType, data []byte) ([]byte, error) {
+	if e.config.MigrateData == nil {
+		return data, nil
+	}
+	pd, err := e.ReadData(height, parent)
+	if err != nil {
+		return nil, err
+	}
+	return e.config.MigrateData(pd, data), nil
+}
+
+// the changes of the root slice and the slices below it since the state was
+// stored, which are committed when storing the root
+func (e *StorageEngine) rootChanges() map[KeyType]DataType {
+	e.mut.RLock()
+	u := e.ss[e.root]
+	e.mut.RUnlock()
+	res := make(map[KeyType]DataType)
+	for ; u != nil; u = u.getBase() {
+		for k, v := range u.st {
+			if _, ok := res[k]; !ok {
+				res[k] = v
 			}
 		}
 	}
+	return res
 }
 
-func (e *StorageEngine) GetTempFileName(k SliceKeyType) string {
-	return filepath.Join(e.config.Path, "temp", hex.EncodeToString(k[:]))
+// iterate over the full state of the root slice, without deleted keys
+func (e *StorageEngine) forEachRoot(fn func(k KeyType, v DataType)) error {
+	st := e.rootChanges()
+	err := e.backend.ForEachState(nil, func(k KeyType, v DataType) {
+		if _, ok := st[k]; !ok && v != (DataType{}) {
+			fn(k, v)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range st {
+		if v != (DataType{}) {
+			fn(k, v)
+		}
+	}
+	return nil
 }
 
 // freeze a slice (no further write operations)
@@ -250,12 +270,15 @@ func (e *StorageEngine) AddFreezedSlice(s *Slice, k SliceKeyType, f SliceKeyType
 	if !s.freezed {
 		return errors.New("not freezed yet")
 	}
+	e.addMut.Lock()
+	defer e.addMut.Unlock()
 	if _, ok := e.ss[k]; ok {
 		return errors.New("key already exists in storage engine")
 	}
 	if _, ok := e.ss[f]; !ok {
 		return errors.New("parent not exist in storage engine")
 	}
+	e.mut.Lock()
 	e.ss[k] = s
 	e.fa[k] = f
 	e.data[k] = data
@@ -265,30 +288,17 @@ func (e *StorageEngine) AddFreezedSlice(s *Slice, k SliceKeyType, f SliceKeyType
 	} else {
 		e.son[f] = []SliceKeyType{k}
 	}
-	fl, err := os.OpenFile(e.GetTempFileName(k), os.O_CREATE|os.O_WRONLY, 0o644)
-	if err != nil {
-		return fmt.Errorf("error when creating file %s: %v", e.GetTempFileName(k), err)
-	}
-	bf := bufio.NewWriter(fl)
-	err = s.DumpFile(bf)
-	if err != nil {
-		fl.Close()
-		return fmt.Errorf("error when writing file %s: %v", e.GetTempFileName(k), err)
-	}
-	err = bf.Flush()
-	if err != nil {
-		fl.Close()
-		return fmt.Errorf("error when writing file %s: %v", e.GetTempFileName(k), err)
-	}
-	err = fl.Close()
-	if err != nil {
-		return fmt.Errorf("error when closing file %s: %v", e.GetTempFileName(k), err)
-	}
-	err = ioutil.WriteFile(e.GetTempFileName(k)+".b", append(f[:], data...), 0o755)
+	e.mut.Unlock()
+	err := e.backend.StoreTemp(&TempSlice{
+		Key:    k,
+		Parent: f,
+		S:      s,
+		Data:   data,
+	})
 	if err != nil {
-		return fmt.Errorf("error when writing file %s: %v", e.GetTempFileName(k)+".b", err)
+		return err
 	}
-	err = e.FinalizeSlice(k)
+	err = e.finalizeSlice(k)
 	if err != nil {
 		return fmt.Errorf("error when finalizing %s: %v", hex.EncodeToString(k[:]), err)
 	}
@@ -298,6 +308,13 @@ func (e *StorageEngine) AddFreezedSlice(s *Slice, k SliceKeyType, f SliceKeyType
 
 // finalize a slice (can't change it anymore)
 func (e *StorageEngine) FinalizeSlice(k SliceKeyType) error {
+	e.addMut.Lock()
+	defer e.addMut.Unlock()
+	return e.finalizeSlice(k)
+}
+
+// the maps are only changed with addMut held, so they can be read without mut
+func (e *StorageEngine) finalizeSlice(k SliceKeyType) error {
 	for i := 0; i < e.config.FinalizeDepth; i++ {
 		var ok bool
 		k, ok = e.fa[k]
@@ -305,6 +322,7 @@ func (e *StorageEngine) FinalizeSlice(k SliceKeyType) error {
 			return nil
 		}
 	}
+	e.mut.Lock()
 	t := k
 	for {
 		fa, ok := e.fa[t]
@@ -320,6 +338,7 @@ func (e *StorageEngine) FinalizeSlice(k SliceKeyType) error {
 		e.son[fa] = []SliceKeyType{t}
 		t = fa
 	}
+	e.mut.Unlock()
 	select {
 	case e.rootMut <- true:
 		e.mergeFa(k)
@@ -330,15 +349,22 @@ func (e *StorageEngine) FinalizeSlice(k SliceKeyType) error {
 }
 
 func (e *StorageEngine) maintainHighest(k SliceKeyType) {
-	e.rootMut <- true
-	defer func() {
-		<-e.rootMut
-	}()
 	s := e.ss[k]
-	if s.height <= e.HighestSlice.height {
-		return
+	if e.config.SliceWork == nil {
+		if s.height <= e.highest.height {
+			return
+		}
+	} else {
+		d, err := e.ReadData(s.height, k)
+		if err != nil {
+			return
+		}
+		w := e.config.SliceWork(d)
+		if e.highest.height != -1 && bytes.Compare(w[:], e.highestWork[:]) <= 0 {
+			return
+		}
+		e.highestWork = w
 	}
-	e.HighestSlice = s
 	ch := make([]SliceChain, 0)
 	for k != e.root {
 		ch = append(ch, SliceChain{
@@ -354,7 +380,21 @@ func (e *StorageEngine) maintainHighest(k SliceKeyType) {
 	for i := 0; i*2 < len(ch); i++ {
 		ch[i], ch[len(ch)-i-1] = ch[len(ch)-i-1], ch[i]
 	}
-	e.HighestChain = ch
+	e.mut.Lock()
+	e.highest = s
+	e.highestChain = ch
+	e.mut.Unlock()
+}
+
+// the highest slice and the chain to it, whose states stay the same after
+// they are merged into the root
+func (e *StorageEngine) Head() Head {
+	e.mut.RLock()
+	defer e.mut.RUnlock()
+	return Head{
+		Slice: e.highest,
+		Chain: e.highestChain,
+	}
 }
 
 func (e *StorageEngine) discardSubtree(k SliceKeyType) {
@@ -365,8 +405,7 @@ func (e *StorageEngine) discardSubtree(k SliceKeyType) {
 		}
 		delete(e.son, k)
 	}
-	os.Remove(e.GetTempFileName(k))
-	os.Remove(e.GetTempFileName(k) + ".b")
+	e.backend.RemoveTemp(k)
 	delete(e.ss, k)
 	delete(e.fa, k)
 	delete(e.data, k)
@@ -380,11 +419,29 @@ func (e *StorageEngine) mergeFa(k SliceKeyType) {
 	e.mergeFa(fa)
 	a := e.ss[fa]
 	b := e.ss[k]
-	for k, v := range b.st {
-		a.st[k] = v
+	if e.archive != nil {
+		err := e.archive.append(b.height, b.st)
+		if err != nil {
+			log.Printf("failed to archive height %d: %v", b.height, err)
+		}
+	}
+	if !e.logBroken {
+		err := e.backend.AppendLog(&LogEntry{
+			Height:  b.height,
+			Key:     k,
+			Data:    e.data[k],
+			Changes: b.st,
+		})
+		if err != nil {
+			log.Printf("failed to write log of height %d: %v", b.height, err)
+			e.logBroken = true
+		} else {
+			// the log keeps the slice now
+			e.backend.RemoveTemp(k)
+		}
 	}
-	b.st = a.st
-	b.base = nil
+	// the slices are kept as they are, so the views of them don't change
+	e.mut.Lock()
 	delete(e.ss, fa)
 	delete(e.fa, k)
 	e.ldMut.Lock()
@@ -392,43 +449,26 @@ func (e *StorageEngine) mergeFa(k SliceKeyType) {
 	e.ldMut.Unlock()
 	delete(e.data, fa)
 	delete(e.son, fa)
+	e.root = k
+	e.mut.Unlock()
 	e.rq = append(e.rq, recycle{
 		height: a.height,
 		id:     fa,
 	})
-	e.root = k
 }
 
 func (e *StorageEngine) ReadKey(height int) (SliceKeyType, error) {
-	_, err := e.fDataPosR.Seek(int64(SliceDataPosLen*height+16), io.SeekStart)
-	if err != nil {
-		return SliceKeyType{}, fmt.Errorf("failed to read key of height %d: %v", height, err)
-	}
-	var res SliceKeyType
-	_, err = io.ReadFull(e.fDataPosR, res[:])
+	k, err := e.backend.ReadKey(height)
 	if err != nil {
 		return SliceKeyType{}, fmt.Errorf("failed to read key of height %d: %v", height, err)
 	}
-	return res, nil
-}
-
-func (e *StorageEngine) ReadOffset(height int) (int, int, error) {
-	_, err := e.fDataPosR.Seek(int64(SliceDataPosLen*height), io.SeekStart)
-	if err != nil {
-		return 0, 0, err
-	}
-	td := make([]byte, 16)
-	_, err = io.ReadFull(e.fDataPosR, td)
-	if err != nil {
-		return 0, 0, err
-	}
-	a := int(binary.LittleEndian.Uint64(td[:8]))
-	b := int(binary.LittleEndian.Uint64(td[8:]))
-	return a, b, nil
+	return k, nil
 }
 
 func (e *StorageEngine) ReadData(height int, k SliceKeyType) ([]byte, error) {
+	e.mut.RLock()
 	d, ok := e.data[k]
+	e.mut.RUnlock()
 	if ok {
 		return d, nil
 	}
@@ -438,36 +478,30 @@ func (e *StorageEngine) ReadData(height int, k SliceKeyType) ([]byte, error) {
 	if ok {
 		return d, nil
 	}
-	npos, length, err := e.ReadOffset(height)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read data at slice %s height %d: %v", hex.EncodeToString(k[:]), height, err)
-	}
-	_, err = e.fDataR.Seek(int64(npos), io.SeekStart)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read data at slice %s height %d: %v", hex.EncodeToString(k[:]), height, err)
-	}
-	res := make([]byte, length)
-	_, err = io.ReadFull(e.fDataR, res)
+	res, err := e.backend.ReadData(height)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read data at slice %s height %d: %v", hex.EncodeToString(k[:]), height, err)
 	}
 	return res, nil
 }
 
-func (e *StorageEngine) storeRoot() (errr error) {
-	dpos, _ := e.fDataW.Seek(0, io.SeekCurrent)
-	ppos, _ := e.fDataPosW.Seek(0, io.SeekCurrent)
-	defer func() {
-		if errr != nil {
-			e.fDataW.Seek(dpos, io.SeekStart)
-			e.fDataPosW.Seek(ppos, io.SeekStart)
+func (e *StorageEngine) storeRoot() error {
+	// the root must never be ahead of the archive
+	if e.archive != nil {
+		err := e.archive.sync()
+		if err != nil {
+			return err
 		}
-	}()
+	}
+	// only mergeFa changes the root, and it's excluded by rootMut
+	e.mut.RLock()
+	root := e.ss[e.root]
+	rootData := e.data[e.root]
+	rootKey := e.root
+	e.mut.RUnlock()
 	if len(e.rq) > 0 {
-		if ppos != int64((e.rq[0].height+1)*SliceDataPosLen) {
-			return errors.New("file seek mismatch")
-		}
-		td := make([]byte, SliceDataPosLen)
+		keys := []SliceKeyType{}
+		data := [][]byte{}
 		curh := e.rq[0].height + 1
 		for i := 1; i <= len(e.rq); i++ {
 			var h int
@@ -475,72 +509,65 @@ func (e *StorageEngine) storeRoot() (errr error) {
 			var id SliceKeyType
 			if i < len(e.rq) {
 				h = e.rq[i].height
+				e.ldMut.Lock()
 				ud = e.ldata[h]
+				e.ldMut.Unlock()
 				id = e.rq[i].id
 			} else {
-				h = e.ss[e.root].height
-				ud = e.data[e.root]
-				id = e.root
+				h = root.height
+				ud = rootData
+				id = rootKey
 			}
-			if h != curh {
+			if h != curh+len(keys) {
 				return errors.New("recycle queue height mismatch")
 			}
-			curh++
-			pos, _ := e.fDataW.Seek(0, io.SeekCurrent)
-			binary.LittleEndian.PutUint64(td[:8], uint64(pos))
-			binary.LittleEndian.PutUint64(td[8:16], uint64(len(ud)))
-			copy(td[16:], id[:])
-			_, err := e.fDataPosW.Write(td)
-			if err != nil {
-				return err
-			}
-			_, err = e.fDataW.Write(ud)
-			if err != nil {
-				return err
-			}
+			keys = append(keys, id)
+			data = append(data, ud)
 		}
-		err := e.fDataPosW.Sync()
-		if err != nil {
-			return err
-		}
-		err = e.fDataW.Sync()
+		err := e.backend.WriteData(curh, keys, data)
 		if err != nil {
 			return err
 		}
 	}
-	fl, err := os.Create(filepath.Join(e.config.Path, "perm", "ss.next"))
-	if err != nil {
-		return err
-	}
-	bf := bufio.NewWriter(fl)
-	err = e.ss[e.root].DumpFile(bf)
-	if err != nil {
-		fl.Close()
-		return err
-	}
-	err = bf.Flush()
-	if err != nil {
-		fl.Close()
-		return err
+	// only the keys changed since the last store are written, and the values
+	// they had are kept for the slices reading the stored state
+	st := e.rootChanges()
+	undo := make(map[KeyType]DataType, len(st))
+	for k, v := range st {
+		u := e.backend.ReadState(k)
+		if v == (DataType{}) && u == (DataType{}) {
+			// set and cleared since the last store
+			delete(st, k)
+			continue
+		}
+		undo[k] = u
 	}
-	err = fl.Close()
+	e.state = e.state.close(undo)
+	err := e.backend.CommitState(root.height, st)
 	if err != nil {
 		return err
 	}
-	err = os.Rename(filepath.Join(e.config.Path, "perm", "ss.next"), filepath.Join(e.config.Path, "perm", "ss"))
-	if err != nil {
-		return err
+	// the slices above the root read the new state from now on, which is the
+	// same as that of the root
+	ns := e.state.slice(root.height)
+	e.mut.Lock()
+	e.ss[rootKey] = ns
+	for _, k := range e.son[rootKey] {
+		e.ss[k].setBase(ns)
 	}
+	e.mut.Unlock()
 	e.ldMut.Lock()
 	for i := 0; i < len(e.rq); i++ {
 		delete(e.ldata, e.rq[i].height)
 	}
 	e.ldMut.Unlock()
 	for i := 0; i < len(e.rq); i++ {
-		os.Remove(e.GetTempFileName(e.rq[i].id))
-		os.Remove(e.GetTempFileName(e.rq[i].id) + ".b")
+		e.backend.RemoveTemp(e.rq[i].id)
 	}
 	e.rq = []recycle{}
+	// the entries left are below the stored height, and skipped when replaying
+	e.backend.ClearLog()
+	e.logBroken = false
 	return nil
 }
 
@@ -554,7 +581,10 @@ func (e *StorageEngine) StoreFinalizedSlices(lastRoot SliceKeyType) {
 			e.stopped <- true
 			return
 		case <-e.flush:
-			e.flushed <- e.storeRoot()
+			e.rootMut <- true
+			err := e.storeRoot()
+			<-e.rootMut
+			e.flushed <- err
 			continue
 		case <-sleep:
 		}
@@ -574,7 +604,9 @@ func (e *StorageEngine) StoreFinalizedSlices(lastRoot SliceKeyType) {
 						sleepTime = time.Hour
 					}
 				} else {
+					e.mut.RLock()
 					log.Printf("failed to store root slice %s at height %d: %v", hex.EncodeToString(e.root[:]), e.ss[e.root].height, err)
+					e.mut.RUnlock()
 					sleepTime = time.Second * 30
 				}
 			}
@@ -585,6 +617,8 @@ func (e *StorageEngine) StoreFinalizedSlices(lastRoot SliceKeyType) {
 }
 
 func (e *StorageEngine) GetSlice(k SliceKeyType) (*Slice, bool) {
+	e.mut.RLock()
+	defer e.mut.RUnlock()
 	t, ok := e.ss[k]
 	return t, ok
 }
@@ -597,4 +631,8 @@ func (e *StorageEngine) Flush() error {
 func (e *StorageEngine) Stop() {
 	e.stop <- true
 	<-e.stopped
+	if e.archive != nil {
+		e.archive.close()
+	}
+	e.backend.Close()
 }
@@ -2,13 +2,17 @@ package storage
 
 import (
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 )
 
-func testStorage(t *testing.T, storeInMiddle bool) {
+func testStorage(t *testing.T, storeInMiddle bool, backend Backend) {
 	rnd := rand.New(rand.NewSource(114514))
 	randK := func() KeyType {
 		var k KeyType
@@ -24,6 +28,7 @@ func testStorage(t *testing.T, storeInMiddle bool) {
 		FinalizeDepth: 10,
 		DumpDiskRatio: 0.8,
 		Path:          "/tmp/tcoin_test/sto_test",
+		Backend:       backend,
 	}
 	err := os.RemoveAll("/tmp/tcoin_test/sto_test")
 	if err != nil {
@@ -147,9 +152,642 @@ func testStorage(t *testing.T, storeInMiddle bool) {
 }
 
 func TestStorage1(t *testing.T) {
-	testStorage(t, false)
+	testStorage(t, false, nil)
 }
 
 func TestStorage2(t *testing.T) {
-	testStorage(t, true)
+	testStorage(t, true, nil)
+}
+
+func TestStorageMemory(t *testing.T) {
+	testStorage(t, true, NewMemoryBackend())
+}
+
+func TestStorageSliceWork(t *testing.T) {
+	config := StorageEngineConfig{
+		FinalizeDepth: 10,
+		DumpDiskRatio: 0.8,
+		Path:          "/tmp/tcoin_test/sto_test_work",
+		SliceWork: func(data []byte) HashType {
+			return HashType{data[0]}
+		},
+	}
+	err := os.RemoveAll(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := EmptySlice()
+	root := SliceKeyType{1}
+	e, err := NewStorageEngine(config, is, root, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(k, f SliceKeyType, work byte) {
+		s := ForkSlice(e.ss[f])
+		s.Freeze()
+		err := e.AddFreezedSlice(s, k, f, []byte{work})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a long chain with little work
+	add(SliceKeyType{2}, root, 2)
+	add(SliceKeyType{3}, SliceKeyType{2}, 3)
+	add(SliceKeyType{4}, SliceKeyType{3}, 4)
+	// a short chain with more work
+	add(SliceKeyType{5}, root, 10)
+	if e.Head().Slice != e.ss[SliceKeyType{5}] || len(e.Head().Chain) != 2 {
+		t.Fatal("highest slice should have the most work")
+	}
+	// equal work doesn't replace the highest slice
+	add(SliceKeyType{6}, SliceKeyType{4}, 10)
+	if e.Head().Slice != e.ss[SliceKeyType{5}] {
+		t.Fatal("highest slice replaced by equal work")
+	}
+	add(SliceKeyType{7}, SliceKeyType{6}, 11)
+	if e.Head().Slice != e.ss[SliceKeyType{7}] || e.Head().Chain[len(e.Head().Chain)-1].Key != (SliceKeyType{7}) {
+		t.Fatal("highest slice should have the most work")
+	}
+	e.Stop()
+}
+
+func TestStorageArchive(t *testing.T) {
+	config := StorageEngineConfig{
+		FinalizeDepth: 5,
+		DumpDiskRatio: 0.8,
+		Path:          "/tmp/tcoin_test/sto_test_archive",
+		Archive:       true,
+	}
+	err := os.RemoveAll(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ka := KeyType{1, 1}
+	kb := KeyType{1, 2}
+	kl := KeyType{LocalKeyPrefix, 1}
+	val := func(i int) DataType {
+		var v DataType
+		binary.LittleEndian.PutUint64(v[:8], uint64(i))
+		return v
+	}
+	kc := func(i int) KeyType {
+		return KeyType{IndexedKeyPrefix, 3, 64: byte(i)}
+	}
+	cp := kc(0)
+	prefix := cp[:33]
+	// the storage of the contract at each height
+	cs := []map[KeyType]DataType{{}}
+	is := EmptySlice()
+	is.Write(kb, val(1000))
+	e, err := NewStorageEngine(config, is, SliceKeyType{}, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := SliceKeyType{}
+	for i := 1; i <= 50; i++ {
+		s := ForkSlice(e.ss[cur])
+		s.Write(ka, val(i))
+		if i%10 == 0 {
+			s.Write(kb, val(i*1000))
+		}
+		s.Write(kl, val(i))
+		c := make(map[KeyType]DataType)
+		for k, v := range cs[i-1] {
+			c[k] = v
+		}
+		c[kc(i%6)] = val(i)
+		s.Write(kc(i%6), val(i))
+		if i%4 == 0 {
+			delete(c, kc((i+3)%6))
+			s.Write(kc((i+3)%6), DataType{})
+		}
+		cs = append(cs, c)
+		s.Freeze()
+		sk := SliceKeyType{byte(i)}
+		err = e.AddFreezedSlice(s, sk, cur, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur = sk
+	}
+	check := func() {
+		for h := 0; h <= 45; h++ {
+			v, err := e.ReadHistory(ka, h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != val(h) {
+				t.Fatalf("wrong value at height %d: %x", h, v)
+			}
+			s, err := e.HistorySlice(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exp := val(1000)
+			if h >= 10 {
+				exp = val(h / 10 * 10000)
+			}
+			if s.Read(kb) != exp {
+				t.Fatalf("wrong value at height %d: %x", h, s.Read(kb))
+			}
+			if s.Read(kl) != (DataType{}) {
+				t.Fatal("local keys shouldn't be archived")
+			}
+			for _, limit := range []int{-1, 2} {
+				kvs, err := s.Iterate(prefix, kc(1), limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				n := 0
+				for i := 1; i < 6; i++ {
+					if v, ok := cs[h][kc(i)]; ok && (limit < 0 || n < limit) {
+						if n >= len(kvs) || kvs[n].Key != kc(i) || kvs[n].Value != v {
+							t.Fatalf("wrong storage at height %d: %v", h, kvs)
+						}
+						n++
+					}
+				}
+				if n != len(kvs) {
+					t.Fatalf("wrong storage at height %d: %v", h, kvs)
+				}
+			}
+			kvs, err := s.Iterate([]byte{1}, KeyType{}, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// ka is written from height 1
+			n := 2
+			if h == 0 {
+				n = 1
+			}
+			if len(kvs) != n || kvs[n-1].Key != kb || kvs[n-1].Value != exp {
+				t.Fatalf("wrong scan at height %d: %v", h, kvs)
+			}
+		}
+		_, err = e.ReadHistory(ka, 46)
+		if err != ErrNotArchived {
+			t.Fatalf("unfinalized height archived: %v", err)
+		}
+	}
+	check()
+	err = e.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Stop()
+	e, err = NewStorageEngine(config, is, SliceKeyType{}, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	e.Stop()
+
+	// the index is built again if it's lost
+	err = os.Remove(config.Path + "/perm/history.index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = NewStorageEngine(config, is, SliceKeyType{}, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	e.Stop()
+
+	// the heights above the root are dropped
+	a, err := openArchive(config.Path, 40, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := a.read(ka, 40)
+	if err != nil || v != val(40) {
+		t.Fatalf("wrong value at height 40: %x %v", v, err)
+	}
+	_, err = a.read(ka, 41)
+	if err != ErrNotArchived {
+		t.Fatalf("dropped height archived: %v", err)
+	}
+	err = a.append(41, map[KeyType]DataType{kb: val(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = a.read(ka, 41)
+	if err != nil || v != val(40) {
+		t.Fatalf("wrong value at height 41: %x %v", v, err)
+	}
+	kvs, err := a.list(prefix, KeyType{}, -1, 41)
+	if err != nil || len(kvs) != len(cs[40]) {
+		t.Fatalf("wrong storage at height 41: %v %v", kvs, err)
+	}
+	a.close()
+}
+
+func TestStorageMigrateRootDump(t *testing.T) {
+	config := StorageEngineConfig{
+		FinalizeDepth: 2,
+		DumpDiskRatio: 0.8,
+		Path:          "/tmp/tcoin_test/sto_test_migrate",
+	}
+	err := os.RemoveAll(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := EmptySlice()
+	is.Write(KeyType{1}, DataType{1})
+	e, err := NewStorageEngine(config, is, SliceKeyType{}, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := SliceKeyType{}
+	for i := 1; i <= 5; i++ {
+		s := ForkSlice(e.ss[cur])
+		s.Write(KeyType{2}, DataType{byte(i)})
+		s.Freeze()
+		sk := SliceKeyType{byte(i)}
+		err = e.AddFreezedSlice(s, sk, cur, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur = sk
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Stop()
+
+	// replace the state file with the root dump of older versions
+	old := EmptySlice()
+	old.height = 3
+	old.Write(KeyType{1}, DataType{1})
+	old.Write(KeyType{2}, DataType{3})
+	f, err := os.Create(config.Path + "/perm/ss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = old.DumpFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	err = os.Remove(config.Path + "/perm/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = NewStorageEngine(config, is, SliceKeyType{}, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	if e.Head().Slice.Height() != 5 {
+		t.Fatalf("wrong height %d", e.Head().Slice.Height())
+	}
+	if e.Head().Slice.Read(KeyType{1}) != (DataType{1}) || e.Head().Slice.Read(KeyType{2}) != (DataType{5}) {
+		t.Fatal("wrong state after migration")
+	}
+	if len(e.ss[e.root].st) != 0 {
+		t.Fatal("root state should be on disk")
+	}
+	res, err := e.Head().Slice.Iterate(nil, KeyType{}, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Key != (KeyType{1}) || res[1].Value != (DataType{5}) {
+		t.Fatalf("wrong iteration: %v", res)
+	}
+	if _, err := os.Stat(config.Path + "/perm/ss"); err == nil {
+		t.Fatal("root dump not removed")
+	}
+}
+
+func TestStoragePruneZero(t *testing.T) {
+	for _, backend := range []Backend{nil, NewMemoryBackend()} {
+		config := StorageEngineConfig{
+			FinalizeDepth: 2,
+			DumpDiskRatio: 0.8,
+			Path:          "/tmp/tcoin_test/sto_test_prune",
+			Backend:       backend,
+		}
+		err := os.RemoveAll(config.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		is := EmptySlice()
+		for i := 0; i < 10; i++ {
+			is.Write(KeyType{1, byte(i)}, DataType{1})
+		}
+		e, err := NewStorageEngine(config, is, SliceKeyType{}, []byte{0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		countState := func() int {
+			cnt := 0
+			err := e.backend.ForEachState(nil, func(k KeyType, v DataType) {
+				cnt++
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return cnt
+		}
+		if countState() != 10 {
+			t.Fatal("wrong initial state")
+		}
+		cur := SliceKeyType{}
+		add := func(i int, fn func(s *Slice)) {
+			s := ForkSlice(e.ss[cur])
+			fn(s)
+			s.Freeze()
+			sk := SliceKeyType{byte(i)}
+			err := e.AddFreezedSlice(s, sk, cur, []byte{byte(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cur = sk
+		}
+		// keys set and cleared before the root is stored never reach the backend
+		add(1, func(s *Slice) {
+			for i := 0; i < 10; i++ {
+				s.Write(KeyType{2, byte(i)}, DataType{2})
+			}
+		})
+		add(2, func(s *Slice) {
+			for i := 0; i < 10; i++ {
+				s.Write(KeyType{2, byte(i)}, DataType{})
+				s.Write(KeyType{1, byte(i)}, DataType{})
+			}
+		})
+		// the tombstones shadow the stored values
+		if e.Head().Slice.Read(KeyType{1, 0}) != (DataType{}) {
+			t.Fatal("tombstone should shadow the parent value")
+		}
+		for i := 3; i <= 5; i++ {
+			add(i, func(s *Slice) {})
+		}
+		root := e.ss[e.root]
+		if root.height != 3 {
+			t.Fatalf("wrong root height %d", root.height)
+		}
+		err = e.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(e.rootChanges()) != 0 || countState() != 0 {
+			t.Fatalf("deleted keys left in the state: %d", countState())
+		}
+		if e.Head().Slice.Read(KeyType{1, 0}) != (DataType{}) {
+			t.Fatal("deleted key should read zero")
+		}
+		e.Stop()
+	}
+}
+
+func TestStorageLog(t *testing.T) {
+	config := StorageEngineConfig{
+		FinalizeDepth: 2,
+		DumpDiskRatio: 0.8,
+		Path:          "/tmp/tcoin_test/sto_test_log",
+	}
+	err := os.RemoveAll(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := EmptySlice()
+	is.Write(KeyType{1}, DataType{1})
+	e, err := NewStorageEngine(config, is, SliceKeyType{}, []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := SliceKeyType{}
+	add := func(i int) {
+		s := ForkSlice(e.ss[cur])
+		s.Write(KeyType{2}, DataType{byte(i)})
+		s.Write(KeyType{3, byte(i)}, DataType{byte(i)})
+		s.Freeze()
+		sk := SliceKeyType{byte(i)}
+		err := e.AddFreezedSlice(s, sk, cur, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur = sk
+	}
+	for i := 1; i <= 5; i++ {
+		add(i)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 6; i <= 10; i++ {
+		add(i)
+	}
+	// the merged slices are only kept in the log
+	for i := 4; i <= 8; i++ {
+		if _, err := os.Stat(config.Path + "/temp/" + hex.EncodeToString([]byte{byte(i)}) + strings.Repeat("00", SliceKeyLen-1)); err == nil {
+			t.Fatalf("temp slice of height %d not removed", i)
+		}
+	}
+	e.Stop()
+
+	check := func() {
+		if e.backend.StateHeight() != 3 || e.ss[e.root].height != 8 || e.root != (SliceKeyType{8}) {
+			t.Fatalf("wrong root after replaying: %d %d", e.backend.StateHeight(), e.ss[e.root].height)
+		}
+		if e.Head().Slice.Height() != 10 || e.Head().Slice.Read(KeyType{2}) != (DataType{10}) {
+			t.Fatal("wrong highest slice after replaying")
+		}
+		for i := 1; i <= 10; i++ {
+			if e.Head().Slice.Read(KeyType{3, byte(i)}) != (DataType{byte(i)}) {
+				t.Fatalf("missing key of height %d", i)
+			}
+		}
+		d, err := e.ReadData(6, SliceKeyType{6})
+		if err != nil || d[0] != 6 {
+			t.Fatal("wrong data of a replayed height")
+		}
+	}
+	e, err = NewStorageEngine(config, is, SliceKeyType{}, []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	e.Stop()
+
+	// a partial entry at the end is dropped
+	f, err := os.OpenFile(config.Path+"/perm/wal", os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeLogEntry(&LogEntry{Height: 9, Key: SliceKeyType{9}})[:50])
+	f.Close()
+	e, err = NewStorageEngine(config, is, SliceKeyType{}, []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	err = e.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Stop()
+	st, err := os.Stat(config.Path + "/perm/wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != 0 {
+		t.Fatal("log not cleared after storing the root")
+	}
+	e, err = NewStorageEngine(config, is, SliceKeyType{}, []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	if e.backend.StateHeight() != 8 || e.Head().Slice.Height() != 10 {
+		t.Fatal("wrong state after storing the replayed root")
+	}
+	for i := 1; i <= 8; i++ {
+		d, err := e.ReadData(i, SliceKeyType{byte(i)})
+		if err != nil || d[0] != byte(i) {
+			t.Fatalf("wrong data of height %d", i)
+		}
+	}
+}
+
+func TestStorageConcurrent(t *testing.T) {
+	config := StorageEngineConfig{
+		FinalizeDepth: 10,
+		DumpDiskRatio: 0.8,
+		Path:          "/tmp/tcoin_test/sto_test_concurrent",
+	}
+	err := os.RemoveAll(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewStorageEngine(config, EmptySlice(), SliceKeyType{}, []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 200
+	done := make(chan bool)
+	errs := make(chan error, 4)
+	go func() {
+		cur := SliceKeyType{}
+		for i := 1; i <= n; i++ {
+			s := ForkSlice(e.Head().Slice)
+			s.Write(KeyType{1}, DataType{byte(i)})
+			s.Write(KeyType{2, byte(i)}, DataType{byte(i)})
+			s.Freeze()
+			sk := SliceKeyType{byte(i), 1}
+			err := e.AddFreezedSlice(s, sk, cur, []byte{byte(i)})
+			if err == nil && i%20 == 0 {
+				err = e.Flush()
+			}
+			if err != nil {
+				errs <- err
+				break
+			}
+			cur = sk
+		}
+		close(done)
+	}()
+	check := func() (int, error) {
+		h := e.Head()
+		height := h.Slice.Height()
+		last := h.Chain[len(h.Chain)-1]
+		if last.S != h.Slice {
+			return height, errors.New("chain doesn't end at the head")
+		}
+		if h.Slice.Read(KeyType{1}) != (DataType{byte(height)}) {
+			return height, errors.New("wrong value")
+		}
+		kvs, err := h.Slice.Iterate([]byte{2}, KeyType{}, -1)
+		if err != nil || len(kvs) != height {
+			return height, fmt.Errorf("wrong keys: %d %v", len(kvs), err)
+		}
+		d, err := e.ReadData(height, last.Key)
+		if err != nil || d[0] != byte(height) {
+			return height, fmt.Errorf("wrong data: %v", err)
+		}
+		return height, nil
+	}
+	for r := 0; r < 3; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				height, err := check()
+				if err != nil {
+					errs <- fmt.Errorf("height %d: %v", height, err)
+					return
+				}
+			}
+		}()
+	}
+	for r := 0; r < 3; r++ {
+		err := <-errs
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	if e.Head().Slice.Height() != n {
+		t.Fatalf("wrong height %d", e.Head().Slice.Height())
+	}
+	e.Stop()
+}
+
+func TestStorageOldHead(t *testing.T) {
+	config := StorageEngineConfig{
+		FinalizeDepth: 2,
+		DumpDiskRatio: 0.8,
+		Path:          "/tmp/tcoin_test/sto_test_old_head",
+	}
+	err := os.RemoveAll(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewStorageEngine(config, EmptySlice(), SliceKeyType{}, []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	cur := SliceKeyType{}
+	var old Head
+	for i := 1; i <= 30; i++ {
+		s := ForkSlice(e.Head().Slice)
+		s.Write(KeyType{1}, DataType{byte(i)})
+		s.Write(KeyType{2, byte(i)}, DataType{byte(i)})
+		s.Freeze()
+		sk := SliceKeyType{byte(i)}
+		err := e.AddFreezedSlice(s, sk, cur, []byte{byte(i)})
+		if err == nil && i%5 == 0 {
+			err = e.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur = sk
+		if i == 6 {
+			old = e.Head()
+		}
+	}
+	// the old head keeps its state after being merged into the root and stored
+	for i, c := range old.Chain {
+		h := c.S.Height()
+		if c.S.Read(KeyType{1}) != (DataType{byte(h)}) {
+			t.Fatalf("wrong value at %d of the chain: %x", i, c.S.Read(KeyType{1}))
+		}
+		kvs, err := c.S.Iterate([]byte{2}, KeyType{}, -1)
+		if err != nil || len(kvs) != h {
+			t.Fatalf("wrong keys at %d of the chain: %d %v", i, len(kvs), err)
+		}
+	}
 }
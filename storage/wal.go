@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The write-ahead log keeps the slices merged into the root since the last
+// commit of the root state, so they don't have to be kept as temp slices.
+// Each entry is the length of its content, the content (height, key, length
+// and content of the data, number of changes, changes) and its sha256.
+type LogEntry struct {
+	Height  int
+	Key     SliceKeyType
+	Data    []byte
+	Changes map[KeyType]DataType
+}
+
+func encodeLogEntry(l *LogEntry) []byte {
+	var buf bytes.Buffer
+	tmp := make([]byte, 8)
+	buf.Write(tmp)
+	binary.LittleEndian.PutUint64(tmp, uint64(l.Height))
+	buf.Write(tmp)
+	buf.Write(l.Key[:])
+	binary.LittleEndian.PutUint64(tmp, uint64(len(l.Data)))
+	buf.Write(tmp)
+	buf.Write(l.Data)
+	binary.LittleEndian.PutUint64(tmp, uint64(len(l.Changes)))
+	buf.Write(tmp)
+	for k, v := range l.Changes {
+		buf.Write(k[:])
+		buf.Write(v[:])
+	}
+	res := buf.Bytes()
+	binary.LittleEndian.PutUint64(res[:8], uint64(len(res)-8))
+	sum := sha256.Sum256(res[8:])
+	return append(res, sum[:]...)
+}
+
+var errLogEntry = errors.New("invalid log entry")
+
+// decode the entry at the start of d, and return its length
+func decodeLogEntry(d []byte) (*LogEntry, int, error) {
+	if len(d) < 8 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	n := binary.LittleEndian.Uint64(d[:8])
+	if n > uint64(len(d)-8) || uint64(len(d)-8)-n < HashLen {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	c := d[8 : 8+n]
+	sum := sha256.Sum256(c)
+	if !bytes.Equal(sum[:], d[8+n:8+n+HashLen]) {
+		return nil, 0, errLogEntry
+	}
+	if len(c) < 24+SliceKeyLen {
+		return nil, 0, errLogEntry
+	}
+	l := &LogEntry{Height: int(binary.LittleEndian.Uint64(c[:8]))}
+	copy(l.Key[:], c[8:8+SliceKeyLen])
+	c = c[8+SliceKeyLen:]
+	dl := binary.LittleEndian.Uint64(c[:8])
+	if dl > uint64(len(c)-16) {
+		return nil, 0, errLogEntry
+	}
+	l.Data = append([]byte{}, c[8:8+dl]...)
+	c = c[8+dl:]
+	cnt := binary.LittleEndian.Uint64(c[:8])
+	c = c[8:]
+	if uint64(len(c)) != cnt*(KeyLen+DataLen) {
+		return nil, 0, errLogEntry
+	}
+	l.Changes = make(map[KeyType]DataType, cnt)
+	var k KeyType
+	var v DataType
+	for p := 0; p < len(c); p += KeyLen + DataLen {
+		copy(k[:], c[p:p+KeyLen])
+		copy(v[:], c[p+KeyLen:p+KeyLen+DataLen])
+		l.Changes[k] = v
+	}
+	return l, int(8 + n + HashLen), nil
+}
+
+// decode the complete entries in the log, and return their length
+func decodeLog(d []byte) ([]*LogEntry, int) {
+	res := []*LogEntry{}
+	pos := 0
+	for pos < len(d) {
+		l, n, err := decodeLogEntry(d[pos:])
+		if err != nil {
+			break
+		}
+		res = append(res, l)
+		pos += n
+	}
+	return res, pos
+}
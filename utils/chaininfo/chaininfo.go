@@ -0,0 +1,39 @@
+package chaininfo
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// the info needed by wallets to sign a transaction for the next block, served
+// by /get_chain_info
+type ChainInfo struct {
+	ChainId     uint16 `json:"chain_id"`
+	Height      int    `json:"height"`
+	Tip3Enabled bool   `json:"tip3_enabled"`
+	Tip5Enabled bool   `json:"tip5_enabled"`
+	GasPrice    uint64 `json:"gas_price"`
+}
+
+// read the chain info from the rpc server at the url, which ends with a slash
+func Read(rpcUrl string) (ChainInfo, error) {
+	resp, err := http.Get(rpcUrl + "get_chain_info")
+	if err != nil {
+		return ChainInfo{}, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Status bool      `json:"status"`
+		Msg    string    `json:"msg"`
+		Data   ChainInfo `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return ChainInfo{}, err
+	}
+	if !res.Status {
+		return ChainInfo{}, errors.New(res.Msg)
+	}
+	return res.Data, nil
+}
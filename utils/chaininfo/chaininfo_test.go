@@ -0,0 +1,29 @@
+package chaininfo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/get_chain_info" {
+			w.Write([]byte(`{"status":false,"msg":"not found"}`))
+			return
+		}
+		w.Write([]byte(`{"status":true,"data":{"chain_id":8888,"height":12,"tip3_enabled":true,"tip5_enabled":false,"gas_price":3}}`))
+	}))
+	defer s.Close()
+	ci, err := Read(s.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci != (ChainInfo{ChainId: 8888, Height: 12, Tip3Enabled: true, GasPrice: 3}) {
+		t.Fatalf("wrong chain info: %+v", ci)
+	}
+	_, err = Read(s.URL + "/x/")
+	if err == nil || err.Error() != "not found" {
+		t.Fatalf("error not returned: %v", err)
+	}
+}
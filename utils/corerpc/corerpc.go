@@ -8,6 +8,7 @@ import (
 	"github.com/mcfx/tcoin/core"
 	"github.com/mcfx/tcoin/core/block"
 	"github.com/mcfx/tcoin/core/consensus"
+	"github.com/mcfx/tcoin/storage"
 	"github.com/mcfx/tcoin/utils/address"
 
 	"github.com/gin-gonic/gin"
@@ -26,12 +27,20 @@ func NewServer(c *core.ChainNode) *Server {
 	s.r.POST("/get_block_candidate", s.getBlockCandidate)
 	s.r.POST("/submit_block", s.submitBlock)
 	s.r.GET("/get_highest", s.getHighest)
+	s.r.GET("/get_chain_info", s.getChainInfo)
+	s.r.GET("/get_bans", s.getBans)
+	s.r.GET("/get_sync_status", s.getSyncStatus)
 	s.r.POST("/get_account_info", s.getAccountInfo)
 	s.r.GET("/get_account_info/:addr", s.getAccountInfo)
 	s.r.POST("/submit_tx", s.submitTx)
 	s.r.GET("/get_block/:blockid", s.getBlock)
 	s.r.GET("/get_storage_at/:addr/:pos", s.getStorageAt)
+	s.r.GET("/list_storage/:addr", s.listStorage)
 	s.r.GET("/get_contract_elf/:addr", s.getContractElf)
+	s.r.GET("/get_proof/:addr", s.getAccountProof)
+	s.r.GET("/get_proof/:addr/:pos", s.getStorageProof)
+	s.r.GET("/get_receipt/:txh", s.getReceipt)
+	s.r.GET("/get_logs", s.getLogs)
 	s.r.POST("/estimate_gas", s.estimateGas)
 	s.r.POST("/run_view_raw_code", s.runViewRawCode)
 	s.r.GET("/explorer/get_account_transactions/:addr/:page", s.explorerGetAccountTransactions)
@@ -105,6 +114,18 @@ func (s *Server) getHighest(c *gin.Context) {
 	c.JSON(200, gin.H{"status": true, "block": buf.Bytes(), "consensus": buf2.Bytes(), "height": cs.Height})
 }
 
+func (s *Server) getChainInfo(c *gin.Context) {
+	c.JSON(200, gin.H{"status": true, "data": s.c.GetChainInfo()})
+}
+
+func (s *Server) getBans(c *gin.Context) {
+	c.JSON(200, gin.H{"status": true, "bans": s.c.GetBans()})
+}
+
+func (s *Server) getSyncStatus(c *gin.Context) {
+	c.JSON(200, gin.H{"status": true, "data": s.c.GetSyncStatus()})
+}
+
 func (s *Server) getAccountInfo(c *gin.Context) {
 	var body struct {
 		Addr string `json:"addr"`
@@ -118,6 +139,20 @@ func (s *Server) getAccountInfo(c *gin.Context) {
 		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
 		return
 	}
+	if rh := c.Query("height"); rh != "" {
+		height, err := strconv.Atoi(rh)
+		if err != nil {
+			c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+			return
+		}
+		ai, err := s.c.GetAccountInfoAtHeight(addr, height)
+		if err != nil {
+			c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"status": true, "data": ai})
+		return
+	}
 	ai := s.c.GetAccountInfo(addr)
 	c.JSON(200, gin.H{"status": true, "data": ai})
 }
@@ -187,10 +222,192 @@ func (s *Server) getStorageAt(c *gin.Context) {
 	}
 	var posc block.HashType
 	copy(posc[:], pos)
+	if rh := c.Query("height"); rh != "" {
+		height, err := strconv.Atoi(rh)
+		if err != nil {
+			c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+			return
+		}
+		res, err := s.c.GetStorageAtHeight(addr, posc, height)
+		if err != nil {
+			c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"status": true, "data": hex.EncodeToString(res[:])})
+		return
+	}
 	res := s.c.GetStorageAt(addr, posc)
 	c.JSON(200, gin.H{"status": true, "data": hex.EncodeToString(res[:])})
 }
 
+func (s *Server) listStorage(c *gin.Context) {
+	addr, err := address.ParseAddr(c.Param("addr"))
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	var start block.HashType
+	if rstart := c.Query("start"); rstart != "" {
+		t, err := hex.DecodeString(rstart)
+		if err != nil {
+			c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+			return
+		}
+		if len(t) != block.HashLen {
+			c.JSON(200, gin.H{"status": false, "msg": "start length invalid"})
+			return
+		}
+		copy(start[:], t)
+	}
+	limit := 100
+	if rlimit := c.Query("limit"); rlimit != "" {
+		limit, err = strconv.Atoi(rlimit)
+		if err != nil {
+			c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+			return
+		}
+	}
+	res, err := s.c.ListStorage(addr, start, limit)
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	slots := make([]gin.H, len(res))
+	for i, slot := range res {
+		slots[i] = gin.H{"pos": hex.EncodeToString(slot.Pos[:]), "value": hex.EncodeToString(slot.Value[:])}
+	}
+	c.JSON(200, gin.H{"status": true, "slots": slots})
+}
+
+func encodeProof(bh *block.BlockHeader, p *storage.StateProof) ([]byte, []byte, error) {
+	var buf bytes.Buffer
+	err := block.EncodeBlockHeader(&buf, *bh)
+	if err != nil {
+		return nil, nil, err
+	}
+	var buf2 bytes.Buffer
+	err = storage.EncodeStateProof(&buf2, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), buf2.Bytes(), nil
+}
+
+func (s *Server) getAccountProof(c *gin.Context) {
+	raddr := c.Param("addr")
+	addr, err := address.ParseAddr(raddr)
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	ai, bh, p, err := s.c.GetAccountInfoWithProof(addr)
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	hb, pb, err := encodeProof(bh, p)
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": true, "data": ai, "header": hb, "proof": pb})
+}
+
+func (s *Server) getStorageProof(c *gin.Context) {
+	raddr := c.Param("addr")
+	rpos := c.Param("pos")
+	addr, err := address.ParseAddr(raddr)
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	pos, err := hex.DecodeString(rpos)
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	if len(pos) != block.HashLen {
+		c.JSON(200, gin.H{"status": false, "msg": "pos length invalid"})
+		return
+	}
+	var posc block.HashType
+	copy(posc[:], pos)
+	res, bh, p, err := s.c.GetStorageAtWithProof(addr, posc)
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	hb, pb, err := encodeProof(bh, p)
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": true, "data": hex.EncodeToString(res[:]), "header": hb, "proof": pb})
+}
+
+func (s *Server) getReceipt(c *gin.Context) {
+	txhStr := c.Param("txh")
+	txht, err := hex.DecodeString(txhStr)
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	if len(txht) != block.HashLen {
+		c.JSON(200, gin.H{"status": false, "msg": "hash length invalid"})
+		return
+	}
+	var txh block.HashType
+	copy(txh[:], txht)
+	rc, height, err := s.c.GetReceipt(txh)
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": true, "receipt": rc, "height": height})
+}
+
+func (s *Server) getLogs(c *gin.Context) {
+	from, err := strconv.Atoi(c.Query("from"))
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	to, err := strconv.Atoi(c.Query("to"))
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	var addr *block.AddressType
+	if raddr := c.Query("address"); raddr != "" {
+		t, err := address.ParseAddr(raddr)
+		if err != nil {
+			c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+			return
+		}
+		addr = &t
+	}
+	var topic *block.HashType
+	if rtopic := c.Query("topic"); rtopic != "" {
+		t, err := hex.DecodeString(rtopic)
+		if err != nil {
+			c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+			return
+		}
+		if len(t) != block.HashLen {
+			c.JSON(200, gin.H{"status": false, "msg": "topic length invalid"})
+			return
+		}
+		topic = &block.HashType{}
+		copy(topic[:], t)
+	}
+	res, err := s.c.GetLogs(addr, topic, from, to)
+	if err != nil {
+		c.JSON(200, gin.H{"status": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": true, "logs": res})
+}
+
 func (s *Server) getContractElf(c *gin.Context) {
 	raddr := c.Param("addr")
 	addr, err := address.ParseAddr(raddr)
@@ -221,12 +438,12 @@ func (s *Server) estimateGas(c *gin.Context) {
 		c.JSON(200, gin.H{"status": false, "msg": "invalid code"})
 		return
 	}
-	useGas, err := s.c.EstimateGas(addr, body.Code)
+	useGas, gasPrice, err := s.c.EstimateGas(addr, body.Code)
 	var es interface{} = nil
 	if err != nil {
 		es = err.Error()
 	}
-	c.JSON(200, gin.H{"status": true, "gas": useGas, "error": es})
+	c.JSON(200, gin.H{"status": true, "gas": useGas, "gas_price": gasPrice, "error": es})
 }
 
 func (s *Server) runViewRawCode(c *gin.Context) {